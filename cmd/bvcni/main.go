@@ -26,5 +26,11 @@ func main() {
 	// Init Logger
 	log.InitLogger(logFile)
 
-	skel.PluginMain(plugin.CmdAdd, plugin.CmdCheck, plugin.CmdDel, version.All, bv.BuildString(pluginName))
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:    plugin.CmdAdd,
+		Check:  plugin.CmdCheck,
+		Del:    plugin.CmdDel,
+		GC:     plugin.CmdGC,
+		Status: plugin.CmdStatus,
+	}, version.All, bv.BuildString(pluginName))
 }
@@ -1,23 +1,41 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"github.com/royroyee/bvcni/pkg/backend"
+	"github.com/royroyee/bvcni/pkg/bridge"
 	"github.com/royroyee/bvcni/pkg/config"
+	"github.com/royroyee/bvcni/pkg/gc"
+	ipa "github.com/royroyee/bvcni/pkg/ip"
+	"github.com/royroyee/bvcni/pkg/ippool"
 	"github.com/royroyee/bvcni/pkg/iptables"
 	pkg "github.com/royroyee/bvcni/pkg/k8s"
 	"github.com/royroyee/bvcni/pkg/signals"
+	"github.com/spf13/pflag"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/component-base/cli/flag"
 	"k8s.io/klog/v2"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	kubeconfigRefreshInterval = 10 * time.Minute
+	gcInterval                = time.Minute
 )
 
 func main() {
+	agentConfig := &config.AgentConfig{}
+	agentConfig.AddFlags(pflag.CommandLine)
 	flag.InitFlags()
 
 	// Run CNI Agent(bvcnid)
-	runCNIAgent()
+	runCNIAgent(agentConfig)
 }
 
-func runCNIAgent() {
+func runCNIAgent(agentConfig *config.AgentConfig) {
 
 	stopCh := signals.SetupSignalHandler()
 
@@ -33,28 +51,247 @@ func runCNIAgent() {
 		klog.Fatalf("GetCurrentNode error : %s", err.Error())
 	}
 
+	// Take the node's pod CIDR blocks from the IPPools instead of kube-controller-manager
+	var allocator *ippool.Allocator
+	if pools := agentConfig.IPPoolNames(); len(pools) > 0 {
+		if node.Spec.PodCIDR != "" {
+			klog.Warningf("node %s has podCIDR %s from kube-controller-manager, the IPPool blocks are used after it", node.Name, node.Spec.PodCIDR)
+		}
+		allocator = ippool.NewAllocator(pkg.InitDynamicClient(), pools, node.Name)
+
+		if err = allocator.ReleaseDeletedNodes(context.TODO(), pkg.NodeDeleted); err != nil {
+			klog.Errorf("ReleaseDeletedNodes error : %s", err.Error())
+		}
+
+		blocks, err := allocator.NodeBlocks(context.TODO())
+		if err != nil {
+			klog.Fatalf("IPPool NodeBlocks error : %s", err.Error())
+		}
+
+		if node, err = ippool.StoreNodeBlocks(node, blocks); err != nil {
+			klog.Fatalf("StoreNodeBlocks error : %s", err.Error())
+		}
+	}
+
+	// Check the cluster CIDR against the node's pod CIDR
+	if err = agentConfig.Validate(node); err != nil {
+		klog.Fatalf("Invalid bvcnid configuration : %s", err.Error())
+	}
+
+	// The plugin reports not ready (CNI STATUS) until the node is set up again
+	if err = config.ClearReady(ipa.DefaultDataDir); err != nil {
+		klog.Errorf("ClearReady error : %s", err.Error())
+	}
+
+	// The runtime only uses the first network config, another CNI's config would take over the node or be shadowed
+	others, err := config.OtherCNIConfigs()
+	if err != nil {
+		klog.Errorf("OtherCNIConfigs error : %s", err.Error())
+	}
+	if len(others) > 0 {
+		if agentConfig.RefuseOtherCNIConfigs() {
+			klog.Fatalf("other CNI configs found, remove them or set --other-cni-configs=warn : %v", others)
+		}
+		klog.Warningf("other CNI configs found, only one CNI must be installed : %v", others)
+	}
+
+	// Overlay between the nodes
+	overlay, err := backend.New(agentConfig.Backend)
+	if err != nil {
+		klog.Fatalf("Invalid bvcnid configuration : %s", err.Error())
+	}
+
+	// Pod MTU: the underlay MTU minus the encapsulation of the backend, unless it is configured
+	detectedMTU, detectErr := backend.PodMTU(overlay)
+	if detectErr != nil && agentConfig.ConfiguredMTU() == 0 {
+		klog.Fatalf("Detect pod MTU error : %s", detectErr.Error())
+	}
+	configMTU := detectedMTU
+	if mtu := agentConfig.ConfiguredMTU(); mtu > 0 {
+		if detectErr == nil && mtu > detectedMTU {
+			klog.Warningf("MTU %d is larger than the %d the underlay interface allows, large pod packets will be fragmented or dropped", mtu, detectedMTU)
+		}
+		configMTU = mtu
+	}
+	klog.Infof("pod MTU : %d", configMTU)
+
+	// Changed by the MTU watcher below, read by the pod CIDRs handler
+	var podMTU atomic.Int64
+	podMTU.Store(int64(configMTU))
+
+	// Kubeconfig for the plugin to look up pods (static IPs), refreshed as the service account token rotates.
+	// It is written before the config, the plugin fails ADDs of pods it cannot look up.
+	if err = pkg.WriteKubeconfig(config.KubeconfigPath); err != nil {
+		klog.Errorf("WriteKubeconfig error : %s", err.Error())
+	}
+	go wait.Until(func() {
+		if err := pkg.WriteKubeconfig(config.KubeconfigPath); err != nil {
+			klog.Errorf("WriteKubeconfig error : %s", err.Error())
+		}
+	}, kubeconfigRefreshInterval, stopCh)
+
 	// Init CNI plugin file
-	err = config.InitCNIPluginConfigFile(node)
+	err = config.InitCNIPluginConfigFile(node, configMTU, agentConfig)
 	if err != nil {
 		klog.Fatalf("InitCNIPluginConfigFile error : %s", err.Error())
 	}
 
+	// The pods set up before, ex) with the 1500 of earlier versions, get the pod MTU of the config as well
+	syncPodMTU(node, configMTU)
+
 	// Update iptables
-	iptables.UpdateIptables(node.Spec.PodCIDR)
+	iptablesErr := iptables.UpdateIptables(config.NodePodCIDRs(node), agentConfig.ClusterNets())
+	if iptablesErr != nil {
+		klog.Errorf("UpdateIptables error : %s", iptablesErr.Error())
+	}
 
-	// Create VXLAN interface
-	vxlanLink, vxlanAddr, err := backend.InitVxlan(node.Spec.PodCIDR)
+	// Create the overlay device, ex) VXLAN interface
+	annotations, err := overlay.Init(config.NodePodCIDRs(node), agentConfig.ClusterNets())
 	if err != nil {
-		klog.Fatalf("Init VXLAN interface error: %s", err.Error())
+		klog.Fatalf("Init %s backend error: %s", agentConfig.Backend, err.Error())
 	}
 
-	// Each node stores its VXLAN information in its own node annotations for updating ARP and FDB
-	err = backend.StoreVxlanInfo(node, vxlanLink)
-	if err != nil {
-		klog.Fatalf("Store VXLAN infro error: %s", err.Error())
+	// Each node stores what the other nodes need to reach it (ex. VTEP MAC) in its own node annotations
+	if err = pkg.AnnotateNode(node, annotations); err != nil {
+		klog.Fatalf("Store %s backend annotations error: %s", agentConfig.Backend, err.Error())
+	}
+
+	if iptablesErr == nil {
+		if err = config.MarkReady(ipa.DefaultDataDir, overlay.Device()); err != nil {
+			klog.Errorf("MarkReady error : %s", err.Error())
+		}
 	}
 
 	// Add Handler of NodeInformer
-	pkg.SetUpNodeHandler(node.Name, vxlanLink, vxlanAddr)
+	pkg.SetUpNodeHandler(node.Name, overlay)
+
+	store, err := ipa.NewStore(ipa.DefaultDataDir)
+	if err != nil {
+		klog.Fatalf("NewStore error : %s", err.Error())
+	}
+	store.SetQuarantine(agentConfig.IPQuarantine())
+
+	// Release the IPs of pods that kubelet never DELeted (node crash, runtime bug)
+	if err = pkg.InitPodInformer(clientSet, node.Name, stopCh); err != nil {
+		klog.Fatalf("InitPodInformer error : %s", err.Error())
+	}
+	collector := gc.NewCollector(store, pkg.PodRunning, agentConfig.GCWindow(), agentConfig.StickyIPGrace())
+	// Each release shows up on the node (kubectl describe node), with the number released so far
+	collector.SetOnRelease(func(message string) {
+		if err := pkg.RecordNodeEvent(node, coreV1.EventTypeWarning, "LeakedIPsReleased", message); err != nil {
+			klog.Errorf("RecordNodeEvent error : %s", err.Error())
+		}
+	})
+	go collector.Run(stopCh, gcInterval)
+
+	if allocator != nil {
+		// Blocks of deleted nodes go back to the pools
+		pkg.AddNodeDeleteHandler(func(deleted *coreV1.Node) {
+			if err := allocator.Release(context.TODO(), deleted.Name); err != nil {
+				klog.Errorf("IPPool Release error : %s", err.Error())
+			}
+		})
+
+		// Another block once the current ones are nearly full, the pod CIDRs handler below picks it up
+		// It runs on the allocator's goroutine, so it patches the node of the informer cache and leaves node alone.
+		go allocator.Run(stopCh, store, func(blocks []string) {
+			current, err := pkg.GetCurrentNode()
+			if err != nil {
+				klog.Errorf("GetCurrentNode error : %s", err.Error())
+				return
+			}
+			if _, err = ippool.StoreNodeBlocks(current, blocks); err != nil {
+				klog.Errorf("StoreNodeBlocks error : %s", err.Error())
+			}
+		})
+	}
+
+	// Follow the MTU of the underlay interface, ex) when jumbo frames are enabled on the node.
+	// The watcher compares against the detected MTU, without one there is nothing to follow.
+	if detectErr == nil {
+		go backend.WatchUnderlayMTU(stopCh, overlay, detectedMTU, func(underlay string, mtu int) {
+			reconcileMTU(agentConfig, overlay, &podMTU, underlay, mtu)
+		})
+	} else {
+		klog.Warningf("Detect pod MTU error : %s, MTU changes of the underlay interface are not followed", detectErr.Error())
+	}
+
+	// The plugin allocates from the new pod CIDRs of the node once they are in the config
+	pkg.AddNodePodCIDRsHandler(node.Name, func(updated *coreV1.Node) {
+		if err := config.InitCNIPluginConfigFile(updated, int(podMTU.Load()), agentConfig); err != nil {
+			klog.Errorf("InitCNIPluginConfigFile error : %s", err.Error())
+		}
+
+		if err := iptables.UpdateIptables(config.NodePodCIDRs(updated), agentConfig.ClusterNets()); err != nil {
+			klog.Errorf("UpdateIptables error : %s", err.Error())
+		}
+	})
 	<-stopCh
 }
+
+// syncPodMTU gives mtu to cni0 and the veths of the running pods when bvcnid starts, and records the pods that had
+// another MTU as an event on the node.
+func syncPodMTU(node *coreV1.Node, mtu int) {
+	event := func(eventType, reason, message string) {
+		if err := pkg.RecordNodeEvent(node, eventType, reason, message); err != nil {
+			klog.Errorf("RecordNodeEvent error : %s", err.Error())
+		}
+	}
+
+	updated, err := bridge.SetPodMTU(mtu)
+	if err != nil {
+		klog.Errorf("SetPodMTU error : %s", err.Error())
+		event(coreV1.EventTypeWarning, "PodMTUChangeFailed", fmt.Sprintf("setting MTU %d on %s and the pod veths failed, %d pods updated: %s", mtu, bridge.BridgeName, updated, err))
+		return
+	}
+	if updated > 0 {
+		klog.Infof("pod MTU %d set on %s and %d pods with another MTU", mtu, bridge.BridgeName, updated)
+		event(coreV1.EventTypeNormal, "PodMTUChanged", fmt.Sprintf("pod MTU %d set on %s and %d pods with another MTU", mtu, bridge.BridgeName, updated))
+	}
+}
+
+// reconcileMTU applies the MTU that follows a new underlay MTU to the overlay device and, unless the pod MTU is
+// configured, to the CNI config, cni0 and the veths of the running pods. Each change is recorded as an event on the node.
+func reconcileMTU(agentConfig *config.AgentConfig, overlay backend.Backend, podMTU *atomic.Int64, underlay string, mtu int) {
+	node, err := pkg.GetCurrentNode()
+	if err != nil {
+		klog.Errorf("GetCurrentNode error : %s", err.Error())
+		return
+	}
+
+	event := func(eventType, reason, message string) {
+		if err := pkg.RecordNodeEvent(node, eventType, reason, message); err != nil {
+			klog.Errorf("RecordNodeEvent error : %s", err.Error())
+		}
+	}
+
+	if err = overlay.SetMTU(mtu); err != nil {
+		klog.Errorf("SetMTU error : %s", err.Error())
+		event(coreV1.EventTypeWarning, "OverlayMTUChangeFailed", fmt.Sprintf("MTU of %s changed, setting MTU %d on %s failed: %s", underlay, mtu, overlay.Device(), err))
+		return
+	}
+	event(coreV1.EventTypeNormal, "OverlayMTUChanged", fmt.Sprintf("MTU of %s changed, MTU of %s set to %d", underlay, overlay.Device(), mtu))
+
+	// The configured pod MTU stays as it is
+	if configured := agentConfig.ConfiguredMTU(); configured > 0 {
+		if configured > mtu {
+			klog.Warningf("MTU %d is larger than the %d the underlay interface allows, large pod packets will be fragmented or dropped", configured, mtu)
+		}
+		return
+	}
+
+	// New pods take the MTU from the config, it is written before the running pods are updated
+	oldPodMTU := podMTU.Swap(int64(mtu))
+	if err = config.InitCNIPluginConfigFile(node, mtu, agentConfig); err != nil {
+		klog.Errorf("InitCNIPluginConfigFile error : %s", err.Error())
+	}
+
+	updated, err := bridge.SetPodMTU(mtu)
+	if err != nil {
+		klog.Errorf("SetPodMTU error : %s", err.Error())
+		event(coreV1.EventTypeWarning, "PodMTUChangeFailed", fmt.Sprintf("setting MTU %d on %s and the pod veths failed, %d pods updated: %s", mtu, bridge.BridgeName, updated, err))
+		return
+	}
+	klog.Infof("pod MTU set from %d to %d on %s and %d pods", oldPodMTU, mtu, bridge.BridgeName, updated)
+	event(coreV1.EventTypeNormal, "PodMTUChanged", fmt.Sprintf("pod MTU set from %d to %d on %s and %d pods", oldPodMTU, mtu, bridge.BridgeName, updated))
+}
@@ -0,0 +1,47 @@
+package backend
+
+import (
+	"github.com/pkg/errors"
+	coreV1 "k8s.io/api/core/v1"
+	"net"
+)
+
+// Backend is the overlay that carries the pod traffic between the nodes. bvcnid initializes it for the pod CIDRs
+// of the node, publishes the annotations it returns on the node, and keeps the peers in sync with the other nodes.
+type Backend interface {
+	// Init sets up the overlay device of the node and routes the cluster pod networks (one per IP family) over it.
+	// It returns the node annotations the other nodes need to reach this node.
+	Init(podCidrs []string, clusterCidrs []*net.IPNet) (map[string]string, error)
+
+	// AddPeer sets up the entries to reach the pod CIDRs of another node.
+	AddPeer(node *coreV1.Node) error
+
+	// UpdatePeer follows the changes of another node, ex) another pod CIDR. Changes that do not concern the backend are ignored.
+	UpdatePeer(oldNode, newNode *coreV1.Node) error
+
+	// RemovePeer deletes the entries of a node that left the cluster.
+	RemovePeer(node *coreV1.Node) error
+
+	// Teardown deletes the overlay device of the node, and with it everything routed over it.
+	// Nothing calls it yet: bvcnid leaves the device up on shutdown so that a restart does not cut the pod traffic.
+	Teardown() error
+
+	// EncapOverhead returns how many bytes the encapsulation adds to each pod packet.
+	EncapOverhead() int
+
+	// Device returns the name of the overlay device, ex) vxlan.1
+	Device() string
+
+	// SetMTU changes the MTU of the overlay device, ex) after the MTU of the underlay interface changed.
+	SetMTU(mtu int) error
+}
+
+// New returns the backend of the name. Empty means the default backend.
+func New(name string) (Backend, error) {
+	switch name {
+	case "", vxlanBackendName:
+		return &vxlanBackend{}, nil
+	}
+
+	return nil, errors.Errorf("unknown backend %q, supported are: %s", name, vxlanBackendName)
+}
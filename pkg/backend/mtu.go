@@ -0,0 +1,84 @@
+package backend
+
+import (
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"time"
+)
+
+// resubscribeInterval is how long WatchUnderlayMTU waits before it subscribes again after the subscription failed.
+const resubscribeInterval = 5 * time.Second
+
+// PodMTU returns the MTU of the pod interfaces: the MTU of the underlay interface (the one of the default route)
+// minus the encapsulation of the backend, so that encapsulated pod packets still fit the underlay.
+func PodMTU(b Backend) (int, error) {
+	gateway, err := getDefaultGatewayInterface()
+	if err != nil {
+		return 0, errors.Wrap(err, "getDefaultGatewayInterface error")
+	}
+
+	return gateway.MTU - b.EncapOverhead(), nil
+}
+
+// WatchUnderlayMTU subscribes to the link updates of the underlay interface and calls fn with the name of the
+// interface and the new pod MTU, its MTU minus the encapsulation of the backend, whenever that differs from podMTU.
+// It runs until stopCh is closed.
+func WatchUnderlayMTU(stopCh <-chan struct{}, b Backend, podMTU int, fn func(underlay string, podMTU int)) {
+	wait.Until(func() {
+		gateway, err := getDefaultGatewayInterface()
+		if err != nil {
+			klog.Errorf("getDefaultGatewayInterface error : %s", err.Error())
+			return
+		}
+
+		updates := make(chan netlink.LinkUpdate)
+		done := make(chan struct{})
+
+		// ListExisting catches a change made before the subscription
+		if err = netlink.LinkSubscribeWithOptions(updates, done, netlink.LinkSubscribeOptions{
+			ListExisting: true,
+			ErrorCallback: func(err error) {
+				select {
+				case <-done: // closing the subscription
+				default:
+					klog.Errorf("link subscription error : %s", err.Error())
+				}
+			},
+		}); err != nil {
+			close(done)
+			klog.Errorf("LinkSubscribe error : %s", err.Error())
+			return
+		}
+		defer func() {
+			close(done)
+			// Unblock the subscription until it sees done and closes updates
+			for range updates {
+			}
+		}()
+
+		for {
+			select {
+			case <-stopCh:
+				return
+			case update, ok := <-updates:
+				// The subscription failed, subscribe again
+				if !ok {
+					return
+				}
+
+				attrs := update.Link.Attrs()
+				if attrs.Index != gateway.Index {
+					continue
+				}
+
+				if mtu := attrs.MTU - b.EncapOverhead(); mtu != podMTU {
+					klog.Infof("MTU of underlay interface %s changed to %d", attrs.Name, attrs.MTU)
+					podMTU = mtu
+					fn(attrs.Name, mtu)
+				}
+			}
+		}
+	}, resubscribeInterval, stopCh)
+}
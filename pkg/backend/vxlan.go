@@ -3,38 +3,245 @@ package backend
 import (
 	"fmt"
 	"github.com/pkg/errors"
-	pkg "github.com/royroyee/bvcni/pkg/k8s"
+	bvconfig "github.com/royroyee/bvcni/pkg/config"
 	"github.com/royroyee/bvcni/pkg/utils"
 	"github.com/vishvananda/netlink"
 	coreV1 "k8s.io/api/core/v1"
 	"k8s.io/klog/v2"
 	"net"
+	"reflect"
 	"strings"
 	"syscall"
 )
 
 const (
+	vxlanBackendName = "vxlan"
+
 	vxlanName     = "vxlan.1"
 	vxlanVni      = 1
 	vxlanPort     = 8472
-	encapOverhead = 50
+	encapOverhead = 50 // outer IPv4 (20), UDP (8) and VXLAN (8) headers, and the inner Ethernet header (14)
 
 	bvcniVtepMacAnnotationKey = "bvcni.vtep.mac"
 	bvcniHostIPAnnotationKey  = "bvcni.host.ip"
 )
 
-func InitVxlan(podCidr string) (*netlink.Vxlan, net.IP, error) {
+// vxlanBackend is the VXLAN overlay: every node has a VXLAN device (VTEP) over its IPv4 underlay, which carries
+// both IPv4 and IPv6 pod traffic. The other nodes reach it through the VTEP MAC and host IP of its annotations.
+type vxlanBackend struct {
+	device *netlink.Vxlan
+}
+
+// vxlanPeer is what a node needs to reach the pod CIDRs of another node.
+type vxlanPeer struct {
+	IPNets  []*net.IPNet // pod CIDRs, several per IP family when the node grew
+	VtepMac net.HardwareAddr
+	HostIP  net.IP
+}
+
+// Init creates and configures the VXLAN device, and routes the cluster pod networks (clusterCidrs, one per IP family) over it.
+// It returns the VTEP MAC and host IP annotations of the node.
+func (b *vxlanBackend) Init(podCidrs []string, clusterCidrs []*net.IPNet) (map[string]string, error) {
 
 	// 1. Create VXLAN interface
 	vxlanDevice, err := createVxlan()
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "Faild to create VXLAN interface")
+		return nil, errors.Wrap(err, "Faild to create VXLAN interface")
 	}
 
 	// 2. Allocate IP address and set up interface
-	vxlanDevice, vxlanAddr, err := setVxlan(podCidr, vxlanDevice)
+	if err = setVxlan(podCidrs, clusterCidrs, vxlanDevice); err != nil {
+		return nil, errors.Wrap(err, "Failed to set up VXLAN interface")
+	}
+	b.device = vxlanDevice
 
-	return vxlanDevice, vxlanAddr, nil
+	klog.Infof("mac: %s", vxlanDevice.HardwareAddr.String())
+	klog.Infof("host ip: %s", vxlanDevice.SrcAddr.String())
+
+	// TODO - Use a more efficient method instead of annotations
+	// Original code : https://github.com/nuczzz/mycni
+	return map[string]string{
+		bvcniVtepMacAnnotationKey: vxlanDevice.HardwareAddr.String(),
+		bvcniHostIPAnnotationKey:  vxlanDevice.SrcAddr.String(),
+	}, nil
+}
+
+// AddPeer adds the FDB entry of the node's VTEP, and the ARP entry and route of each of its pod CIDRs.
+func (b *vxlanBackend) AddPeer(node *coreV1.Node) error {
+	peer, err := vxlanPeerOf(node)
+	if err != nil {
+		return err
+	}
+
+	// The FDB entry is shared by every IP family, since the underlay is the node's host IP.
+	if err = utils.AddFDB(b.device.Index, peer.HostIP, peer.VtepMac); err != nil {
+		return fmt.Errorf("error adding FDB for node %s: %w", node.Name, err)
+	}
+
+	// ARP (IPv4) or neighbor (IPv6) entry and route for each pod CIDR of the node
+	for _, ipnet := range peer.IPNets {
+		if err = utils.AddArp(b.device.Index, ipnet.IP, peer.VtepMac); err != nil {
+			return fmt.Errorf("error adding ARP for node %s: %w", node.Name, err)
+		}
+
+		if err = utils.ReplaceRoute(b.device.Index, ipnet); err != nil {
+			return fmt.Errorf("error replacing route for node %s: %w", node.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// UpdatePeer follows a new VTEP MAC or host IP of the node, or pod CIDRs it got or lost (IPPool blocks).
+func (b *vxlanBackend) UpdatePeer(oldNode, newNode *coreV1.Node) error {
+	if oldNode.Annotations[bvcniVtepMacAnnotationKey] == newNode.Annotations[bvcniVtepMacAnnotationKey] &&
+		oldNode.Annotations[bvcniHostIPAnnotationKey] == newNode.Annotations[bvcniHostIPAnnotationKey] &&
+		reflect.DeepEqual(bvconfig.NodePodCIDRs(oldNode), bvconfig.NodePodCIDRs(newNode)) {
+		return nil
+	}
+
+	klog.Infof("node update event: %s", newNode.Name)
+
+	if err := b.removePodCIDRs(oldNode, newNode); err != nil {
+		return err
+	}
+
+	return b.AddPeer(newNode)
+}
+
+// removePodCIDRs deletes the ARP entries and routes of the pod CIDRs that oldNode had and newNode no longer has,
+// and the FDB entry of the old VTEP when it changed.
+func (b *vxlanBackend) removePodCIDRs(oldNode, newNode *coreV1.Node) error {
+	old, err := vxlanPeerOf(oldNode)
+	if err != nil {
+		// No overlay entries were added for the node
+		return nil
+	}
+
+	kept := make(map[string]bool)
+	for _, podCidr := range bvconfig.NodePodCIDRs(newNode) {
+		kept[podCidr] = true
+	}
+
+	for _, ipnet := range old.IPNets {
+		if kept[ipnet.String()] {
+			continue
+		}
+
+		klog.Infof("pod CIDR %s removed from node %s", ipnet, newNode.Name)
+		if err = utils.DelArp(b.device.Index, ipnet.IP, old.VtepMac); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return fmt.Errorf("error deleting ARP for node %s: %w", newNode.Name, err)
+		}
+
+		if err = utils.DelRoute(b.device.Index, ipnet); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return fmt.Errorf("error deleting route for node %s: %w", newNode.Name, err)
+		}
+	}
+
+	if newNode.Annotations[bvcniVtepMacAnnotationKey] != old.VtepMac.String() || newNode.Annotations[bvcniHostIPAnnotationKey] != old.HostIP.String() {
+		if err = utils.DelFDB(b.device.Index, old.HostIP, old.VtepMac); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return fmt.Errorf("error deleting FDB for node %s: %w", newNode.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// RemovePeer deletes the ARP entries, FDB entry and routes of the node.
+func (b *vxlanBackend) RemovePeer(node *coreV1.Node) error {
+	peer, err := vxlanPeerOf(node)
+	if err != nil {
+		return err
+	}
+
+	klog.Infof("Node delete event: %s", node.Name)
+
+	for _, ipnet := range peer.IPNets {
+		if err = utils.DelArp(b.device.Index, ipnet.IP, peer.VtepMac); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return fmt.Errorf("error deleting ARP for node %s: %w", node.Name, err)
+		}
+	}
+
+	if err = utils.DelFDB(b.device.Index, peer.HostIP, peer.VtepMac); err != nil && !errors.Is(err, syscall.ENOENT) {
+		return fmt.Errorf("error deleting FDB for node %s: %w", node.Name, err)
+	}
+
+	for _, ipnet := range peer.IPNets {
+		if err = utils.DelRoute(b.device.Index, ipnet); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return fmt.Errorf("error deleting route for node %s: %w", node.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Teardown deletes the VXLAN device, the kernel removes its FDB and ARP entries and routes with it.
+func (b *vxlanBackend) Teardown() error {
+	link, err := netlink.LinkByName(vxlanName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return errors.Wrapf(err, "get link %s error", vxlanName)
+	}
+
+	if err = netlink.LinkDel(link); err != nil {
+		return errors.Wrapf(err, "delete link %s error", vxlanName)
+	}
+	b.device = nil
+
+	return nil
+}
+
+// EncapOverhead returns the size of the VXLAN encapsulation over the IPv4 underlay.
+func (b *vxlanBackend) EncapOverhead() int {
+	return encapOverhead
+}
+
+// Device returns the name of the VXLAN device.
+func (b *vxlanBackend) Device() string {
+	return vxlanName
+}
+
+// SetMTU changes the MTU of the VXLAN device.
+func (b *vxlanBackend) SetMTU(mtu int) error {
+	if b.device == nil {
+		return errors.Errorf("vxlan device %s is not initialized", vxlanName)
+	}
+
+	return setVxlanMTU(b.device, mtu)
+}
+
+// vxlanPeerOf reads the pod CIDRs and the VTEP annotations of the node.
+func vxlanPeerOf(node *coreV1.Node) (*vxlanPeer, error) {
+	var ipnets []*net.IPNet
+	for _, podCidr := range bvconfig.NodePodCIDRs(node) {
+		_, ipnet, err := net.ParseCIDR(podCidr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse CIDR %s for node %s: %w", podCidr, node.Name, err)
+		}
+		ipnets = append(ipnets, ipnet)
+	}
+
+	if len(ipnets) == 0 {
+		return nil, fmt.Errorf("node %s has no pod CIDR", node.Name)
+	}
+
+	vtepMac, err := net.ParseMAC(node.Annotations[bvcniVtepMacAnnotationKey])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse MAC %s for node %s: %w", node.Annotations[bvcniVtepMacAnnotationKey], node.Name, err)
+	}
+
+	hostIP := net.ParseIP(node.Annotations[bvcniHostIPAnnotationKey])
+	if hostIP == nil {
+		return nil, fmt.Errorf("host IP for node %s is nil", node.Name)
+	}
+
+	return &vxlanPeer{
+		IPNets:  ipnets,
+		VtepMac: vtepMac,
+		HostIP:  hostIP,
+	}, nil
 }
 
 // If there is no vxlan interface, create the interface.
@@ -54,9 +261,7 @@ func createVxlan() (*netlink.Vxlan, error) {
 		return nil, errors.Errorf("length of local host addrs is 0")
 	}
 
-	vxlanDevice, err := ensureVxlanExists(gateway, localHostAddrs[0].IP)
-
-	return vxlanDevice, nil
+	return ensureVxlanExists(gateway, localHostAddrs[0].IP)
 }
 
 func ensureVxlanExists(gateway *net.Interface, srcAddr net.IP) (*netlink.Vxlan, error) {
@@ -82,84 +287,108 @@ func ensureVxlanExists(gateway *net.Interface, srcAddr net.IP) (*netlink.Vxlan,
 				return nil, errors.Wrap(err, "LinkAdd vxlan error")
 			}
 
-			return vxlan, nil
+			// Lookup the device again so that the attributes assigned by the kernel (index, VTEP MAC) are filled in.
+			if link, err = netlink.LinkByName(vxlanName); err != nil {
+				return nil, errors.Wrapf(err, "get link %s error", vxlanName)
+			}
+		} else {
+			return nil, errors.Wrapf(err, "get link %s error", vxlanName)
 		}
-
-		return nil, errors.Wrapf(err, "get link %s error", vxlanName)
 	}
 
 	v, ok := link.(*netlink.Vxlan)
-	if ok {
-		klog.Infof("vxlan device %s already exists", vxlanName)
-		return v, nil
+	if !ok {
+		return nil, errors.Errorf("link %s already exists but not vxlan device", vxlanName)
+	}
+
+	// The underlay MTU may have changed since the device was created
+	if err = setVxlanMTU(v, gateway.MTU-encapOverhead); err != nil {
+		return nil, err
 	}
 
-	return nil, errors.Errorf("link %s already exists but not vxlan device", vxlanName)
+	return v, nil
 }
 
-func setVxlan(podCidr string, vxlanDevice *netlink.Vxlan) (*netlink.Vxlan, net.IP, error) {
-	_, ipnet, err := net.ParseCIDR(podCidr)
-	if err != nil {
-		return nil, nil, fmt.Errorf("ParseCIDR error: %w", err)
-	}
+// setVxlan gives the VXLAN device the network address of each pod CIDR as a host address and brings it up.
+func setVxlan(podCidrs []string, clusterCidrs []*net.IPNet, vxlanDevice *netlink.Vxlan) error {
+	for _, podCidr := range podCidrs {
+		_, ipnet, err := net.ParseCIDR(podCidr)
+		if err != nil {
+			return fmt.Errorf("ParseCIDR error: %w", err)
+		}
 
-	addrList, err := netlink.AddrList(vxlanDevice, syscall.AF_INET) // AF_INET : 2 , IPv4
-	if err != nil {
-		return nil, nil, fmt.Errorf("AddrList error: %w", err)
+		if err = addVxlanAddr(vxlanDevice, ipnet); err != nil {
+			return err
+		}
 	}
 
-	if len(addrList) == 0 {
-		klog.Infof("config vxlan device %s ip: %s", vxlanDevice.Name, ipnet.IP)
-		addr := &netlink.Addr{
-			IPNet: &net.IPNet{
-				IP:   ipnet.IP,
-				Mask: net.IPv4Mask(255, 255, 255, 255),
-			},
-		}
+	if err := netlink.LinkSetUp(vxlanDevice); err != nil {
+		return fmt.Errorf("LinkSetUp error: %w", err)
+	}
 
-		if err = netlink.AddrAdd(vxlanDevice, addr); err != nil {
-			return nil, nil, fmt.Errorf("AddrAdd error: %w", err)
+	// Route the cluster pod networks over VXLAN. ex) 10.244.0.0/16, fd00:10:244::/56
+	// The local pod CIDRs stay on cni0 because their routes are more specific.
+	for _, clusterCidr := range clusterCidrs {
+		if err := utils.ReplaceRoute(vxlanDevice.Attrs().Index, clusterCidr); err != nil {
+			klog.Errorf("Error replacing route for vxlan, err : %s, clusterCidr : %s", err, clusterCidr)
+			return errors.Wrapf(err, "vxlan add event ReplaceRoute error")
 		}
+		klog.Infof("ReplaceRoute: ip route replace %s dev %s", clusterCidr, vxlanDevice.Name)
 	}
 
-	if err = netlink.LinkSetUp(vxlanDevice); err != nil {
-		return nil, nil, fmt.Errorf("LinkSetUp error: %w", err)
+	return nil
+}
+
+// addVxlanAddr adds the network address of the pod CIDR to the VXLAN device (/32 or /128)
+// unless the device already has an address of that IP family.
+func addVxlanAddr(vxlanDevice *netlink.Vxlan, ipnet *net.IPNet) error {
+	family, bits := syscall.AF_INET, 32 // AF_INET : 2 , IPv4
+	if ipnet.IP.To4() == nil {
+		family, bits = syscall.AF_INET6, 128
 	}
 
-	// Make a copy of ipnet.IP
-	ip := make(net.IP, len(ipnet.IP))
-	copy(ip, ipnet.IP)
+	addrList, err := netlink.AddrList(vxlanDevice, family)
+	if err != nil {
+		return fmt.Errorf("AddrList error: %w", err)
+	}
 
-	// Reset the last octet to 0. ex) 10.244.1.0 -> 10.244.0.0
-	ip[2] = 0
+	for _, addr := range addrList {
+		// Skip the IPv6 link-local address the kernel assigns
+		if addr.IP.IsGlobalUnicast() {
+			return nil
+		}
+	}
 
-	// Construct new IPNet. ex) 10.244.0.0 -> 10.244.0.0/24
-	defaultCidr := &net.IPNet{
-		IP:   ip,
-		Mask: net.IPv4Mask(255, 255, 255, 0),
+	klog.Infof("config vxlan device %s ip: %s", vxlanDevice.Name, ipnet.IP)
+	addr := &netlink.Addr{
+		IPNet: &net.IPNet{
+			IP:   ipnet.IP,
+			Mask: net.CIDRMask(bits, bits),
+		},
+	}
+	if family == syscall.AF_INET6 {
+		addr.Flags = syscall.IFA_F_NODAD
 	}
 
-	// add routing table
-	//	if err = utils.ReplaceRoute(vxlanDevice.Attrs().Index, defaultCidr, ipnet.IP); err != nil {
-	if err = utils.ReplaceRoute(vxlanDevice.Attrs().Index, defaultCidr); err != nil {
-		klog.Errorf("Error replacing route for vxlan, err : %s, defaultCidr : %s", err, defaultCidr)
-		return nil, nil, errors.Wrapf(err, "vxlan add event ReplaceRoute error")
+	if err = netlink.AddrAdd(vxlanDevice, addr); err != nil {
+		return fmt.Errorf("AddrAdd error: %w", err)
 	}
-	klog.Infof("ReplaceRoute: ip route add %s via %s dev %s onlink", ipnet.String(), ipnet.IP, vxlanDevice.Name)
-	return vxlanDevice, ipnet.IP, nil
+
+	return nil
 }
 
-// TODO - Use a more efficient method instead of annotations
-// Original code : https://github.com/nuczzz/mycni
-func StoreVxlanInfo(node *coreV1.Node, vxlanDevice *netlink.Vxlan) error {
-	newNode := node.DeepCopy()
-	newNode.Annotations[bvcniVtepMacAnnotationKey] = vxlanDevice.HardwareAddr.String()
-	newNode.Annotations[bvcniHostIPAnnotationKey] = vxlanDevice.SrcAddr.String()
+func setVxlanMTU(vxlanDevice *netlink.Vxlan, mtu int) error {
+	if vxlanDevice.MTU == mtu {
+		return nil
+	}
 
-	klog.Infof("mac: %s", vxlanDevice.HardwareAddr.String())
-	klog.Infof("host ip: %s", vxlanDevice.SrcAddr.String())
+	klog.Infof("set MTU of vxlan device %s from %d to %d", vxlanDevice.Name, vxlanDevice.MTU, mtu)
+	if err := netlink.LinkSetMTU(vxlanDevice, mtu); err != nil {
+		return errors.Wrapf(err, "set MTU of %s error", vxlanDevice.Name)
+	}
+	vxlanDevice.MTU = mtu
 
-	return pkg.PatchNode(node, newNode)
+	return nil
 }
 
 func getDefaultGatewayInterface() (*net.Interface, error) {
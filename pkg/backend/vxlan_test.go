@@ -0,0 +1,153 @@
+package backend
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/vishvananda/netlink"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNew(t *testing.T) {
+	for _, name := range []string{"", "vxlan"} {
+		b, err := New(name)
+		if err != nil {
+			t.Fatalf("New %q: %v", name, err)
+		}
+		if b.Device() != vxlanName || b.EncapOverhead() != encapOverhead {
+			t.Errorf("New %q: unexpected backend %s", name, b.Device())
+		}
+	}
+
+	if _, err := New("geneve"); err == nil {
+		t.Fatalf("expected an unknown backend to fail")
+	}
+}
+
+func peerNode(mac, hostIP string, podCidrs ...string) *coreV1.Node {
+	return &coreV1.Node{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:        "worker-2",
+			Annotations: map[string]string{bvcniVtepMacAnnotationKey: mac, bvcniHostIPAnnotationKey: hostIP},
+		},
+		Spec: coreV1.NodeSpec{PodCIDRs: podCidrs},
+	}
+}
+
+func TestVxlanPeers(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("netns tests must run as root")
+	}
+
+	hostNS, err := testutils.NewNS()
+	if err != nil {
+		t.Fatalf("NewNS: %v", err)
+	}
+	defer func() {
+		hostNS.Close()
+		testutils.UnmountNS(hostNS)
+	}()
+
+	_ = hostNS.Do(func(_ ns.NetNS) error {
+		device := &netlink.Vxlan{LinkAttrs: netlink.LinkAttrs{Name: vxlanName, MTU: 1450}, VxlanId: vxlanVni, Port: vxlanPort}
+		if err := netlink.LinkAdd(device); err != nil {
+			t.Fatalf("LinkAdd: %v", err)
+		}
+		link, err := netlink.LinkByName(vxlanName)
+		if err != nil {
+			t.Fatalf("LinkByName: %v", err)
+		}
+		if err = netlink.LinkSetUp(link); err != nil {
+			t.Fatalf("LinkSetUp: %v", err)
+		}
+		b := &vxlanBackend{device: link.(*netlink.Vxlan)}
+
+		expectRoutes := func(expected ...string) {
+			t.Helper()
+			routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+			if err != nil {
+				t.Fatalf("RouteList: %v", err)
+			}
+			got := map[string]bool{}
+			for _, route := range routes {
+				if route.Dst != nil && !route.Dst.IP.IsLinkLocalUnicast() {
+					got[route.Dst.String()] = true
+				}
+			}
+			if len(got) != len(expected) {
+				t.Errorf("expected routes %v, got %v", expected, got)
+			}
+			for _, dst := range expected {
+				if !got[dst] {
+					t.Errorf("expected routes %v, got %v", expected, got)
+				}
+			}
+		}
+		expectFDB := func(hostIP string, exists bool) {
+			t.Helper()
+			neighs, err := netlink.NeighList(link.Attrs().Index, syscall.AF_BRIDGE)
+			if err != nil {
+				t.Fatalf("NeighList: %v", err)
+			}
+			found := false
+			for _, neigh := range neighs {
+				found = found || neigh.IP.Equal(net.ParseIP(hostIP))
+			}
+			if found != exists {
+				t.Errorf("expected FDB entry of %s: %v, got %v", hostIP, exists, neighs)
+			}
+		}
+
+		node := peerNode("aa:bb:cc:dd:ee:01", "192.168.0.12", "10.244.2.0/24", "fd00:10:244:2::/64")
+		if err = b.AddPeer(node); err != nil {
+			t.Fatalf("AddPeer: %v", err)
+		}
+		expectRoutes("10.244.2.0/24", "fd00:10:244:2::/64")
+		expectFDB("192.168.0.12", true)
+
+		// Unrelated changes are ignored
+		unrelated := node.DeepCopy()
+		unrelated.Labels = map[string]string{"zone": "b"}
+		if err = b.UpdatePeer(node, unrelated); err != nil {
+			t.Fatalf("UpdatePeer: %v", err)
+		}
+
+		// Another block, the IPv6 CIDR is gone and the node got a new VTEP
+		updated := peerNode("aa:bb:cc:dd:ee:02", "192.168.0.13", "10.244.2.0/24", "10.244.9.0/24")
+		if err = b.UpdatePeer(node, updated); err != nil {
+			t.Fatalf("UpdatePeer: %v", err)
+		}
+		expectRoutes("10.244.2.0/24", "10.244.9.0/24")
+		expectFDB("192.168.0.12", false)
+		expectFDB("192.168.0.13", true)
+
+		if err = b.RemovePeer(updated); err != nil {
+			t.Fatalf("RemovePeer: %v", err)
+		}
+		expectRoutes()
+		expectFDB("192.168.0.13", false)
+
+		if err = b.SetMTU(1400); err != nil {
+			t.Fatalf("SetMTU: %v", err)
+		}
+		if link, err = netlink.LinkByName(vxlanName); err != nil || link.Attrs().MTU != 1400 {
+			t.Errorf("expected MTU 1400, got %v (%v)", link, err)
+		}
+
+		// Twice, the device is gone the second time
+		for i := 0; i < 2; i++ {
+			if err = b.Teardown(); err != nil {
+				t.Fatalf("Teardown: %v", err)
+			}
+		}
+		if _, err = netlink.LinkByName(vxlanName); err == nil {
+			t.Errorf("vxlan device was not deleted")
+		}
+		return nil
+	})
+}
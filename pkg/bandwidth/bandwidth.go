@@ -0,0 +1,159 @@
+package bandwidth
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"math"
+	"net"
+	"syscall"
+)
+
+// latencyInMillis is how long a packet may wait in the token bucket before it is dropped, like the CNI bandwidth plugin.
+const latencyInMillis = 25
+
+// Limits is the bandwidth capability of the runtime config, which kubelet fills from the
+// kubernetes.io/ingress-bandwidth and kubernetes.io/egress-bandwidth pod annotations.
+// Rates are in bits per second and bursts in bits; 0 means no limit.
+type Limits struct {
+	IngressRate  uint64 `json:"ingressRate,omitempty"`  // traffic to the pod
+	IngressBurst uint64 `json:"ingressBurst,omitempty"` // traffic to the pod
+	EgressRate   uint64 `json:"egressRate,omitempty"`   // traffic from the pod
+	EgressBurst  uint64 `json:"egressBurst,omitempty"`  // traffic from the pod
+}
+
+// IsZero reports whether no direction is limited.
+func (l *Limits) IsZero() bool {
+	return l == nil || (l.IngressRate == 0 && l.EgressRate == 0)
+}
+
+// Validate checks that rate and burst are set together and that the burst fits into a token bucket.
+func (l *Limits) Validate() error {
+	if l == nil {
+		return nil
+	}
+
+	for _, dir := range []struct {
+		name        string
+		rate, burst uint64
+	}{{"ingress", l.IngressRate, l.IngressBurst}, {"egress", l.EgressRate, l.EgressBurst}} {
+		switch {
+		case dir.rate != 0 && dir.burst == 0:
+			return errors.Errorf("%s rate is set without a burst", dir.name)
+		case dir.rate == 0 && dir.burst != 0:
+			return errors.Errorf("%s burst is set without a rate", dir.name)
+		case dir.rate != 0 && dir.rate < 8:
+			return errors.Errorf("%s rate of %d bit/s is below one byte per second", dir.name, dir.rate)
+		case dir.burst/8 >= math.MaxUint32:
+			return errors.Errorf("%s burst cannot be more than 4GB", dir.name)
+		}
+	}
+
+	return nil
+}
+
+// IfbName derives the name of the ifb device that shapes the egress traffic of a container interface,
+// like bridge.HostVethName. ex) bwp1a2b3c4d5e6f
+func IfbName(containerID, ifName string) string {
+	sum := sha1.Sum([]byte(containerID + "/" + ifName))
+	return "bwp" + hex.EncodeToString(sum[:])[:12]
+}
+
+// SetUp shapes the traffic of a container interface with token buckets on the host side: traffic to the pod on
+// the root qdisc of the host veth, traffic from the pod (which enters the host on the ingress of the host veth)
+// on an ifb device it is redirected to.
+func SetUp(hostVethName, ifbName string, mtu int, limits *Limits) error {
+	hostVeth, err := netlink.LinkByName(hostVethName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to lookup %q", hostVethName)
+	}
+
+	if limits.IngressRate > 0 {
+		if err = addTBF(hostVeth.Attrs().Index, limits.IngressRate, limits.IngressBurst); err != nil {
+			return errors.Wrapf(err, "failed to limit the ingress of %q", hostVethName)
+		}
+	}
+
+	if limits.EgressRate == 0 {
+		return nil
+	}
+
+	if err = netlink.LinkAdd(&netlink.Ifb{LinkAttrs: netlink.LinkAttrs{Name: ifbName, Flags: net.FlagUp, MTU: mtu}}); err != nil {
+		return errors.Wrapf(err, "failed to add ifb device %q", ifbName)
+	}
+
+	ifb, err := netlink.LinkByName(ifbName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to lookup %q", ifbName)
+	}
+
+	// tc qdisc add dev <host veth> ingress
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: hostVeth.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	if err = netlink.QdiscAdd(ingress); err != nil {
+		return errors.Wrapf(err, "failed to add the ingress qdisc of %q", hostVethName)
+	}
+
+	// tc filter add dev <host veth> parent ffff: protocol all u32 match u32 0 0 action mirred egress redirect dev <ifb>
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: hostVeth.Attrs().Index,
+			Parent:    ingress.Handle,
+			Priority:  1,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		ClassId:    netlink.MakeHandle(1, 1),
+		RedirIndex: ifb.Attrs().Index,
+		Actions: []netlink.Action{
+			&netlink.MirredAction{
+				MirredAction: netlink.TCA_EGRESS_REDIR,
+				Ifindex:      ifb.Attrs().Index,
+			},
+		},
+	}
+	if err = netlink.FilterAdd(filter); err != nil {
+		return errors.Wrapf(err, "failed to redirect the traffic of %q to %q", hostVethName, ifbName)
+	}
+
+	return errors.Wrapf(addTBF(ifb.Attrs().Index, limits.EgressRate, limits.EgressBurst), "failed to limit the egress of %q", hostVethName)
+}
+
+// TearDown deletes the ifb device of a container interface. The qdiscs of the host veth go away with the veth.
+func TearDown(ifbName string) error {
+	if err := ip.DelLinkByName(ifbName); err != nil && !errors.Is(err, ip.ErrLinkNotFound) {
+		return errors.Wrapf(err, "failed to delete ifb device %q", ifbName)
+	}
+
+	return nil
+}
+
+// addTBF adds a token bucket filter as root qdisc of the link.
+// tc qdisc add dev <link> root handle 1: tbf rate <rate> burst <burst> latency 25ms
+func addTBF(linkIndex int, rateInBits, burstInBits uint64) error {
+	rate := rateInBits / 8
+	burst := uint32(burstInBits / 8)
+	buffer := time2Tick(uint32(float64(burst) * float64(netlink.TIME_UNITS_PER_SEC) / float64(rate)))
+	latency := float64(netlink.TIME_UNITS_PER_SEC) * latencyInMillis / 1000
+
+	return netlink.QdiscAdd(&netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   rate,
+		Limit:  uint32(float64(rate)*latency/float64(netlink.TIME_UNITS_PER_SEC)) + burst,
+		Buffer: buffer,
+	})
+}
+
+func time2Tick(time uint32) uint32 {
+	return uint32(float64(time) * netlink.TickInUsec())
+}
@@ -0,0 +1,55 @@
+package bandwidth
+
+import (
+	"testing"
+)
+
+func TestLimitsValidate(t *testing.T) {
+	cases := []struct {
+		name   string
+		limits *Limits
+		valid  bool
+	}{
+		{"none", nil, true},
+		{"zero", &Limits{}, true},
+		{"ingress", &Limits{IngressRate: 1000000, IngressBurst: 2000000}, true},
+		{"both", &Limits{IngressRate: 1000000, IngressBurst: 2000000, EgressRate: 2000000, EgressBurst: 4000000}, true},
+		{"rate without burst", &Limits{EgressRate: 1000000}, false},
+		{"burst without rate", &Limits{IngressBurst: 1000000}, false},
+		{"below one byte per second", &Limits{IngressRate: 7, IngressBurst: 1000}, false},
+		{"burst over 4GB", &Limits{EgressRate: 1000000, EgressBurst: 8 * (1 << 32)}, false},
+	}
+
+	for _, c := range cases {
+		if err := c.limits.Validate(); (err == nil) != c.valid {
+			t.Errorf("%s: expected valid %v, got %v", c.name, c.valid, err)
+		}
+	}
+}
+
+func TestIfbName(t *testing.T) {
+	cases := []struct {
+		containerID, ifName string
+	}{
+		{"", ""},
+		{"test-container", "eth0"},
+		{"test-container", "net1"},
+		{"a-very-long-container-id-of-the-runtime-0123456789abcdef", "eth0"},
+	}
+
+	names := map[string]bool{}
+	for _, c := range cases {
+		name := IfbName(c.containerID, c.ifName)
+		// Link names are limited to 15 characters (IFNAMSIZ)
+		if len(name) != 15 || name[:3] != "bwp" {
+			t.Errorf("IfbName(%q, %q): expected bwp and 12 hex digits, got %q", c.containerID, c.ifName, name)
+		}
+		if name != IfbName(c.containerID, c.ifName) {
+			t.Errorf("IfbName(%q, %q) is not stable", c.containerID, c.ifName)
+		}
+		if names[name] {
+			t.Errorf("IfbName(%q, %q): %s is not unique", c.containerID, c.ifName, name)
+		}
+		names[name] = true
+	}
+}
@@ -1,32 +1,43 @@
 package bridge
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"github.com/pkg/errors"
-	log "github.com/royroyee/bvcni/pkg/log"
+	ipa "github.com/royroyee/bvcni/pkg/ip"
 	"github.com/vishvananda/netlink"
 	"net"
+	"os"
+	"syscall"
 )
 
-const bridgeName = "cni0"
+const BridgeName = "cni0"
 
-func addBridgeAddr(podCidr string, bridge *netlink.Bridge) error {
+// HostVethName derives the host side veth name from the container interface, so DEL (and bvcnid's
+// garbage collection) can find it without entering the pod network namespace. ex) veth1a2b3c4d5e6
+func HostVethName(containerID, ifName string) string {
+	sum := sha1.Sum([]byte(containerID + "/" + ifName))
+	return "veth" + hex.EncodeToString(sum[:])[:11]
+}
+
+func addBridgeAddr(podCidr string, ranges ipa.Ranges, bridge *netlink.Bridge) error {
 
 	// Create a bridge address using the podCIDR
-	bridgeAddr, err := generateBridgeAddr(podCidr)
+	bridgeAddr, err := generateBridgeAddr(podCidr, ranges)
 
 	if err != nil {
 		return errors.Wrapf(err, "Failed to generate the Gateway IP address")
 	}
 
-	addr := &netlink.Addr{
-		IPNet: &net.IPNet{
-			IP:   bridgeAddr.IP,
-			Mask: net.IPv4Mask(255, 255, 255, 0), //  /24
-		},
+	// The bridge address carries the prefix length of the pod CIDR, ex) 10.244.1.1/23
+	addr := &netlink.Addr{IPNet: bridgeAddr}
+	if bridgeAddr.IP.To4() == nil {
+		// The gateway address is unique by construction, skip duplicate address detection.
+		addr.Flags = syscall.IFA_F_NODAD
 	}
 
-	if err = netlink.AddrAdd(bridge, addr); err != nil {
-		log.Debugf("addBridgeAddr - AddrAdd error : %s", err.Error())
+	if err = netlink.AddrAdd(bridge, addr); err != nil && !os.IsExist(err) {
+		return errors.Wrapf(err, "Failed to add the address %s to the bridge", addr.IPNet)
 	}
 
 	// 3. Update the Routing Table
@@ -49,59 +60,89 @@ func addRoutingTable(podCidr string, bridge *netlink.Bridge) error {
 		Dst:       ipNet,
 	}
 
-	// Add a routing table entry for the specified destination network (ipNet) via the bridge
-	if err = netlink.RouteAdd(&route); err != nil {
+	// Add a routing table entry for the specified destination network (ipNet) via the bridge.
+	// The kernel usually adds it together with the bridge address already.
+	if err = netlink.RouteAdd(&route); err != nil && !os.IsExist(err) {
 		return errors.Wrapf(err, "bridge add route error")
 	}
 	return nil
 }
 
-func generateBridgeAddr(podCidr string) (*net.IPNet, error) {
+func generateBridgeAddr(podCidr string, ranges ipa.Ranges) (*net.IPNet, error) {
 
-	_, ipNet, err := net.ParseCIDR(podCidr)
+	// The gateway is the configured gateway or the first usable address of the pod CIDR, the same one the IP allocator skips.
+	bridgeAddr, err := ranges.GatewayIP(podCidr)
 	if err != nil {
 		return nil, errors.Wrapf(err, "generateBridgeAddr - Failed to parse CIDR")
 	}
 
-	// Create a copy of ipNet
-	bridgeAddr := *ipNet
-
-	// Increment the last octet of the IP address to generate the gateway address
-	bridgeAddr.IP[3]++
-
-	return &bridgeAddr, nil
+	return bridgeAddr, nil
 }
 
-func SetUpBridge(podCidr string) (*netlink.Bridge, error) {
+// SetUpBridge creates cni0 if needed and makes sure it has the pod MTU and a gateway address in every pod CIDR.
+func SetUpBridge(podCidrs []string, ranges ipa.Ranges, mtu int) (*netlink.Bridge, error) {
+
+	// Check if the bridge exists. It may predate an IP family that was added later, so its addresses are still checked.
+	link, err := netlink.LinkByName(BridgeName)
+	if err == nil {
+		br, ok := link.(*netlink.Bridge)
+		if !ok {
+			return nil, errors.Errorf("link %s already exists but is not a bridge", BridgeName)
+		}
+		// The bridge may predate the MTU of the config, ex) 1500 of earlier versions or a changed underlay
+		if err = setLinkMTU(br, mtu); err != nil {
+			return nil, err
+		}
+		if err = addBridgeAddrs(podCidrs, ranges, br); err != nil {
+			return nil, err
+		}
+		return br, nil
+	}
 
-	// Check if the bridge exists and exit if it does.
-	link, err := netlink.LinkByName(bridgeName)
-	if link != nil {
-		return link.(*netlink.Bridge), nil
+	if _, ok := err.(netlink.LinkNotFoundError); !ok {
+		return nil, errors.Wrapf(err, "get link %s error", BridgeName)
 	}
 
 	// Create the bridge
 	bridge := &netlink.Bridge{
 		LinkAttrs: netlink.LinkAttrs{
-			Name:   bridgeName,
-			MTU:    1500,
+			Name:   BridgeName,
+			MTU:    mtu,
 			TxQLen: -1,
 		},
 	}
 
-	err = netlink.LinkAdd(bridge)
-	if err != nil {
-		log.Debugf("SetUpBridge LinkAdd Error")
+	// Another ADD running in parallel may have created the bridge in the meantime.
+	if err = netlink.LinkAdd(bridge); err != nil && !os.IsExist(err) {
+		return nil, errors.Wrap(err, "SetUpBridge LinkAdd error")
 	}
 
-	err = netlink.LinkSetUp(bridge)
-	if err != nil {
-		log.Debugf("SetUpBridge LinkSetUp Error ")
+	if err = netlink.LinkSetUp(bridge); err != nil {
+		return nil, errors.Wrap(err, "SetUpBridge LinkSetUp error")
 	}
 
-	err = addBridgeAddr(podCidr, bridge)
+	if err = addBridgeAddrs(podCidrs, ranges, bridge); err != nil {
+		return nil, err
+	}
+
+	// Lookup the bridge again so that the attributes assigned by the kernel (index, MAC) are filled in.
+	link, err = netlink.LinkByName(BridgeName)
 	if err != nil {
-		log.Debugf("SetUpBridge addBridgeAddr Error")
+		return nil, errors.Wrapf(err, "get link %s error", BridgeName)
+	}
+
+	br, ok := link.(*netlink.Bridge)
+	if !ok {
+		return nil, errors.Errorf("link %s is not a bridge", BridgeName)
 	}
-	return bridge, nil
+	return br, nil
+}
+
+func addBridgeAddrs(podCidrs []string, ranges ipa.Ranges, bridge *netlink.Bridge) error {
+	for _, podCidr := range podCidrs {
+		if err := addBridgeAddr(podCidr, ranges, bridge); err != nil {
+			return errors.Wrap(err, "SetUpBridge addBridgeAddr error")
+		}
+	}
+	return nil
 }
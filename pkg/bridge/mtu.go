@@ -0,0 +1,145 @@
+package bridge
+
+import (
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"os"
+	"path/filepath"
+)
+
+var (
+	// netnsDir holds the pod network namespaces of the runtimes that bind mount them (containerd, CRI-O).
+	netnsDir = "/var/run/netns"
+
+	// withNetNSPath enters a pod network namespace, a variable so that tests can make it fail.
+	withNetNSPath = ns.WithNetNSPath
+)
+
+// SetPodMTU gives mtu to cni0 and to both ends of the veths on it, ex) after the underlay MTU changed. The pod ends
+// are found through the network namespaces under /var/run/netns, entering them needs CAP_SYS_ADMIN. Pods whose
+// network namespace is not there (ex. docker, /proc/<pid>/ns/net) only get it on the host end. It returns how many
+// pods had another MTU and were updated, and the errors of the others. Without cni0 there are no pods to update.
+func SetPodMTU(mtu int) (int, error) {
+	br, err := netlink.LinkByName(BridgeName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return 0, nil
+		}
+		return 0, errors.Wrapf(err, "get link %s error", BridgeName)
+	}
+	if err = setLinkMTU(br, mtu); err != nil {
+		return 0, err
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return 0, errors.Wrap(err, "list links error")
+	}
+
+	// The kernel gives the namespaces of the veth peers an ID when the links are listed
+	netnsPaths, err := netnsPathsByID()
+	if err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	var errs []error
+	for _, link := range links {
+		if link.Type() != "veth" || link.Attrs().MasterIndex != br.Attrs().Index {
+			continue
+		}
+
+		changed, err := setVethMTU(mtu, link, netnsPaths[link.Attrs().NetNsID])
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "set MTU of %s error", link.Attrs().Name))
+			continue
+		}
+		if changed {
+			updated++
+		}
+	}
+
+	return updated, utilerrors.NewAggregate(errs)
+}
+
+// netnsPathsByID maps the IDs the current network namespace has for the namespaces of netnsDir to their paths.
+func netnsPathsByID() (map[int]string, error) {
+	entries, err := os.ReadDir(netnsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "read %s error", netnsDir)
+	}
+
+	paths := map[int]string{}
+	for _, entry := range entries {
+		path := filepath.Join(netnsDir, entry.Name())
+		netNS, err := ns.GetNS(path)
+		if err != nil {
+			// Not a network namespace, or deleted in the meantime
+			continue
+		}
+
+		id, err := netlink.GetNetNsIdByFd(int(netNS.Fd()))
+		netNS.Close()
+		if err == nil && id >= 0 {
+			paths[id] = path
+		}
+	}
+
+	return paths, nil
+}
+
+// setVethMTU gives mtu to a host veth and to its peer in the network namespace netnsPath, empty if it is unknown.
+// It returns whether either end had another MTU.
+func setVethMTU(mtu int, hostVeth netlink.Link, netnsPath string) (bool, error) {
+	changed := hostVeth.Attrs().MTU != mtu
+
+	setContainerMTU := func() error {
+		if netnsPath == "" {
+			return nil
+		}
+
+		return withNetNSPath(netnsPath, func(_ ns.NetNS) error {
+			link, err := netlink.LinkByIndex(hostVeth.Attrs().ParentIndex)
+			if err != nil {
+				return errors.Wrapf(err, "get peer of %s error", hostVeth.Attrs().Name)
+			}
+			changed = changed || link.Attrs().MTU != mtu
+			return setLinkMTU(link, mtu)
+		})
+	}
+
+	// A veth drops the packets of its peer that exceed its own MTU: the sending end gets a lower MTU first,
+	// and a higher one last. The host end is lowered even if the pod end fails, the underlay drops the
+	// larger packets anyway.
+	if mtu < hostVeth.Attrs().MTU {
+		contErr := setContainerMTU()
+		if err := setLinkMTU(hostVeth, mtu); err != nil {
+			return false, utilerrors.NewAggregate([]error{contErr, err})
+		}
+		return changed, contErr
+	}
+
+	if err := setLinkMTU(hostVeth, mtu); err != nil {
+		return false, err
+	}
+	err := setContainerMTU()
+	return changed, err
+}
+
+func setLinkMTU(link netlink.Link, mtu int) error {
+	if link.Attrs().MTU == mtu {
+		return nil
+	}
+
+	if err := netlink.LinkSetMTU(link, mtu); err != nil {
+		return errors.Wrapf(err, "set MTU of %s error", link.Attrs().Name)
+	}
+	link.Attrs().MTU = mtu
+
+	return nil
+}
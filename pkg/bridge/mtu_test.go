@@ -0,0 +1,205 @@
+package bridge
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/vishvananda/netlink"
+)
+
+func newNS(t *testing.T) ns.NetNS {
+	netNS, err := testutils.NewNS()
+	if err != nil {
+		t.Fatalf("NewNS: %v", err)
+	}
+	t.Cleanup(func() {
+		netNS.Close()
+		testutils.UnmountNS(netNS)
+	})
+
+	return netNS
+}
+
+// newPodNetwork creates cni0 with MTU mtu in a new host netns, and returns the host netns and a function that
+// gives a pod a veth pair of MTU mtu, attached to cni0 unless detached is set.
+func newPodNetwork(t *testing.T, mtu int) (ns.NetNS, func(containerID string, podNS ns.NetNS, detached bool)) {
+	hostNS := newNS(t)
+	err := hostNS.Do(func(_ ns.NetNS) error {
+		return netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: BridgeName, MTU: mtu}})
+	})
+	if err != nil {
+		t.Fatalf("add %s: %v", BridgeName, err)
+	}
+
+	addPod := func(containerID string, podNS ns.NetNS, detached bool) {
+		hostVethName := HostVethName(containerID, "eth0")
+		err := podNS.Do(func(_ ns.NetNS) error {
+			_, _, err := ip.SetupVethWithName("eth0", hostVethName, mtu, "", hostNS)
+			return err
+		})
+		if err == nil && !detached {
+			err = hostNS.Do(func(_ ns.NetNS) error {
+				br, err := netlink.LinkByName(BridgeName)
+				if err != nil {
+					return err
+				}
+				hostVeth, err := netlink.LinkByName(hostVethName)
+				if err != nil {
+					return err
+				}
+				return netlink.LinkSetMaster(hostVeth, br)
+			})
+		}
+		if err != nil {
+			t.Fatalf("set up the veth of %s: %v", containerID, err)
+		}
+	}
+
+	return hostNS, addPod
+}
+
+// fakeNetnsDir points netnsDir at a directory with links to the network namespaces of podNSs only.
+func fakeNetnsDir(t *testing.T, podNSs ...ns.NetNS) {
+	dir := t.TempDir()
+	for _, podNS := range podNSs {
+		if err := os.Symlink(podNS.Path(), filepath.Join(dir, filepath.Base(podNS.Path()))); err != nil {
+			t.Fatalf("Symlink: %v", err)
+		}
+	}
+
+	orig := netnsDir
+	t.Cleanup(func() { netnsDir = orig })
+	netnsDir = dir
+}
+
+func expectMTU(t *testing.T, netNS ns.NetNS, name string, expected int) {
+	t.Helper()
+	_ = netNS.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			t.Fatalf("LinkByName %s: %v", name, err)
+		}
+		if mtu := link.Attrs().MTU; mtu != expected {
+			t.Errorf("expected MTU %d on %s, got %d", expected, name, mtu)
+		}
+		return nil
+	})
+}
+
+func TestSetPodMTU(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("netns tests must run as root")
+	}
+
+	hostNS, addPod := newPodNetwork(t, 1450)
+	podNS, dockerNS, otherNS := newNS(t), newNS(t), newNS(t)
+	addPod("c1", podNS, false)
+	// The netns of docker is under /proc, only the host end is updated
+	addPod("c2", dockerNS, false)
+	// Not on cni0, not a pod of bvcni
+	addPod("c3", otherNS, true)
+	fakeNetnsDir(t, podNS, otherNS)
+
+	// Up to jumbo frames and back
+	for _, mtu := range []int{8950, 1400} {
+		var updated int
+		err := hostNS.Do(func(_ ns.NetNS) error {
+			var err error
+			updated, err = SetPodMTU(mtu)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("SetPodMTU %d: %v", mtu, err)
+		}
+		if updated != 2 {
+			t.Errorf("expected 2 pods updated, got %d", updated)
+		}
+
+		expectMTU(t, hostNS, BridgeName, mtu)
+		expectMTU(t, hostNS, HostVethName("c1", "eth0"), mtu)
+		expectMTU(t, podNS, "eth0", mtu)
+		expectMTU(t, hostNS, HostVethName("c2", "eth0"), mtu)
+		expectMTU(t, dockerNS, "eth0", 1450)
+		expectMTU(t, hostNS, HostVethName("c3", "eth0"), 1450)
+		expectMTU(t, otherNS, "eth0", 1450)
+	}
+}
+
+func TestSetPodMTUPodNetnsFails(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("netns tests must run as root")
+	}
+
+	hostNS, addPod := newPodNetwork(t, 1450)
+	podNS := newNS(t)
+	addPod("c1", podNS, false)
+	fakeNetnsDir(t, podNS)
+
+	// Like bvcnid without CAP_SYS_ADMIN
+	orig := withNetNSPath
+	defer func() { withNetNSPath = orig }()
+	withNetNSPath = func(string, func(ns.NetNS) error) error { return syscall.EPERM }
+
+	var updated int
+	err := hostNS.Do(func(_ ns.NetNS) error {
+		var err error
+		updated, err = SetPodMTU(1400)
+		return err
+	})
+	if !errors.Is(err, syscall.EPERM) || updated != 0 {
+		t.Fatalf("expected SetPodMTU to fail with no pods updated, got %v, %d updated", err, updated)
+	}
+
+	// The pod end keeps its MTU, the host end is lowered all the same so cni0 does not send it larger packets
+	expectMTU(t, hostNS, HostVethName("c1", "eth0"), 1400)
+	expectMTU(t, podNS, "eth0", 1450)
+}
+
+func TestSetPodMTUExistingPods(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("netns tests must run as root")
+	}
+
+	// Set up by an earlier version with MTU 1500, bvcnid corrects it at startup
+	hostNS, addPod := newPodNetwork(t, 1500)
+	podNS := newNS(t)
+	addPod("c1", podNS, false)
+	fakeNetnsDir(t, podNS)
+
+	// Only the first call changes anything
+	for _, expected := range []int{1, 0} {
+		var updated int
+		err := hostNS.Do(func(_ ns.NetNS) error {
+			var err error
+			updated, err = SetPodMTU(1450)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("SetPodMTU: %v", err)
+		}
+		if updated != expected {
+			t.Errorf("expected %d pods updated, got %d", expected, updated)
+		}
+
+		expectMTU(t, hostNS, BridgeName, 1450)
+		expectMTU(t, hostNS, HostVethName("c1", "eth0"), 1450)
+		expectMTU(t, podNS, "eth0", 1450)
+	}
+
+	// A node without pods has no cni0 yet
+	if err := newNS(t).Do(func(_ ns.NetNS) error {
+		updated, err := SetPodMTU(1450)
+		if updated != 0 {
+			t.Errorf("expected no pods updated, got %d", updated)
+		}
+		return err
+	}); err != nil {
+		t.Fatalf("SetPodMTU without %s: %v", BridgeName, err)
+	}
+}
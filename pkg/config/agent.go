@@ -0,0 +1,345 @@
+package config
+
+import (
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	v1 "k8s.io/api/core/v1"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCNIVersion is the first CNI spec version with the GC and STATUS verbs.
+const defaultCNIVersion = "1.1.0"
+
+// defaultIPQuarantinePeriod is how long released pod IPs are not handed out again.
+const defaultIPQuarantinePeriod = "1m"
+
+// defaultBackend is the overlay between the nodes unless another one is configured.
+const defaultBackend = "vxlan"
+
+// supportedBackends are the names pkg/backend has an implementation for.
+var supportedBackends = []string{defaultBackend}
+
+// defaultGCSafetyWindow is how long an IPAM allocation must stay orphaned before bvcnid releases it.
+const defaultGCSafetyWindow = "5m"
+
+// The bounds of the pod MTU. IPv6 needs at least 1280 on every link.
+const (
+	minMTU = 1280
+	maxMTU = 65535
+)
+
+// What bvcnid does about the network configs of other CNI plugins in /etc/cni/net.d.
+const (
+	otherCNIConfigsWarn   = "warn"
+	otherCNIConfigsRefuse = "refuse"
+)
+
+// AgentConfig is the configuration of bvcnid. Every setting can be given as a flag, or
+// through the environment variable named next to it when the flag is not set.
+type AgentConfig struct {
+	// ClusterCIDR is the cluster-wide pod network that contains the pod CIDR of every node
+	// (kube-controller-manager --cluster-cidr). Dual-stack clusters give one CIDR per IP family,
+	// separated by a comma. ex) 10.244.0.0/16,fd00:10:244::/56
+	ClusterCIDR string
+
+	// IPPools names the IPPool custom resources that hand out pod CIDR blocks to the nodes, one per IP family,
+	// separated by a comma. Empty means the pod CIDRs come from kube-controller-manager (node.Spec.PodCIDRs).
+	IPPools string
+
+	// StickyIPGracePeriod keeps the IPs of a deleted StatefulSet pod reserved for its namespace/name this long,
+	// so that the recreated pod gets the same IPs. ex) 10m. Empty disables sticky IPs.
+	StickyIPGracePeriod string
+
+	// IPQuarantinePeriod keeps released pod IPs from being handed out again this long, so that stale conntrack
+	// entries and client connections do not reach another pod. ex) 1m. 0 disables the quarantine.
+	IPQuarantinePeriod string
+
+	// GCSafetyWindow is how long an IPAM allocation must look leaked (its pod, host veth or netns gone)
+	// before bvcnid releases it, so that ADDs and DELs in progress are left alone. ex) 5m
+	GCSafetyWindow string
+
+	// CNIVersion is the cniVersion of the CNI config file. GC and STATUS need 1.1.0, runtimes that
+	// do not know it yet (CNI library before v1.2) need 1.0.0 or 0.4.0.
+	CNIVersion string
+
+	// ChainedPlugins are the CNI plugins that run after bvcni in the conflist: names, ex) portmap,tuning, or a JSON
+	// array of plugin configs. Their binaries must be in /opt/cni/bin.
+	ChainedPlugins string
+
+	// OtherCNIConfigs is what bvcnid does when /etc/cni/net.d holds network configs of other CNI plugins:
+	// warn (the default), or refuse to start.
+	OtherCNIConfigs string
+
+	// MTU is the MTU of cni0 and the pod veths. Empty means the MTU of the underlay interface minus the VXLAN
+	// overhead, set it when the path between the nodes has a smaller MTU than the interface. ex) 1400
+	MTU string
+
+	// Backend is the overlay that carries the pod traffic between the nodes. ex) vxlan
+	Backend string
+
+	// IPAM is the "ipam" section of the bvcni config as a JSON object, ex) {"type":"whereabouts","range":"10.244.0.0/16"}.
+	// It delegates the pod IPs to that IPAM plugin instead of the built-in allocator. Empty means the built-in allocator.
+	IPAM string
+
+	clusterNets    []*net.IPNet
+	pluginChain    []map[string]interface{}
+	ipam           map[string]interface{}
+	stickyIPGrace  time.Duration
+	ipQuarantine   time.Duration
+	gcSafetyWindow time.Duration
+	mtu            int
+}
+
+// AddFlags registers the bvcnid flags on fs.
+func (c *AgentConfig) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&c.ClusterCIDR, "cluster-cidr", os.Getenv("CLUSTER_CIDR"),
+		"CIDR of the cluster pod network, must contain the pod CIDR of every node. Comma separated, one per IP family (env CLUSTER_CIDR)")
+	fs.StringVar(&c.IPPools, "ip-pools", os.Getenv("IP_POOLS"),
+		"IPPool resources to take the node's pod CIDR blocks from, instead of kube-controller-manager. Comma separated, one per IP family (env IP_POOLS)")
+	fs.StringVar(&c.StickyIPGracePeriod, "sticky-ip-grace-period", os.Getenv("STICKY_IP_GRACE_PERIOD"),
+		"How long the IPs of a deleted StatefulSet pod stay reserved for the recreated pod, ex) 10m. Empty disables sticky IPs (env STICKY_IP_GRACE_PERIOD)")
+
+	ipQuarantinePeriod := os.Getenv("IP_QUARANTINE_PERIOD")
+	if ipQuarantinePeriod == "" {
+		ipQuarantinePeriod = defaultIPQuarantinePeriod
+	}
+	fs.StringVar(&c.IPQuarantinePeriod, "ip-quarantine-period", ipQuarantinePeriod,
+		"How long released pod IPs are not handed out again unless the pod CIDRs are otherwise exhausted, 0 disables it (env IP_QUARANTINE_PERIOD)")
+
+	gcSafetyWindow := os.Getenv("GC_SAFETY_WINDOW")
+	if gcSafetyWindow == "" {
+		gcSafetyWindow = defaultGCSafetyWindow
+	}
+	fs.StringVar(&c.GCSafetyWindow, "gc-safety-window", gcSafetyWindow,
+		"How long an IP allocation must look leaked before it is released (env GC_SAFETY_WINDOW)")
+
+	cniVersion := os.Getenv("CNI_VERSION")
+	if cniVersion == "" {
+		cniVersion = defaultCNIVersion
+	}
+	fs.StringVar(&c.CNIVersion, "cni-version", cniVersion,
+		"cniVersion of the CNI config file, 1.1.0 enables GC and STATUS (env CNI_VERSION)")
+	fs.StringVar(&c.ChainedPlugins, "chained-plugins", os.Getenv("CHAINED_PLUGINS"),
+		"CNI plugins to chain after bvcni, names (ex. portmap,tuning) or a JSON array of plugin configs (env CHAINED_PLUGINS)")
+
+	otherCNIConfigs := os.Getenv("OTHER_CNI_CONFIGS")
+	if otherCNIConfigs == "" {
+		otherCNIConfigs = otherCNIConfigsWarn
+	}
+	fs.StringVar(&c.OtherCNIConfigs, "other-cni-configs", otherCNIConfigs,
+		"What to do when /etc/cni/net.d holds configs of other CNI plugins: warn or refuse to start (env OTHER_CNI_CONFIGS)")
+	fs.StringVar(&c.MTU, "mtu", os.Getenv("MTU"),
+		"MTU of the pod interfaces, empty detects it from the underlay interface (env MTU)")
+
+	backendName := os.Getenv("BACKEND")
+	if backendName == "" {
+		backendName = defaultBackend
+	}
+	fs.StringVar(&c.Backend, "backend", backendName,
+		"Overlay that carries the pod traffic between the nodes: vxlan (env BACKEND)")
+	fs.StringVar(&c.IPAM, "ipam", os.Getenv("IPAM"),
+		"ipam section of the CNI config as a JSON object, delegates the pod IPs to that IPAM plugin. Empty uses the built-in allocator (env IPAM)")
+}
+
+// Validate checks the configuration against the current node. Every pod CIDR that
+// kube-controller-manager (or an IPPool) assigned to the node must be inside the cluster CIDR of its IP family.
+func (c *AgentConfig) Validate(node *v1.Node) error {
+	if c.ClusterCIDR == "" {
+		return errors.New("cluster CIDR is not set, use --cluster-cidr or the CLUSTER_CIDR environment variable")
+	}
+
+	if c.CNIVersion == "" {
+		c.CNIVersion = defaultCNIVersion
+	}
+	supported := false
+	for _, v := range version.All.SupportedVersions() {
+		supported = supported || v == c.CNIVersion
+	}
+	if !supported {
+		return errors.Errorf("unsupported CNI version %q, supported are %v", c.CNIVersion, version.All.SupportedVersions())
+	}
+
+	if c.Backend == "" {
+		c.Backend = defaultBackend
+	}
+	if !containsString(supportedBackends, c.Backend) {
+		return errors.Errorf("unknown backend %q, supported are %v", c.Backend, supportedBackends)
+	}
+
+	pluginChain, err := parseChainedPlugins(c.ChainedPlugins)
+	if err != nil {
+		return err
+	}
+
+	ipam, err := parseIPAM(c.IPAM)
+	if err != nil {
+		return err
+	}
+	if ipam != nil && c.StickyIPGracePeriod != "" {
+		return errors.New("sticky IPs are a feature of the built-in allocator, they cannot be used with an IPAM plugin")
+	}
+
+	switch c.OtherCNIConfigs {
+	case "":
+		c.OtherCNIConfigs = otherCNIConfigsWarn
+	case otherCNIConfigsWarn, otherCNIConfigsRefuse:
+	default:
+		return errors.Errorf("invalid other CNI configs policy %q, use %s or %s", c.OtherCNIConfigs, otherCNIConfigsWarn, otherCNIConfigsRefuse)
+	}
+
+	var stickyIPGrace time.Duration
+	if c.StickyIPGracePeriod != "" {
+		grace, err := time.ParseDuration(c.StickyIPGracePeriod)
+		if err != nil || grace < 0 {
+			return errors.Errorf("invalid sticky IP grace period %q", c.StickyIPGracePeriod)
+		}
+		stickyIPGrace = grace
+	}
+
+	var ipQuarantine time.Duration
+	if c.IPQuarantinePeriod != "" {
+		quarantine, err := time.ParseDuration(c.IPQuarantinePeriod)
+		if err != nil || quarantine < 0 {
+			return errors.Errorf("invalid IP quarantine period %q", c.IPQuarantinePeriod)
+		}
+		ipQuarantine = quarantine
+	}
+
+	if c.GCSafetyWindow == "" {
+		c.GCSafetyWindow = defaultGCSafetyWindow
+	}
+	gcSafetyWindow, err := time.ParseDuration(c.GCSafetyWindow)
+	if err != nil || gcSafetyWindow <= 0 {
+		return errors.Errorf("invalid GC safety window %q", c.GCSafetyWindow)
+	}
+
+	var mtu int
+	if c.MTU != "" {
+		mtu, err = strconv.Atoi(c.MTU)
+		if err != nil || mtu < minMTU || mtu > maxMTU {
+			return errors.Errorf("invalid MTU %q, it must be between %d and %d", c.MTU, minMTU, maxMTU)
+		}
+	}
+
+	var clusterNets []*net.IPNet
+	for _, cidr := range strings.Split(c.ClusterCIDR, ",") {
+		_, clusterNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return errors.Wrapf(err, "invalid cluster CIDR %q", cidr)
+		}
+
+		if FamilyNet(clusterNets, clusterNet.IP) != nil {
+			return errors.Errorf("cluster CIDR %q has more than one CIDR of the same IP family", c.ClusterCIDR)
+		}
+		clusterNets = append(clusterNets, clusterNet)
+	}
+
+	podCidrs := NodePodCIDRs(node)
+	if len(podCidrs) == 0 {
+		return errors.Errorf("node : %s is not set podCIDR ", node.Name)
+	}
+
+	for _, podCidr := range podCidrs {
+		_, podNet, err := net.ParseCIDR(podCidr)
+		if err != nil {
+			return errors.Wrapf(err, "invalid pod CIDR %q of node %s", podCidr, node.Name)
+		}
+
+		clusterNet := FamilyNet(clusterNets, podNet.IP)
+		if clusterNet == nil {
+			return errors.Errorf("no cluster CIDR of the IP family of pod CIDR %s of node %s, check --cluster-cidr against kube-controller-manager",
+				podNet, node.Name)
+		}
+
+		if !containsCIDR(clusterNet, podNet) {
+			return errors.Errorf("pod CIDR %s of node %s is not inside the cluster CIDR %s, check --cluster-cidr against kube-controller-manager",
+				podNet, node.Name, clusterNet)
+		}
+	}
+
+	c.clusterNets = clusterNets
+	c.pluginChain = pluginChain
+	c.ipam = ipam
+	c.stickyIPGrace = stickyIPGrace
+	c.ipQuarantine = ipQuarantine
+	c.gcSafetyWindow = gcSafetyWindow
+	c.mtu = mtu
+	return nil
+}
+
+// IPPoolNames returns the names of the IPPools, or nil if the pod CIDRs come from kube-controller-manager.
+func (c *AgentConfig) IPPoolNames() []string {
+	var names []string
+	for _, name := range strings.Split(c.IPPools, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// ClusterNets returns the parsed cluster CIDRs, one per IP family. They are only set once Validate succeeded.
+func (c *AgentConfig) ClusterNets() []*net.IPNet {
+	return c.clusterNets
+}
+
+// PluginChain returns the parsed chained plugins. It is only set once Validate succeeded.
+func (c *AgentConfig) PluginChain() []map[string]interface{} {
+	return c.pluginChain
+}
+
+// IPAMSection returns the parsed ipam section, nil if the built-in allocator hands out the pod IPs.
+// It is only set once Validate succeeded.
+func (c *AgentConfig) IPAMSection() map[string]interface{} {
+	return c.ipam
+}
+
+// RefuseOtherCNIConfigs reports whether bvcnid must not start next to the configs of other CNI plugins.
+func (c *AgentConfig) RefuseOtherCNIConfigs() bool {
+	return c.OtherCNIConfigs == otherCNIConfigsRefuse
+}
+
+// StickyIPGrace returns the parsed sticky IP grace period, 0 if sticky IPs are disabled. It is only set once Validate succeeded.
+func (c *AgentConfig) StickyIPGrace() time.Duration {
+	return c.stickyIPGrace
+}
+
+// IPQuarantine returns the parsed IP quarantine period, 0 if it is disabled. It is only set once Validate succeeded.
+func (c *AgentConfig) IPQuarantine() time.Duration {
+	return c.ipQuarantine
+}
+
+// GCWindow returns the parsed GC safety window. It is only set once Validate succeeded.
+func (c *AgentConfig) GCWindow() time.Duration {
+	return c.gcSafetyWindow
+}
+
+// ConfiguredMTU returns the parsed MTU, 0 if it is detected from the underlay interface. It is only set once Validate succeeded.
+func (c *AgentConfig) ConfiguredMTU() int {
+	return c.mtu
+}
+
+// FamilyNet returns the network of nets that has the IP family of ip, or nil.
+func FamilyNet(nets []*net.IPNet, ip net.IP) *net.IPNet {
+	for _, n := range nets {
+		if (n.IP.To4() != nil) == (ip.To4() != nil) {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// containsCIDR reports whether inner is a subnet of outer.
+func containsCIDR(outer, inner *net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+
+	return outerBits == innerBits && outerOnes <= innerOnes && outer.Contains(inner.IP)
+}
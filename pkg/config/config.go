@@ -2,49 +2,131 @@ package config
 
 import (
 	"encoding/json"
-	"fmt"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/version"
 	"github.com/pkg/errors"
+	"github.com/royroyee/bvcni/pkg/bandwidth"
+	"github.com/royroyee/bvcni/pkg/hostport"
+	ipa "github.com/royroyee/bvcni/pkg/ip"
 	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
-	"os"
+	"strings"
+	"time"
 )
 
-const cniConfigPath = "/etc/cni/net.d/00-bvcni.conf"
+const (
+	// KubeconfigPath is written by bvcnid, so that the plugin can read pods with the bvcni service account.
+	KubeconfigPath = "/etc/cni/net.d/bvcni.kubeconfig"
 
-var cniConfTemplate = `{
-  "cniVersion": "0.3.1",
-  "name": "bvcni",
-  "type": "bvcni",
-  "podcidr": "%s"
-}`
+	// PodCIDRsAnnotationKey lists the pod CIDRs a node owns besides those of kube-controller-manager: its IPPool blocks,
+	// or CIDRs added by hand to grow the node. ex) 10.244.3.0/24,10.244.9.0/24
+	PodCIDRsAnnotationKey = "bvcni.pod.cidrs"
+
+	defaultMTU = 1500
+)
 
 type CNIConfig struct {
-	CNIVersion string `json:"cniVersion"`
-	Name       string `json:"name"`
-	Type       string `json:"type"`
-	PodCidr    string `json:"podcidr"`
+	types.NetConf          // cniVersion, name, type and prevResult
+	PodCidr       string   `json:"podcidr"`
+	PodCidrs      []string `json:"podcidrs,omitempty"` // one CIDR per IP family on dual-stack nodes
+	ipa.Ranges             // rangeStart, rangeEnd, exclude and gateway of the built-in allocator
+	DataDir       string   `json:"dataDir,omitempty"`    // IPAM store directory, defaults to /var/lib/cni/bvcni
+	Kubeconfig    string   `json:"kubeconfig,omitempty"` // written by bvcnid, used to look up the pod of CNI_ARGS
+	// StickyIPGracePeriod keeps the IPs of a deleted StatefulSet pod for its namespace/name this long, ex) "10m".
+	// Empty disables sticky IPs.
+	StickyIPGracePeriod string `json:"stickyIPGracePeriod,omitempty"`
+	// IPQuarantinePeriod keeps released IPs from being handed out again this long, ex) "1m", unless the
+	// pod CIDRs are otherwise exhausted. Empty disables the quarantine.
+	IPQuarantinePeriod string `json:"ipQuarantinePeriod,omitempty"`
+	// MTU of cni0 and the pod veths, written by bvcnid from the underlay interface. 0 means 1500.
+	MTU int `json:"mtu,omitempty"`
+	// RuntimeConfig holds what the runtime passes in for the capabilities of the config.
+	RuntimeConfig struct {
+		Bandwidth    *bandwidth.Limits      `json:"bandwidth,omitempty"`
+		PortMappings []hostport.PortMapping `json:"portMappings,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+
+	stickyIPGrace time.Duration
+	ipQuarantine  time.Duration
+}
+
+// StickyIPGrace returns the parsed StickyIPGracePeriod, 0 if sticky IPs are disabled.
+func (c *CNIConfig) StickyIPGrace() time.Duration {
+	return c.stickyIPGrace
 }
 
-func InitCNIPluginConfigFile(node *v1.Node) error {
+// IPQuarantine returns the parsed IPQuarantinePeriod, 0 if released IPs may be reused right away.
+func (c *CNIConfig) IPQuarantine() time.Duration {
+	return c.ipQuarantine
+}
 
-	// Check Node's PodCIDR
-	if node.Spec.PodCIDR == "" {
-		return errors.Errorf("node : %s is not set podCIDR ", node.Name)
+// ValidateIPAM rejects the settings of the built-in allocator when an "ipam" section delegates addressing to an IPAM plugin.
+// The plugin would silently ignore them: the bvcni.io/ip annotation (read with kubeconfig), sticky IPs and the quarantine.
+func (c *CNIConfig) ValidateIPAM() error {
+	if c.IPAM.Type == "" {
+		return nil
 	}
 
-	fd, err := os.OpenFile(cniConfigPath,
-		os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.ModeAppend|os.ModePerm)
-	if err != nil {
-		return errors.Wrap(err, "open cni config file error")
+	settings := []struct{ name, value string }{
+		{"kubeconfig", c.Kubeconfig},
+		{"stickyIPGracePeriod", c.StickyIPGracePeriod},
+		{"ipQuarantinePeriod", c.IPQuarantinePeriod},
+	}
+	for _, setting := range settings {
+		if setting.value != "" {
+			return errors.Errorf("%s is a setting of the built-in allocator and does not apply to IPAM plugin %q", setting.name, c.IPAM.Type)
+		}
 	}
 
-	defer fd.Close()
+	return nil
+}
 
-	if _, err = fd.Write([]byte(fmt.Sprintf(cniConfTemplate, node.Spec.PodCIDR))); err != nil {
-		return errors.Wrap(err, "write cni config file error")
+// PodMTU returns the MTU of the pod interfaces. Config files without "mtu" get the 1500 of earlier versions.
+func (c *CNIConfig) PodMTU() int {
+	if c.MTU > 0 {
+		return c.MTU
 	}
 
-	return nil
+	return defaultMTU
+}
+
+// PodCIDRs returns the pod CIDRs of the node. Config files without "podcidrs" fall back to "podcidr".
+func (c *CNIConfig) PodCIDRs() []string {
+	if len(c.PodCidrs) > 0 {
+		return c.PodCidrs
+	}
+
+	return []string{c.PodCidr}
+}
+
+// NodePodCIDRs returns every pod CIDR assigned to the node, ex) [10.244.1.0/24 fd00:10:244:1::/64] on dual-stack nodes:
+// the pod CIDRs of kube-controller-manager first, then the blocks of the bvcni.pod.cidrs annotation (IPPool blocks,
+// or CIDRs added by hand to grow the node). A node may own several CIDRs of one IP family, pods get addresses from them in order.
+func NodePodCIDRs(node *v1.Node) []string {
+	podCidrs := node.Spec.PodCIDRs
+	if len(podCidrs) == 0 && node.Spec.PodCIDR != "" {
+		podCidrs = []string{node.Spec.PodCIDR}
+	}
+
+	for _, block := range strings.Split(node.Annotations[PodCIDRsAnnotationKey], ",") {
+		block = strings.TrimSpace(block)
+		if block == "" || containsString(podCidrs, block) {
+			continue
+		}
+		podCidrs = append(podCidrs[:len(podCidrs):len(podCidrs)], block)
+	}
+
+	return podCidrs
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
 }
 
 func LoadCNIConfig(stdinData []byte) (*CNIConfig, error) {
@@ -55,5 +137,26 @@ func LoadCNIConfig(stdinData []byte) (*CNIConfig, error) {
 		return nil, errors.Wrap(err, "json Unmarshal error")
 	}
 
+	if config.StickyIPGracePeriod != "" {
+		grace, err := time.ParseDuration(config.StickyIPGracePeriod)
+		if err != nil || grace < 0 {
+			return nil, errors.Errorf("invalid stickyIPGracePeriod %q", config.StickyIPGracePeriod)
+		}
+		config.stickyIPGrace = grace
+	}
+
+	if config.IPQuarantinePeriod != "" {
+		quarantine, err := time.ParseDuration(config.IPQuarantinePeriod)
+		if err != nil || quarantine < 0 {
+			return nil, errors.Errorf("invalid ipQuarantinePeriod %q", config.IPQuarantinePeriod)
+		}
+		config.ipQuarantine = quarantine
+	}
+
+	// Parse the result of the previous plugin (CHECK, and DEL/ADD when chained)
+	if err := version.ParsePrevResult(&config.NetConf); err != nil {
+		return nil, errors.Wrap(err, "parse prevResult error")
+	}
+
 	return &config, nil
 }
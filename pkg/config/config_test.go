@@ -0,0 +1,90 @@
+package config
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"testing"
+)
+
+func TestNodePodCIDRs(t *testing.T) {
+	cases := []struct {
+		name     string
+		spec     v1.NodeSpec
+		blocks   string
+		expected []string
+	}{
+		{"none", v1.NodeSpec{}, "", nil},
+		{"podCIDR", v1.NodeSpec{PodCIDR: "10.244.1.0/24"}, "", []string{"10.244.1.0/24"}},
+		{"dual-stack", v1.NodeSpec{PodCIDR: "10.244.1.0/24", PodCIDRs: []string{"10.244.1.0/24", "fd00:10:244:1::/64"}}, "",
+			[]string{"10.244.1.0/24", "fd00:10:244:1::/64"}},
+		{"blocks", v1.NodeSpec{}, "10.244.3.0/24,10.244.9.0/24", []string{"10.244.3.0/24", "10.244.9.0/24"}},
+		{"grown", v1.NodeSpec{PodCIDR: "10.244.1.0/24", PodCIDRs: []string{"10.244.1.0/24"}}, "10.244.1.0/24, 10.244.200.0/24,",
+			[]string{"10.244.1.0/24", "10.244.200.0/24"}},
+	}
+
+	for _, c := range cases {
+		node := &v1.Node{ObjectMeta: metaV1.ObjectMeta{Annotations: map[string]string{}}, Spec: c.spec}
+		if c.blocks != "" {
+			node.Annotations[PodCIDRsAnnotationKey] = c.blocks
+		}
+
+		if got := NodePodCIDRs(node); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, got)
+		}
+	}
+}
+
+func TestPodMTU(t *testing.T) {
+	for stdin, expected := range map[string]int{
+		`{"cniVersion":"1.0.0","type":"bvcni","podcidr":"10.244.1.0/24"}`:            1500,
+		`{"cniVersion":"1.0.0","type":"bvcni","podcidr":"10.244.1.0/24","mtu":1450}`: 1450,
+	} {
+		CNIConfig, err := LoadCNIConfig([]byte(stdin))
+		if err != nil {
+			t.Fatalf("LoadCNIConfig: %v", err)
+		}
+		if mtu := CNIConfig.PodMTU(); mtu != expected {
+			t.Errorf("%s: expected MTU %d, got %d", stdin, expected, mtu)
+		}
+	}
+
+	for mtu, valid := range map[string]bool{"": true, "1400": true, "9000": true, "1000": false, "70000": false, "jumbo": false} {
+		agentConfig := &AgentConfig{ClusterCIDR: "10.244.0.0/16", MTU: mtu}
+		node := &v1.Node{Spec: v1.NodeSpec{PodCIDR: "10.244.1.0/24"}}
+		if err := agentConfig.Validate(node); (err == nil) != valid {
+			t.Errorf("MTU %q: expected valid=%v, got %v", mtu, valid, err)
+		}
+	}
+}
+
+func TestValidateIPAM(t *testing.T) {
+	for stdin, valid := range map[string]bool{
+		`{"type":"bvcni","kubeconfig":"/etc/cni/net.d/bvcni.kubeconfig","stickyIPGracePeriod":"10m","ipQuarantinePeriod":"1m"}`: true,
+		`{"type":"bvcni","ipam":{"type":"host-local"}}`:                                                true,
+		`{"type":"bvcni","ipam":{"type":"host-local"},"kubeconfig":"/etc/cni/net.d/bvcni.kubeconfig"}`: false,
+		`{"type":"bvcni","ipam":{"type":"host-local"},"stickyIPGracePeriod":"10m"}`:                    false,
+		`{"type":"bvcni","ipam":{"type":"host-local"},"ipQuarantinePeriod":"1m"}`:                      false,
+	} {
+		c, err := LoadCNIConfig([]byte(stdin))
+		if err != nil {
+			t.Fatalf("LoadCNIConfig(%s): %v", stdin, err)
+		}
+		if err = c.ValidateIPAM(); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got %v", stdin, valid, err)
+		}
+	}
+}
+
+func TestValidateBackend(t *testing.T) {
+	for backend, valid := range map[string]bool{"": true, "vxlan": true, "wireguard": false} {
+		agentConfig := &AgentConfig{ClusterCIDR: "10.244.0.0/16", Backend: backend}
+		node := &v1.Node{Spec: v1.NodeSpec{PodCIDR: "10.244.1.0/24"}}
+		if err := agentConfig.Validate(node); (err == nil) != valid {
+			t.Errorf("backend %q: expected valid=%v, got %v", backend, valid, err)
+		}
+		if valid && agentConfig.Backend != "vxlan" {
+			t.Errorf("backend %q: expected vxlan, got %q", backend, agentConfig.Backend)
+		}
+	}
+}
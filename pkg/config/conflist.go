@@ -0,0 +1,236 @@
+package config
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	cniConfDir = "/etc/cni/net.d"
+
+	// cniConfListName sorts first, container runtimes use the first network config of the directory.
+	cniConfListName = "00-bvcni.conflist"
+
+	// legacyCNIConfName is the single plugin config of earlier bvcnid versions, replaced by the conflist.
+	legacyCNIConfName = "00-bvcni.conf"
+)
+
+// chainedPresets are the configs of the chained plugins that can be given by name.
+var chainedPresets = map[string]map[string]interface{}{
+	"portmap":   {"type": "portmap", "snat": true, "capabilities": map[string]bool{"portMappings": true}},
+	"bandwidth": {"type": "bandwidth", "capabilities": map[string]bool{"bandwidth": true}},
+}
+
+// bvcniPluginConf is the bvcni entry of the conflist. The runtime adds cniVersion and name of the list.
+// The settings of the built-in allocator are left out when an IPAM plugin hands out the pod IPs.
+type bvcniPluginConf struct {
+	Type                string                 `json:"type"`
+	PodCidr             string                 `json:"podcidr"`
+	PodCidrs            []string               `json:"podcidrs"`
+	Kubeconfig          string                 `json:"kubeconfig,omitempty"`
+	StickyIPGracePeriod string                 `json:"stickyIPGracePeriod,omitempty"`
+	IPQuarantinePeriod  string                 `json:"ipQuarantinePeriod,omitempty"`
+	MTU                 int                    `json:"mtu"`
+	Capabilities        map[string]bool        `json:"capabilities,omitempty"`
+	IPAM                map[string]interface{} `json:"ipam,omitempty"`
+}
+
+type cniConfList struct {
+	CNIVersion string        `json:"cniVersion"`
+	Name       string        `json:"name"`
+	Plugins    []interface{} `json:"plugins"`
+}
+
+// parseChainedPlugins parses the plugins to chain after bvcni: either names, ex) portmap,tuning, or a JSON array of
+// plugin configs, ex) [{"type":"firewall","backend":"iptables"}]. Names other than portmap and bandwidth get a config
+// with nothing but the type.
+func parseChainedPlugins(chained string) ([]map[string]interface{}, error) {
+	chained = strings.TrimSpace(chained)
+	if chained == "" {
+		return nil, nil
+	}
+
+	var plugins []map[string]interface{}
+	if strings.HasPrefix(chained, "[") {
+		if err := json.Unmarshal([]byte(chained), &plugins); err != nil {
+			return nil, errors.Wrap(err, "invalid chained plugins")
+		}
+	} else {
+		for _, name := range strings.Split(chained, ",") {
+			name = strings.TrimSpace(name)
+			plugin, ok := chainedPresets[name]
+			if !ok {
+				plugin = map[string]interface{}{"type": name}
+			}
+			plugins = append(plugins, plugin)
+		}
+	}
+
+	for _, plugin := range plugins {
+		pluginType, _ := plugin["type"].(string)
+		if pluginType == "" || pluginType == "bvcni" {
+			return nil, errors.Errorf("invalid chained plugin %v, it needs a type other than bvcni", plugin)
+		}
+	}
+
+	return plugins, nil
+}
+
+// parseIPAM parses the ipam section of the bvcni config, ex) {"type":"whereabouts","range":"10.244.0.0/16"}.
+// Empty means the built-in allocator, nil is returned.
+func parseIPAM(ipam string) (map[string]interface{}, error) {
+	ipam = strings.TrimSpace(ipam)
+	if ipam == "" {
+		return nil, nil
+	}
+
+	var section map[string]interface{}
+	if err := json.Unmarshal([]byte(ipam), &section); err != nil {
+		return nil, errors.Wrap(err, "invalid ipam section")
+	}
+
+	if ipamType, _ := section["type"].(string); ipamType == "" {
+		return nil, errors.Errorf("invalid ipam section %s, it needs the type of an IPAM plugin", ipam)
+	}
+
+	return section, nil
+}
+
+// chainedCapabilities returns the capabilities that the chained plugins declare.
+func chainedCapabilities(plugins []map[string]interface{}) map[string]bool {
+	capabilities := map[string]bool{}
+	for _, plugin := range plugins {
+		switch caps := plugin["capabilities"].(type) {
+		case map[string]bool:
+			for capability, enabled := range caps {
+				capabilities[capability] = capabilities[capability] || enabled
+			}
+		case map[string]interface{}:
+			for capability, enabled := range caps {
+				capabilities[capability] = capabilities[capability] || enabled == true
+			}
+		}
+	}
+
+	return capabilities
+}
+
+// buildCNIConfList returns the conflist for the pod CIDRs and the pod MTU: bvcni, then the chained plugins. bvcni leaves the
+// bandwidth and portMappings capabilities to a chained plugin that declares them, so that they are not applied twice.
+func buildCNIConfList(podCidrs []string, mtu int, agentConfig *AgentConfig) ([]byte, error) {
+	capabilities := map[string]bool{}
+	chained := chainedCapabilities(agentConfig.PluginChain())
+	for _, capability := range []string{"bandwidth", "portMappings"} {
+		if !chained[capability] {
+			capabilities[capability] = true
+		}
+	}
+
+	bvcni := bvcniPluginConf{
+		Type:         "bvcni",
+		PodCidr:      podCidrs[0],
+		PodCidrs:     podCidrs,
+		MTU:          mtu,
+		Capabilities: capabilities,
+		IPAM:         agentConfig.IPAMSection(),
+	}
+	if bvcni.IPAM == nil {
+		bvcni.Kubeconfig = KubeconfigPath
+		bvcni.StickyIPGracePeriod = agentConfig.StickyIPGracePeriod
+		bvcni.IPQuarantinePeriod = agentConfig.IPQuarantinePeriod
+	}
+
+	plugins := []interface{}{bvcni}
+	for _, plugin := range agentConfig.PluginChain() {
+		plugins = append(plugins, plugin)
+	}
+
+	return json.MarshalIndent(cniConfList{CNIVersion: agentConfig.CNIVersion, Name: "bvcni", Plugins: plugins}, "", "  ")
+}
+
+// InitCNIPluginConfigFile writes the conflist of the node to /etc/cni/net.d. The plugin gives mtu to cni0 and the pod veths.
+func InitCNIPluginConfigFile(node *v1.Node, mtu int, agentConfig *AgentConfig) error {
+	return writeCNIConfList(cniConfDir, node, mtu, agentConfig)
+}
+
+// writeCNIConfList replaces the conflist in dir atomically, so that the runtime never reads a half-written file,
+// and removes the config of earlier bvcnid versions.
+func writeCNIConfList(dir string, node *v1.Node, mtu int, agentConfig *AgentConfig) error {
+
+	// Check Node's PodCIDR
+	podCidrs := NodePodCIDRs(node)
+	if len(podCidrs) == 0 {
+		return errors.Errorf("node : %s is not set podCIDR ", node.Name)
+	}
+
+	content, err := buildCNIConfList(podCidrs, mtu, agentConfig)
+	if err != nil {
+		return errors.Wrap(err, "marshal cni config error")
+	}
+
+	// The runtime only reads .conf, .conflist and .json files, not the temporary file
+	tmp, err := os.CreateTemp(dir, "."+cniConfListName+".*.tmp")
+	if err != nil {
+		return errors.Wrap(err, "create cni config file error")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(content); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "write cni config file error")
+	}
+
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return errors.Wrap(err, "chmod cni config file error")
+	}
+
+	if err = os.Rename(tmp.Name(), filepath.Join(dir, cniConfListName)); err != nil {
+		return errors.Wrap(err, "replace cni config file error")
+	}
+
+	if err = os.Remove(filepath.Join(dir, legacyCNIConfName)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove legacy cni config file error")
+	}
+
+	return nil
+}
+
+// OtherCNIConfigs returns the network configs in /etc/cni/net.d that bvcnid did not write, ex) of a CNI plugin
+// installed before bvcni. Only one CNI may manage the pod network of a node.
+func OtherCNIConfigs() ([]string, error) {
+	return otherCNIConfigs(cniConfDir)
+}
+
+func otherCNIConfigs(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "read cni config dir error")
+	}
+
+	var others []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || name == cniConfListName || name == legacyCNIConfName {
+			continue
+		}
+
+		switch filepath.Ext(name) {
+		case ".conf", ".conflist", ".json":
+			others = append(others, filepath.Join(dir, name))
+		}
+	}
+
+	return others, nil
+}
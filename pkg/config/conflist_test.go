@@ -0,0 +1,206 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testNode() *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metaV1.ObjectMeta{Name: "worker-1"},
+		Spec:       v1.NodeSpec{PodCIDR: "10.244.1.0/24", PodCIDRs: []string{"10.244.1.0/24", "fd00:10:244:1::/64"}},
+	}
+}
+
+func TestWriteCNIConfList(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, legacyCNIConfName), []byte(`{"type":"bvcni"}`), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	agentConfig := &AgentConfig{ClusterCIDR: "10.244.0.0/16,fd00:10:244::/56", CNIVersion: "1.1.0", IPQuarantinePeriod: "1m", ChainedPlugins: "portmap,tuning"}
+	if err := agentConfig.Validate(testNode()); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	// Writing again replaces the conflist
+	for i := 0; i < 2; i++ {
+		if err := writeCNIConfList(dir, testNode(), 1450, agentConfig); err != nil {
+			t.Fatalf("writeCNIConfList: %v", err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != cniConfListName {
+		t.Fatalf("expected only %s, got %v", cniConfListName, entries)
+	}
+
+	path := filepath.Join(dir, cniConfListName)
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+		t.Fatalf("expected a 0644 conflist, got %v (%v)", info, err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	var confList struct {
+		CNIVersion string                       `json:"cniVersion"`
+		Name       string                       `json:"name"`
+		Plugins    []map[string]json.RawMessage `json:"plugins"`
+	}
+	if err = json.Unmarshal(content, &confList); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if confList.CNIVersion != "1.1.0" || confList.Name != "bvcni" || len(confList.Plugins) != 3 {
+		t.Fatalf("unexpected conflist %s", content)
+	}
+
+	var types []string
+	for _, plugin := range confList.Plugins {
+		var pluginType string
+		_ = json.Unmarshal(plugin["type"], &pluginType)
+		types = append(types, pluginType)
+	}
+	if !reflect.DeepEqual(types, []string{"bvcni", "portmap", "tuning"}) {
+		t.Fatalf("unexpected plugins %v", types)
+	}
+
+	// The runtime adds cniVersion and name to each plugin of the list
+	plugin := confList.Plugins[0]
+	plugin["cniVersion"], _ = json.Marshal(confList.CNIVersion)
+	plugin["name"], _ = json.Marshal(confList.Name)
+	stdin, _ := json.Marshal(plugin)
+	CNIConfig, err := LoadCNIConfig(stdin)
+	if err != nil {
+		t.Fatalf("LoadCNIConfig: %v", err)
+	}
+	if !reflect.DeepEqual(CNIConfig.PodCIDRs(), testNode().Spec.PodCIDRs) || CNIConfig.IPQuarantine().String() != "1m0s" || CNIConfig.PodMTU() != 1450 {
+		t.Fatalf("unexpected bvcni config %+v", CNIConfig)
+	}
+	// portmap handles the host ports
+	if !reflect.DeepEqual(CNIConfig.Capabilities, map[string]bool{"bandwidth": true}) {
+		t.Fatalf("unexpected capabilities %v", CNIConfig.Capabilities)
+	}
+}
+
+func TestWriteCNIConfListIPAM(t *testing.T) {
+	dir := t.TempDir()
+
+	agentConfig := &AgentConfig{ClusterCIDR: "10.244.0.0/16,fd00:10:244::/56", IPQuarantinePeriod: "1m", IPAM: `{"type":"whereabouts","range":"10.244.0.0/16"}`}
+	if err := agentConfig.Validate(testNode()); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if err := writeCNIConfList(dir, testNode(), 1450, agentConfig); err != nil {
+		t.Fatalf("writeCNIConfList: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, cniConfListName))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	var confList struct {
+		Plugins []map[string]json.RawMessage `json:"plugins"`
+	}
+	if err = json.Unmarshal(content, &confList); err != nil || len(confList.Plugins) != 1 {
+		t.Fatalf("unexpected conflist %s (%v)", content, err)
+	}
+
+	// The settings of the built-in allocator would fail every ADD next to the ipam section
+	plugin := confList.Plugins[0]
+	for _, key := range []string{"kubeconfig", "stickyIPGracePeriod", "ipQuarantinePeriod"} {
+		if _, ok := plugin[key]; ok {
+			t.Errorf("unexpected %s with an IPAM plugin", key)
+		}
+	}
+
+	plugin["cniVersion"], _ = json.Marshal(defaultCNIVersion)
+	plugin["name"], _ = json.Marshal("bvcni")
+	stdin, _ := json.Marshal(plugin)
+	CNIConfig, err := LoadCNIConfig(stdin)
+	if err != nil {
+		t.Fatalf("LoadCNIConfig: %v", err)
+	}
+	if CNIConfig.IPAM.Type != "whereabouts" {
+		t.Fatalf("expected the whereabouts ipam section, got %s", plugin["ipam"])
+	}
+	if err = CNIConfig.ValidateIPAM(); err != nil {
+		t.Fatalf("ValidateIPAM: %v", err)
+	}
+}
+
+func TestParseIPAM(t *testing.T) {
+	if ipam, err := parseIPAM(""); err != nil || ipam != nil {
+		t.Fatalf("expected no ipam section, got %v (%v)", ipam, err)
+	}
+
+	for _, invalid := range []string{`{"range":"10.244.0.0/16"}`, `null`, `["host-local"]`, `{"type":`} {
+		if _, err := parseIPAM(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+
+	// Sticky IPs are a feature of the built-in allocator
+	agentConfig := &AgentConfig{ClusterCIDR: "10.244.0.0/16,fd00:10:244::/56", IPAM: `{"type":"whereabouts"}`}
+	if err := agentConfig.Validate(testNode()); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	agentConfig.StickyIPGracePeriod = "10m"
+	if err := agentConfig.Validate(testNode()); err == nil {
+		t.Fatalf("expected sticky IPs to be refused with an IPAM plugin")
+	}
+}
+
+func TestParseChainedPlugins(t *testing.T) {
+	plugins, err := parseChainedPlugins(`[{"type":"firewall","backend":"iptables"},{"type":"bandwidth","capabilities":{"bandwidth":true}}]`)
+	if err != nil {
+		t.Fatalf("parseChainedPlugins: %v", err)
+	}
+	if len(plugins) != 2 || plugins[0]["backend"] != "iptables" {
+		t.Fatalf("unexpected plugins %v", plugins)
+	}
+	if caps := chainedCapabilities(plugins); !reflect.DeepEqual(caps, map[string]bool{"bandwidth": true}) {
+		t.Fatalf("unexpected capabilities %v", caps)
+	}
+
+	for _, invalid := range []string{`[{"backend":"iptables"}]`, `[{"type":"bvcni"}]`, `portmap,,tuning`, `[{"type":`} {
+		if _, err = parseChainedPlugins(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+
+	if plugins, err = parseChainedPlugins(""); err != nil || plugins != nil {
+		t.Fatalf("expected no plugins, got %v (%v)", plugins, err)
+	}
+}
+
+func TestOtherCNIConfigs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{cniConfListName, legacyCNIConfName, "bvcni.kubeconfig", "10-flannel.conflist", "99-loopback.conf", "calico-kubeconfig"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("{}"), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	others, err := otherCNIConfigs(dir)
+	if err != nil {
+		t.Fatalf("otherCNIConfigs: %v", err)
+	}
+	expected := []string{filepath.Join(dir, "10-flannel.conflist"), filepath.Join(dir, "99-loopback.conf")}
+	if !reflect.DeepEqual(others, expected) {
+		t.Fatalf("expected %v, got %v", expected, others)
+	}
+
+	if others, err = otherCNIConfigs(filepath.Join(dir, "missing")); err != nil || len(others) != 0 {
+		t.Fatalf("expected no configs in a missing dir, got %v (%v)", others, err)
+	}
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	ipa "github.com/royroyee/bvcni/pkg/ip"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// readyFile is written by bvcnid into the IPAM data directory once the node is set up (the CNI config file,
+// the overlay device and the iptables rules), and answers the CNI STATUS verb.
+const readyFile = "bvcnid.ready"
+
+// Readiness is the content of the ready file. The data directory survives reboots while the overlay device does not,
+// so STATUS also checks that the device still exists.
+type Readiness struct {
+	Device string    `json:"device"` // ex) vxlan.1
+	Time   time.Time `json:"time"`
+}
+
+// MarkReady records that bvcnid has set up the node with the overlay device.
+func MarkReady(dataDir, device string) error {
+	content, err := json.Marshal(Readiness{Device: device, Time: time.Now()})
+	if err != nil {
+		return errors.Wrap(err, "marshal readiness error")
+	}
+
+	// Replace the file atomically, the plugin may be reading it
+	path := readyPath(dataDir)
+	if err = os.WriteFile(path+".tmp", content, 0600); err != nil {
+		return errors.Wrap(err, "write ready file error")
+	}
+
+	return errors.Wrap(os.Rename(path+".tmp", path), "replace ready file error")
+}
+
+// ClearReady removes the ready file, ex) when bvcnid starts setting up the node again.
+func ClearReady(dataDir string) error {
+	if err := os.Remove(readyPath(dataDir)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove ready file error")
+	}
+
+	return nil
+}
+
+// ReadReady returns what bvcnid recorded in MarkReady. The error satisfies os.IsNotExist while bvcnid has not finished.
+func ReadReady(dataDir string) (*Readiness, error) {
+	content, err := os.ReadFile(readyPath(dataDir))
+	if err != nil {
+		return nil, err
+	}
+
+	readiness := &Readiness{}
+	if err = json.Unmarshal(content, readiness); err != nil {
+		return nil, errors.Wrap(err, "decode ready file error")
+	}
+
+	return readiness, nil
+}
+
+func readyPath(dataDir string) string {
+	if dataDir == "" {
+		dataDir = ipa.DefaultDataDir
+	}
+
+	return filepath.Join(dataDir, readyFile)
+}
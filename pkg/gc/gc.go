@@ -0,0 +1,196 @@
+package gc
+
+import (
+	"fmt"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/pkg/errors"
+	"github.com/royroyee/bvcni/pkg/bandwidth"
+	"github.com/royroyee/bvcni/pkg/bridge"
+	"github.com/royroyee/bvcni/pkg/hostport"
+	ipa "github.com/royroyee/bvcni/pkg/ip"
+	"github.com/vishvananda/netlink"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Refer : https://github.com/containernetworking/cni/blob/main/SPEC.md#garbage-collection
+
+// Hooks for the host state, variables so that tests can fake them.
+var (
+	now = time.Now
+
+	linkExists = func(name string) bool {
+		_, err := netlink.LinkByName(name)
+		return err == nil
+	}
+
+	// netnsExists checks the netns path recorded at ADD. Paths under /proc (ex. docker) belong to
+	// the host pid namespace and cannot be checked from bvcnid, they always count as existing.
+	netnsExists = func(path string) bool {
+		if strings.HasPrefix(path, "/proc/") {
+			return true
+		}
+		_, err := os.Stat(path)
+		return !os.IsNotExist(err)
+	}
+
+	delLink = ip.DelLinkByName
+
+	tearDownHostPorts = hostport.TearDown
+)
+
+// Collector releases the IPAM allocations that kubelet never DELeted (node crash, runtime bug), before they
+// exhaust the pod CIDRs. An allocation is leaked when its pod no longer runs on the node, or when its host veth
+// or network namespace is gone. It is only released once it has looked leaked for the whole safety window,
+// so that ADDs and DELs in progress are left alone.
+type Collector struct {
+	store         *ipa.Store
+	podRunning    func(pod string) bool // namespace/name
+	window        time.Duration
+	stickyIPGrace time.Duration
+
+	orphans   map[string]time.Time // containerID/ifName -> first time it looked leaked
+	released  uint64
+	onRelease func(message string)
+}
+
+// NewCollector returns a Collector for the allocations of store. Released sticky IPs stay reserved for stickyIPGrace, like after a DEL.
+func NewCollector(store *ipa.Store, podRunning func(pod string) bool, window, stickyIPGrace time.Duration) *Collector {
+	return &Collector{
+		store:         store,
+		podRunning:    podRunning,
+		window:        window,
+		stickyIPGrace: stickyIPGrace,
+		orphans:       map[string]time.Time{},
+	}
+}
+
+// Run reconciles every interval until stopCh is closed.
+func (c *Collector) Run(stopCh <-chan struct{}, interval time.Duration) {
+	wait.Until(func() {
+		if err := c.Reconcile(); err != nil {
+			klog.Errorf("IPAM garbage collection error : %s", err.Error())
+		}
+	}, interval, stopCh)
+}
+
+// SetOnRelease sets a function that gets the message of each release, with the number of allocations released so far,
+// ex) to record it as a node event. It must be set before Run.
+func (c *Collector) SetOnRelease(onRelease func(message string)) {
+	c.onRelease = onRelease
+}
+
+// Reconcile compares the allocations against the pods, host veths and network namespaces of the node,
+// and releases the ones that have been leaked for longer than the safety window.
+func (c *Collector) Reconcile() error {
+	allocs, err := c.store.List()
+	if err != nil {
+		return errors.Wrap(err, "list IPAM allocations error")
+	}
+
+	// One allocation per IP family, they are released together
+	var keys []string
+	byKey := map[string][]ipa.AllocatedIP{}
+	for _, alloc := range allocs {
+		key := alloc.ContainerID + "/" + alloc.IfName
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		byKey[key] = append(byKey[key], alloc)
+	}
+
+	// Forget the allocations that were released in the meantime
+	for key := range c.orphans {
+		if _, ok := byKey[key]; !ok {
+			delete(c.orphans, key)
+		}
+	}
+
+	for _, key := range keys {
+		alloc := byKey[key][0]
+
+		reason := c.leaked(alloc)
+		if reason == "" {
+			delete(c.orphans, key)
+			continue
+		}
+
+		first, ok := c.orphans[key]
+		if !ok {
+			klog.V(2).Infof("allocation of %s (pod %q) looks leaked: %s", key, alloc.Pod, reason)
+			c.orphans[key] = now()
+			continue
+		}
+		if now().Sub(first) < c.window {
+			continue
+		}
+
+		if err = c.release(alloc); err != nil {
+			klog.Errorf("release leaked allocation of %s error : %s", key, err.Error())
+			continue
+		}
+		delete(c.orphans, key)
+
+		released := atomic.AddUint64(&c.released, 1)
+		message := fmt.Sprintf("released leaked IPs %s of %s (pod %q): %s, %d leaked allocations released so far",
+			addresses(byKey[key]), key, alloc.Pod, reason, released)
+		klog.Info(message)
+		if c.onRelease != nil {
+			c.onRelease(message)
+		}
+	}
+
+	return nil
+}
+
+// leaked returns why the allocation looks leaked, or "" if it is in use.
+func (c *Collector) leaked(alloc ipa.AllocatedIP) string {
+	// Allocations of plugin versions that did not record the pod are only checked against the host
+	if alloc.Pod != "" && !c.podRunning(alloc.Pod) {
+		return fmt.Sprintf("pod %s is not running on the node", alloc.Pod)
+	}
+
+	if name := bridge.HostVethName(alloc.ContainerID, alloc.IfName); !linkExists(name) {
+		return fmt.Sprintf("host veth %s is gone", name)
+	}
+
+	if alloc.Netns != "" && !netnsExists(alloc.Netns) {
+		return fmt.Sprintf("network namespace %s is gone", alloc.Netns)
+	}
+
+	return ""
+}
+
+// release does what the missing DEL would have done on the host: delete the host veth (which takes
+// the container end with it), the ifb device and the host ports, and return the IPs.
+func (c *Collector) release(alloc ipa.AllocatedIP) error {
+	// The ifb device only exists for pods with an egress bandwidth limit
+	for _, name := range []string{bridge.HostVethName(alloc.ContainerID, alloc.IfName), bandwidth.IfbName(alloc.ContainerID, alloc.IfName)} {
+		if linkExists(name) {
+			if err := delLink(name); err != nil && !errors.Is(err, ip.ErrLinkNotFound) {
+				return errors.Wrapf(err, "delete link %s error", name)
+			}
+		}
+	}
+
+	// The host ports DNAT to the IPs, which the next pod may get
+	if err := tearDownHostPorts(alloc.ContainerID, alloc.IfName); err != nil {
+		return errors.Wrap(err, "delete host ports error")
+	}
+
+	return c.store.ReturnIPWithGracePeriod(alloc.ContainerID, alloc.IfName, c.stickyIPGrace)
+}
+
+// addresses joins the addresses of the allocations. ex) 10.244.1.5/24,fd00:10:244:1::5/64
+func addresses(allocs []ipa.AllocatedIP) string {
+	var addrs []string
+	for _, alloc := range allocs {
+		addrs = append(addrs, alloc.Address)
+	}
+
+	return strings.Join(addrs, ",")
+}
@@ -0,0 +1,212 @@
+package gc
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/royroyee/bvcni/pkg/bridge"
+	ipa "github.com/royroyee/bvcni/pkg/ip"
+)
+
+// fakeHost fakes the pods, host veths and network namespaces of the node.
+type fakeHost struct {
+	pods    map[string]bool
+	links   map[string]bool
+	netns   map[string]bool
+	deleted []string
+	// containers whose host ports were torn down
+	hostPortsDeleted []string
+}
+
+func newFakeHost(t *testing.T) *fakeHost {
+	h := &fakeHost{pods: map[string]bool{}, links: map[string]bool{}, netns: map[string]bool{}}
+
+	origLinkExists, origNetnsExists, origDelLink, origTearDown := linkExists, netnsExists, delLink, tearDownHostPorts
+	t.Cleanup(func() {
+		linkExists, netnsExists, delLink, now = origLinkExists, origNetnsExists, origDelLink, time.Now
+		tearDownHostPorts = origTearDown
+	})
+
+	linkExists = func(name string) bool { return h.links[name] }
+	netnsExists = func(path string) bool { return h.netns[path] }
+	delLink = func(name string) error {
+		h.deleted = append(h.deleted, name)
+		delete(h.links, name)
+		return nil
+	}
+	tearDownHostPorts = func(containerID, ifName string) error {
+		h.hostPortsDeleted = append(h.hostPortsDeleted, containerID)
+		return nil
+	}
+
+	return h
+}
+
+// addPod allocates the IPs of a pod and creates its host veth and netns.
+func (h *fakeHost) addPod(t *testing.T, store *ipa.Store, pod, containerID string) {
+	netns := "/var/run/netns/cni-" + containerID
+	req := ipa.Request{ContainerID: containerID, IfName: "eth0", Pod: pod, Netns: netns}
+	if _, err := store.Allocate([]string{"10.244.1.0/24"}, ipa.Ranges{}, req); err != nil {
+		t.Fatalf("Allocate %s: %v", pod, err)
+	}
+
+	h.pods[pod] = true
+	h.links[bridge.HostVethName(containerID, "eth0")] = true
+	h.netns[netns] = true
+}
+
+func allocated(t *testing.T, store *ipa.Store, containerID string) bool {
+	allocs, err := store.Get(containerID, "eth0")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	return len(allocs) > 0
+}
+
+func TestReconcile(t *testing.T) {
+	store, err := ipa.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+
+	h := newFakeHost(t)
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+
+	h.addPod(t, store, "default/running", "c-running")
+	h.addPod(t, store, "default/deleted", "c-deleted")
+	h.addPod(t, store, "default/crashed", "c-crashed")
+	h.addPod(t, store, "default/netns", "c-netns")
+
+	// kubelet never DELeted: the pod is gone, the node rebooted (veth gone), the netns was removed
+	delete(h.pods, "default/deleted")
+	delete(h.links, bridge.HostVethName("c-crashed", "eth0"))
+	delete(h.netns, "/var/run/netns/cni-c-netns")
+
+	c := NewCollector(store, func(pod string) bool { return h.pods[pod] }, 5*time.Minute, 0)
+	var messages []string
+	c.SetOnRelease(func(message string) { messages = append(messages, message) })
+
+	// Leaked allocations are only released after the safety window
+	for _, elapsed := range []time.Duration{0, 4 * time.Minute} {
+		clock = clock.Add(elapsed)
+		if err = c.Reconcile(); err != nil {
+			t.Fatalf("Reconcile: %v", err)
+		}
+		for _, id := range []string{"c-running", "c-deleted", "c-crashed", "c-netns"} {
+			if !allocated(t, store, id) {
+				t.Fatalf("%s released within the safety window", id)
+			}
+		}
+	}
+
+	clock = clock.Add(time.Minute)
+	if err = c.Reconcile(); err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+
+	if !allocated(t, store, "c-running") {
+		t.Fatalf("allocation of a running pod released")
+	}
+	for _, id := range []string{"c-deleted", "c-crashed", "c-netns"} {
+		if allocated(t, store, id) {
+			t.Errorf("leaked allocation %s not released", id)
+		}
+	}
+
+	// Each release is counted
+	if len(messages) != 3 || !strings.HasSuffix(messages[2], ", 3 leaked allocations released so far") {
+		t.Fatalf("expected 3 counted releases, got %q", messages)
+	}
+
+	// The host veth of the deleted pod went with it
+	if h.links[bridge.HostVethName("c-deleted", "eth0")] {
+		t.Fatalf("host veth of the leaked allocation not deleted")
+	}
+	if len(h.hostPortsDeleted) != 3 {
+		t.Fatalf("expected the host ports of 3 containers to be deleted, got %v", h.hostPortsDeleted)
+	}
+}
+
+func TestReconcileRecovered(t *testing.T) {
+	store, err := ipa.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+
+	h := newFakeHost(t)
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+
+	// ADD in progress: IPs allocated, host veth not created yet
+	h.addPod(t, store, "default/web-0", "c-web")
+	veth := bridge.HostVethName("c-web", "eth0")
+	delete(h.links, veth)
+
+	c := NewCollector(store, func(pod string) bool { return h.pods[pod] }, 5*time.Minute, 0)
+	released := 0
+	c.SetOnRelease(func(string) { released++ })
+	if err = c.Reconcile(); err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+
+	// The veth shows up, the window starts over the next time it looks leaked
+	h.links[veth] = true
+	clock = clock.Add(3 * time.Minute)
+	if err = c.Reconcile(); err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+
+	delete(h.links, veth)
+	clock = clock.Add(3 * time.Minute)
+	if err = c.Reconcile(); err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+
+	if !allocated(t, store, "c-web") || released != 0 {
+		t.Fatalf("allocation released although it was in use within the safety window")
+	}
+}
+
+func TestReconcileStickyIPs(t *testing.T) {
+	store, err := ipa.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+
+	h := newFakeHost(t)
+	clock := time.Now()
+	now = func() time.Time { return clock }
+
+	req := ipa.Request{ContainerID: "c-old", IfName: "eth0", Owner: "default/db-0", Pod: "default/db-0"}
+	allocs, err := store.Allocate([]string{"10.244.1.0/24"}, ipa.Ranges{}, req)
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+
+	// The node crashed, so the old sandbox's veth is gone while the recreated pod runs
+	h.pods["default/db-0"] = true
+
+	c := NewCollector(store, func(pod string) bool { return h.pods[pod] }, time.Minute, 10*time.Minute)
+	for i := 0; i < 2; i++ {
+		if err = c.Reconcile(); err != nil {
+			t.Fatalf("Reconcile: %v", err)
+		}
+		clock = clock.Add(time.Minute)
+	}
+	if allocated(t, store, "c-old") {
+		t.Fatalf("leaked allocation not released")
+	}
+
+	// Released like a DEL, the sticky IP stays reserved for the pod
+	req.ContainerID = "c-new"
+	again, err := store.Allocate([]string{"10.244.1.0/24"}, ipa.Ranges{}, req)
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if again[0].Address != allocs[0].Address {
+		t.Fatalf("expected the sticky IP %s back, got %s", allocs[0].Address, again[0].Address)
+	}
+}
@@ -0,0 +1,318 @@
+package hostport
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/pkg/errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The nat chains owned by bvcni. Every pod with host ports gets a DNAT and a SNAT chain of its own,
+// so `iptables -t nat -S | grep BVCNI-` shows which pod holds which port.
+const (
+	// HostPortsChain is jumped to from PREROUTING and OUTPUT for local destinations, and jumps to the DNAT chains of the pods.
+	HostPortsChain = "BVCNI-HOSTPORTS"
+	// HostPortsSNATChain is jumped to from POSTROUTING, and jumps to the SNAT chains of the pods.
+	HostPortsSNATChain = "BVCNI-HOSTPORTS-SNAT"
+
+	dnatChainPrefix = "BVCNI-DN-"
+	snatChainPrefix = "BVCNI-SN-"
+)
+
+// PortMapping is an entry of the portMappings capability, which kubelet fills from the hostPort of the containers.
+type PortMapping struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"hostIP,omitempty"`
+}
+
+// iptablesRunner is the part of go-iptables the host ports need, so that tests can run without an iptables binary.
+type iptablesRunner interface {
+	ChainExists(table, chain string) (bool, error)
+	ClearChain(table, chain string) error
+	ClearAndDeleteChain(table, chain string) error
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	Insert(table, chain string, pos int, rulespec ...string) error
+	AppendUnique(table, chain string, rulespec ...string) error
+	DeleteIfExists(table, chain string, rulespec ...string) error
+	List(table, chain string) ([]string, error)
+}
+
+var newIPTables = func(protocol iptables.Protocol) (iptablesRunner, error) {
+	return iptables.NewWithProtocol(protocol)
+}
+
+// Validate checks the port mappings of a pod.
+func Validate(mappings []PortMapping) error {
+	for _, m := range mappings {
+		if m.HostPort < 1 || m.HostPort > 65535 || m.ContainerPort < 1 || m.ContainerPort > 65535 {
+			return errors.Errorf("invalid port mapping %d:%d", m.HostPort, m.ContainerPort)
+		}
+
+		switch strings.ToLower(m.Protocol) {
+		case "tcp", "udp", "sctp":
+		default:
+			return errors.Errorf("invalid protocol %q of host port %d", m.Protocol, m.HostPort)
+		}
+
+		if m.HostIP != "" && net.ParseIP(m.HostIP) == nil {
+			return errors.Errorf("invalid host IP %q of host port %d", m.HostIP, m.HostPort)
+		}
+	}
+
+	return nil
+}
+
+// podChains returns the names of the DNAT and SNAT chains of a container interface. ex) BVCNI-DN-1A2B3C4D5E6F7A8B
+func podChains(containerID, ifName string) (string, string) {
+	sum := sha1.Sum([]byte(containerID + "/" + ifName))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:])[:16])
+	return dnatChainPrefix + hash, snatChainPrefix + hash
+}
+
+// podRules returns the rules of the DNAT and SNAT chains of a pod IP: host port traffic is DNATed to the pod,
+// and traffic of the pod to its own host port (hairpin) is masqueraded, so that the replies go back through the host.
+func podRules(podIP net.IP, mappings []PortMapping) ([][]string, [][]string) {
+	var dnat, snat [][]string
+	for _, m := range mappings {
+		hostIP := net.ParseIP(m.HostIP)
+		if hostIP != nil && !hostIP.IsUnspecified() && (hostIP.To4() == nil) != (podIP.To4() == nil) {
+			continue
+		}
+		protocol := strings.ToLower(m.Protocol)
+
+		rule := []string{"-p", protocol, "--dport", strconv.Itoa(m.HostPort)}
+		if hostIP != nil && !hostIP.IsUnspecified() {
+			rule = append(rule, "-d", hostIP.String())
+		}
+		dnat = append(dnat, append(rule, "-j", "DNAT", "--to-destination", net.JoinHostPort(podIP.String(), strconv.Itoa(m.ContainerPort))))
+
+		snat = append(snat, []string{"-s", podIP.String(), "-d", podIP.String(), "-p", protocol, "--dport", strconv.Itoa(m.ContainerPort), "-j", "MASQUERADE"})
+	}
+
+	return dnat, snat
+}
+
+// jumpRule is the rule of a top level chain that jumps to the chain of a container interface.
+func jumpRule(containerID, ifName, chain string) []string {
+	return []string{"-m", "comment", "--comment", containerID + "/" + ifName, "-j", chain}
+}
+
+// protocolOf returns the iptables protocol of ip.
+func protocolOf(ip net.IP) iptables.Protocol {
+	if ip.To4() == nil {
+		return iptables.ProtocolIPv6
+	}
+
+	return iptables.ProtocolIPv4
+}
+
+// SetUp installs the host ports of a container interface for each of its pod IPs (IPv4 and IPv6 on dual-stack
+// nodes): a DNAT chain and a SNAT chain for the pod, and the jumps from the bvcni top level chains to them.
+func SetUp(containerID, ifName string, podIPs []net.IP, mappings []PortMapping) error {
+	dnatChain, snatChain := podChains(containerID, ifName)
+
+	for _, podIP := range podIPs {
+		dnat, snat := podRules(podIP, mappings)
+		if len(dnat) == 0 {
+			continue
+		}
+
+		ipt, err := newIPTables(protocolOf(podIP))
+		if err != nil {
+			return errors.Wrap(err, "failed to setup iptables")
+		}
+
+		if err = ensureTopChains(ipt); err != nil {
+			return err
+		}
+
+		for chain, rules := range map[string][][]string{dnatChain: dnat, snatChain: snat} {
+			// ClearChain creates the chain, or flushes the rules of an earlier ADD
+			if err = ipt.ClearChain("nat", chain); err != nil {
+				return errors.Wrapf(err, "failed to create chain %s", chain)
+			}
+
+			for _, rule := range rules {
+				if err = ipt.AppendUnique("nat", chain, rule...); err != nil {
+					return errors.Wrapf(err, "failed to add rule to %s", chain)
+				}
+			}
+		}
+
+		if err = ipt.AppendUnique("nat", HostPortsChain, jumpRule(containerID, ifName, dnatChain)...); err != nil {
+			return errors.Wrapf(err, "failed to add jump to %s", dnatChain)
+		}
+		if err = ipt.AppendUnique("nat", HostPortsSNATChain, jumpRule(containerID, ifName, snatChain)...); err != nil {
+			return errors.Wrapf(err, "failed to add jump to %s", snatChain)
+		}
+	}
+
+	return nil
+}
+
+// ensureTopChains creates the bvcni top level chains and the jumps of the built-in chains to them.
+func ensureTopChains(ipt iptablesRunner) error {
+	jumps := []struct {
+		chain, target string
+		rule          []string
+	}{
+		{"PREROUTING", HostPortsChain, []string{"-m", "addrtype", "--dst-type", "LOCAL", "-j", HostPortsChain}},
+		{"OUTPUT", HostPortsChain, []string{"-m", "addrtype", "--dst-type", "LOCAL", "-j", HostPortsChain}},
+		// Before the MASQUERADE rule of the pod CIDR
+		{"POSTROUTING", HostPortsSNATChain, []string{"-j", HostPortsSNATChain}},
+	}
+
+	for _, jump := range jumps {
+		exists, err := ipt.ChainExists("nat", jump.target)
+		if err != nil {
+			return errors.Wrapf(err, "failed to check chain %s", jump.target)
+		}
+		if !exists {
+			if err = ipt.ClearChain("nat", jump.target); err != nil {
+				return errors.Wrapf(err, "failed to create chain %s", jump.target)
+			}
+		}
+
+		if exists, err = ipt.Exists("nat", jump.chain, jump.rule...); err != nil {
+			return errors.Wrapf(err, "failed to check the jump of %s", jump.chain)
+		}
+		if !exists {
+			if err = ipt.Insert("nat", jump.chain, 1, jump.rule...); err != nil {
+				return errors.Wrapf(err, "failed to add the jump of %s", jump.chain)
+			}
+		}
+	}
+
+	return nil
+}
+
+// TearDown removes the host ports of a container interface, for IPv4 and IPv6. Removing them twice is not an error.
+// An IP family without iptables (ex. no ip6tables binary) cannot have host ports and is skipped.
+func TearDown(containerID, ifName string) error {
+	dnatChain, snatChain := podChains(containerID, ifName)
+
+	for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt, err := newIPTables(protocol)
+		if err != nil {
+			continue
+		}
+
+		for top, chain := range map[string]string{HostPortsChain: dnatChain, HostPortsSNATChain: snatChain} {
+			exists, err := ipt.ChainExists("nat", chain)
+			if err != nil {
+				return errors.Wrapf(err, "failed to check chain %s", chain)
+			}
+			if !exists {
+				continue
+			}
+
+			if err = ipt.DeleteIfExists("nat", top, jumpRule(containerID, ifName, chain)...); err != nil {
+				return errors.Wrapf(err, "failed to delete jump to %s", chain)
+			}
+			if err = ipt.ClearAndDeleteChain("nat", chain); err != nil {
+				return errors.Wrapf(err, "failed to delete chain %s", chain)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Attachment is a container interface that has host ports.
+type Attachment struct {
+	ContainerID string
+	IfName      string
+}
+
+// Attachments returns the container interfaces with host ports, from the comments (containerID/ifName) of the jumps
+// of HostPortsChain, for IPv4 and IPv6. An IP family without iptables or without the chain has none.
+func Attachments() ([]Attachment, error) {
+	var attachments []Attachment
+	seen := map[Attachment]bool{}
+
+	for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt, err := newIPTables(protocol)
+		if err != nil {
+			continue
+		}
+
+		exists, err := ipt.ChainExists("nat", HostPortsChain)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to check chain %s", HostPortsChain)
+		}
+		if !exists {
+			continue
+		}
+
+		rules, err := ipt.List("nat", HostPortsChain)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list chain %s", HostPortsChain)
+		}
+
+		// ex) -A BVCNI-HOSTPORTS -m comment --comment "c1/eth0" -j BVCNI-DN-1A2B3C4D5E6F7A8B
+		for _, rule := range rules {
+			fields := strings.Fields(rule)
+			for i := 0; i+1 < len(fields); i++ {
+				if fields[i] != "--comment" {
+					continue
+				}
+
+				comment := strings.Trim(fields[i+1], `"`)
+				slash := strings.LastIndex(comment, "/")
+				if slash <= 0 || slash == len(comment)-1 {
+					break
+				}
+				attachment := Attachment{ContainerID: comment[:slash], IfName: comment[slash+1:]}
+				if !seen[attachment] {
+					seen[attachment] = true
+					attachments = append(attachments, attachment)
+				}
+				break
+			}
+		}
+	}
+
+	return attachments, nil
+}
+
+// Check verifies that every rule SetUp installed for the container interface is still in place.
+func Check(containerID, ifName string, podIPs []net.IP, mappings []PortMapping) error {
+	dnatChain, snatChain := podChains(containerID, ifName)
+
+	for _, podIP := range podIPs {
+		dnat, snat := podRules(podIP, mappings)
+		if len(dnat) == 0 {
+			continue
+		}
+
+		ipt, err := newIPTables(protocolOf(podIP))
+		if err != nil {
+			return errors.Wrap(err, "failed to setup iptables")
+		}
+
+		rules := map[string][][]string{
+			dnatChain:          dnat,
+			snatChain:          snat,
+			HostPortsChain:     {jumpRule(containerID, ifName, dnatChain)},
+			HostPortsSNATChain: {jumpRule(containerID, ifName, snatChain)},
+		}
+		for chain, chainRules := range rules {
+			for _, rule := range chainRules {
+				exists, err := ipt.Exists("nat", chain, rule...)
+				if err != nil {
+					return errors.Wrapf(err, "failed to check chain %s", chain)
+				}
+				if !exists {
+					return errors.Errorf("rule %q of %s is missing in chain %s", strings.Join(rule, " "), podIP, chain)
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,219 @@
+package hostport
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// fakeIPTables keeps the rules of each chain of the nat table in memory.
+type fakeIPTables struct {
+	chains map[string][]string
+}
+
+func newFakeIPTables() *fakeIPTables {
+	return &fakeIPTables{chains: map[string][]string{"PREROUTING": nil, "OUTPUT": nil, "POSTROUTING": {"-s 10.244.1.0/24 ! -d 10.244.0.0/16 -j MASQUERADE"}}}
+}
+
+func (f *fakeIPTables) ChainExists(_, chain string) (bool, error) {
+	_, ok := f.chains[chain]
+	return ok, nil
+}
+
+func (f *fakeIPTables) ClearChain(_, chain string) error {
+	f.chains[chain] = nil
+	return nil
+}
+
+func (f *fakeIPTables) ClearAndDeleteChain(_, chain string) error {
+	delete(f.chains, chain)
+	return nil
+}
+
+func (f *fakeIPTables) Exists(_, chain string, rulespec ...string) (bool, error) {
+	for _, rule := range f.chains[chain] {
+		if rule == strings.Join(rulespec, " ") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *fakeIPTables) Insert(_, chain string, pos int, rulespec ...string) error {
+	rules := f.chains[chain]
+	f.chains[chain] = append(rules[:pos-1:pos-1], append([]string{strings.Join(rulespec, " ")}, rules[pos-1:]...)...)
+	return nil
+}
+
+func (f *fakeIPTables) AppendUnique(table, chain string, rulespec ...string) error {
+	if exists, _ := f.Exists(table, chain, rulespec...); !exists {
+		f.chains[chain] = append(f.chains[chain], strings.Join(rulespec, " "))
+	}
+	return nil
+}
+
+func (f *fakeIPTables) DeleteIfExists(_, chain string, rulespec ...string) error {
+	kept := f.chains[chain][:0]
+	for _, rule := range f.chains[chain] {
+		if rule != strings.Join(rulespec, " ") {
+			kept = append(kept, rule)
+		}
+	}
+	f.chains[chain] = kept
+	return nil
+}
+
+// List returns the rules of chain like iptables -S, with the comments quoted.
+func (f *fakeIPTables) List(_, chain string) ([]string, error) {
+	rules := []string{"-N " + chain}
+	for _, rule := range f.chains[chain] {
+		fields := strings.Fields(rule)
+		for i := range fields {
+			if i > 0 && fields[i-1] == "--comment" {
+				fields[i] = `"` + fields[i] + `"`
+			}
+		}
+		rules = append(rules, "-A "+chain+" "+strings.Join(fields, " "))
+	}
+	return rules, nil
+}
+
+func fakeHost(t *testing.T) map[iptables.Protocol]*fakeIPTables {
+	tables := map[iptables.Protocol]*fakeIPTables{
+		iptables.ProtocolIPv4: newFakeIPTables(),
+		iptables.ProtocolIPv6: newFakeIPTables(),
+	}
+
+	orig := newIPTables
+	t.Cleanup(func() { newIPTables = orig })
+	newIPTables = func(protocol iptables.Protocol) (iptablesRunner, error) {
+		return tables[protocol], nil
+	}
+
+	return tables
+}
+
+func TestSetUpTearDown(t *testing.T) {
+	tables := fakeHost(t)
+	v4, v6 := tables[iptables.ProtocolIPv4], tables[iptables.ProtocolIPv6]
+
+	podIPs := []net.IP{net.ParseIP("10.244.1.5"), net.ParseIP("fd00:10:244:1::5")}
+	mappings := []PortMapping{
+		{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"},
+		{HostPort: 5353, ContainerPort: 53, Protocol: "UDP", HostIP: "192.168.0.10"},
+	}
+
+	// A second ADD of the same container must not duplicate anything
+	for i := 0; i < 2; i++ {
+		if err := SetUp("c1", "eth0", podIPs, mappings); err != nil {
+			t.Fatalf("SetUp: %v", err)
+		}
+	}
+
+	dnatChain, snatChain := podChains("c1", "eth0")
+	expectRules := func(f *fakeIPTables, chain string, expected ...string) {
+		t.Helper()
+		if strings.Join(f.chains[chain], "\n") != strings.Join(expected, "\n") {
+			t.Errorf("%s: expected %q, got %q", chain, expected, f.chains[chain])
+		}
+	}
+
+	expectRules(v4, dnatChain,
+		"-p tcp --dport 8080 -j DNAT --to-destination 10.244.1.5:80",
+		"-p udp --dport 5353 -d 192.168.0.10 -j DNAT --to-destination 10.244.1.5:53")
+	expectRules(v4, snatChain,
+		"-s 10.244.1.5 -d 10.244.1.5 -p tcp --dport 80 -j MASQUERADE",
+		"-s 10.244.1.5 -d 10.244.1.5 -p udp --dport 53 -j MASQUERADE")
+	// The IPv4 host IP only applies to IPv4
+	expectRules(v6, dnatChain, "-p tcp --dport 8080 -j DNAT --to-destination [fd00:10:244:1::5]:80")
+
+	expectRules(v4, "PREROUTING", "-m addrtype --dst-type LOCAL -j "+HostPortsChain)
+	expectRules(v4, "OUTPUT", "-m addrtype --dst-type LOCAL -j "+HostPortsChain)
+	expectRules(v4, "POSTROUTING", "-j "+HostPortsSNATChain, "-s 10.244.1.0/24 ! -d 10.244.0.0/16 -j MASQUERADE")
+	expectRules(v4, HostPortsChain, "-m comment --comment c1/eth0 -j "+dnatChain)
+	expectRules(v4, HostPortsSNATChain, "-m comment --comment c1/eth0 -j "+snatChain)
+
+	if err := Check("c1", "eth0", podIPs, mappings); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+
+	// Another pod keeps its host ports
+	if err := SetUp("c2", "eth0", []net.IP{net.ParseIP("10.244.1.6")}, []PortMapping{{HostPort: 9090, ContainerPort: 90, Protocol: "tcp"}}); err != nil {
+		t.Fatalf("SetUp: %v", err)
+	}
+	otherChain, _ := podChains("c2", "eth0")
+
+	attachments, err := Attachments()
+	if err != nil {
+		t.Fatalf("Attachments: %v", err)
+	}
+	if expected := []Attachment{{"c1", "eth0"}, {"c2", "eth0"}}; !reflect.DeepEqual(attachments, expected) {
+		t.Errorf("expected attachments %v, got %v", expected, attachments)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := TearDown("c1", "eth0"); err != nil {
+			t.Fatalf("TearDown: %v", err)
+		}
+	}
+
+	for _, f := range []*fakeIPTables{v4, v6} {
+		if _, ok := f.chains[dnatChain]; ok {
+			t.Errorf("DNAT chain not deleted")
+		}
+		if _, ok := f.chains[snatChain]; ok {
+			t.Errorf("SNAT chain not deleted")
+		}
+	}
+	expectRules(v4, HostPortsChain, "-m comment --comment c2/eth0 -j "+otherChain)
+	expectRules(v6, HostPortsChain)
+
+	if err := Check("c1", "eth0", podIPs, mappings); err == nil {
+		t.Fatalf("expected Check to fail without the rules")
+	}
+
+	if attachments, err = Attachments(); err != nil || !reflect.DeepEqual(attachments, []Attachment{{"c2", "eth0"}}) {
+		t.Errorf("expected the attachment of c2 only, got %v (%v)", attachments, err)
+	}
+}
+
+func TestCheckMissingRule(t *testing.T) {
+	tables := fakeHost(t)
+
+	podIPs := []net.IP{net.ParseIP("10.244.1.5")}
+	mappings := []PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}}
+	if err := SetUp("c1", "eth0", podIPs, mappings); err != nil {
+		t.Fatalf("SetUp: %v", err)
+	}
+
+	_, snatChain := podChains("c1", "eth0")
+	tables[iptables.ProtocolIPv4].chains[snatChain] = nil
+
+	err := Check("c1", "eth0", podIPs, mappings)
+	if err == nil || !strings.Contains(err.Error(), snatChain) {
+		t.Fatalf("expected the missing rule of %s, got %v", snatChain, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		mapping PortMapping
+		valid   bool
+	}{
+		{PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}, true},
+		{PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "SCTP", HostIP: "fd00::1"}, true},
+		{PortMapping{HostPort: 0, ContainerPort: 80, Protocol: "tcp"}, false},
+		{PortMapping{HostPort: 8080, ContainerPort: 65536, Protocol: "tcp"}, false},
+		{PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "icmp"}, false},
+		{PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "tcp", HostIP: "localhost"}, false},
+	}
+
+	for _, c := range cases {
+		if err := Validate([]PortMapping{c.mapping}); (err == nil) != c.valid {
+			t.Errorf("%+v: expected valid=%v, got %v", c.mapping, c.valid, err)
+		}
+	}
+}
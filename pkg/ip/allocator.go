@@ -0,0 +1,179 @@
+package ip
+
+import (
+	"encoding/binary"
+	cniip "github.com/containernetworking/plugins/pkg/ip"
+	"math"
+	"math/bits"
+	"net"
+	"net/netip"
+)
+
+const (
+	// maxRangeSize caps the dynamic range of huge (IPv6) pod CIDRs, like PodIPCount.
+	maxRangeSize = math.MaxUint32
+	// maxBitmapSize is the largest range whose used addresses are kept in a bitmap (128KiB), larger ones use a map.
+	maxBitmapSize = 1 << 20
+)
+
+// offsetRange is the dynamic range of a pod CIDR as offsets from rangeStart, ex) 10.244.1.2-10.244.1.254 is 0-252.
+// Addresses are looked up by offset, so the range is never materialized: finding the next free address costs
+// O(allocated addresses + exclusions), not O(size of the pod CIDR).
+type offsetRange struct {
+	cr   *cidrRange
+	size uint64
+	used usedSet // offsets of the allocated and reserved addresses
+}
+
+// usedSet is a bitmap of offsets, or a map when the range is too large for one.
+type usedSet struct {
+	bitmap []uint64
+	sparse map[uint64]bool
+}
+
+func newUsedSet(size uint64) usedSet {
+	if size <= maxBitmapSize {
+		return usedSet{bitmap: make([]uint64, (size+63)/64)}
+	}
+
+	return usedSet{sparse: map[uint64]bool{}}
+}
+
+func (u usedSet) add(off uint64) {
+	if u.bitmap != nil {
+		u.bitmap[off/64] |= 1 << (off % 64)
+		return
+	}
+	u.sparse[off] = true
+}
+
+func (u usedSet) has(off uint64) bool {
+	if u.bitmap != nil {
+		return u.bitmap[off/64]&(1<<(off%64)) != 0
+	}
+	return u.sparse[off]
+}
+
+// newOffsetRange returns the dynamic range of cr, with the addresses of reservedIPs that fall inside it marked used.
+func newOffsetRange(cr *cidrRange, reservedIPs map[string]bool) *offsetRange {
+	r := &offsetRange{cr: cr}
+
+	if cniip.Cmp(cr.start, cr.end) <= 0 {
+		r.size = maxRangeSize
+		if diff, ok := ipDiff(cr.end, cr.start); ok && diff < maxRangeSize {
+			r.size = diff + 1
+		}
+	}
+	r.used = newUsedSet(r.size)
+
+	// The store keeps addresses as strings; netip parses them without allocating
+	var start [16]byte
+	copy(start[:], cr.start.To16())
+	for addr := range reservedIPs {
+		prefix, err := netip.ParsePrefix(addr)
+		if err != nil {
+			continue
+		}
+		if off, ok := diff16(prefix.Addr().As16(), start); ok && off < r.size {
+			r.used.add(off)
+		}
+	}
+
+	return r
+}
+
+// offset returns the offset of ip, and whether ip is inside the range.
+func (r *offsetRange) offset(ip net.IP) (uint64, bool) {
+	if !r.cr.subnet.Contains(ip) {
+		return 0, false
+	}
+
+	off, ok := ipDiff(ip, r.cr.start)
+	return off, ok && off < r.size
+}
+
+// next returns the first free usable address after last, wrapping around at the end of the range, so that
+// released addresses are not handed out again right away. Without last (or outside of the range) it starts at rangeStart.
+func (r *offsetRange) next(last net.IP) (net.IP, bool) {
+	var from uint64
+	if off, ok := r.offset(last); ok {
+		from = off + 1
+	}
+
+	// Every offset is visited at most once; excluded blocks are skipped as a whole.
+	for visited := uint64(0); visited < r.size; {
+		off := (from + visited) % r.size
+		ip := addOffset(r.cr.start, off)
+
+		if skip := r.excludedUntil(ip, off); skip > 0 {
+			visited += skip
+			continue
+		}
+
+		if !r.used.has(off) && r.cr.usable(ip) {
+			return ip, true
+		}
+		visited++
+	}
+
+	return nil, false
+}
+
+// excludedUntil returns how many offsets, from off up to the end of the range, belong to the exclusion that
+// contains ip, or 0 if ip is not excluded.
+func (r *offsetRange) excludedUntil(ip net.IP, off uint64) uint64 {
+	for _, exclude := range r.cr.exclude {
+		if !exclude.Contains(ip) {
+			continue
+		}
+
+		n, ok := ipDiff(lastIP(exclude), ip)
+		if !ok || n >= r.size-off {
+			return r.size - off
+		}
+		return n + 1
+	}
+
+	return 0
+}
+
+// ipDiff returns a - b, and false if a is before b or the difference does not fit into 64 bits.
+func ipDiff(a, b net.IP) (uint64, bool) {
+	a, b = a.To16(), b.To16()
+	if a == nil || b == nil {
+		return 0, false
+	}
+
+	var a16, b16 [16]byte
+	copy(a16[:], a)
+	copy(b16[:], b)
+	return diff16(a16, b16)
+}
+
+// diff16 is ipDiff for 16 byte addresses.
+func diff16(a, b [16]byte) (uint64, bool) {
+	lo, borrow := bits.Sub64(binary.BigEndian.Uint64(a[8:]), binary.BigEndian.Uint64(b[8:]), 0)
+	hi, borrow := bits.Sub64(binary.BigEndian.Uint64(a[:8]), binary.BigEndian.Uint64(b[:8]), borrow)
+	if borrow != 0 || hi != 0 {
+		return 0, false
+	}
+
+	return lo, true
+}
+
+// addOffset returns ip + off.
+func addOffset(ip net.IP, off uint64) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	out := make(net.IP, len(ip))
+	copy(out, ip)
+	for i := len(out) - 1; i >= 0 && off > 0; i-- {
+		sum := uint64(out[i]) + off&0xff
+		out[i] = byte(sum)
+		off = off>>8 + sum>>8
+	}
+
+	return out
+}
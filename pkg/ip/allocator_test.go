@@ -0,0 +1,159 @@
+package ip
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	cniip "github.com/containernetworking/plugins/pkg/ip"
+)
+
+func TestOffsetRangeNext(t *testing.T) {
+	ranges := Ranges{RangeStart: "10.244.1.10", RangeEnd: "10.244.1.20", Exclude: []string{"10.244.1.12/30", "10.244.1.17"}}
+	cr, err := ranges.cidrRange("10.244.1.0/24")
+	if err != nil {
+		t.Fatalf("cidrRange: %v", err)
+	}
+
+	reserved := map[string]bool{"10.244.1.11/24": true, "10.244.1.19/24": true}
+	r := newOffsetRange(cr, reserved)
+	if r.size != 11 {
+		t.Fatalf("expected 11 addresses in .10-.20, got %d", r.size)
+	}
+
+	cases := []struct {
+		last string
+		want string
+	}{
+		{"", "10.244.1.10"},
+		{"10.244.1.10", "10.244.1.16"}, // .11 reserved, .12-.15 excluded
+		{"10.244.1.16", "10.244.1.18"}, // .17 excluded
+		{"10.244.1.18", "10.244.1.20"}, // .19 reserved
+		{"10.244.1.20", "10.244.1.10"}, // wraps around
+		{"10.244.1.99", "10.244.1.10"}, // outside of the range
+	}
+	for _, c := range cases {
+		ip, ok := r.next(net.ParseIP(c.last))
+		if !ok || ip.String() != c.want {
+			t.Errorf("after %q: expected %s, got %s (%v)", c.last, c.want, ip, ok)
+		}
+	}
+
+	for _, ip := range []string{"10.244.1.10", "10.244.1.16", "10.244.1.18", "10.244.1.20"} {
+		reserved[ip+"/24"] = true
+	}
+	if ip, ok := newOffsetRange(cr, reserved).next(nil); ok {
+		t.Fatalf("expected a full range, got %s", ip)
+	}
+}
+
+func TestOffsetRangeIPv6(t *testing.T) {
+	cr, err := Ranges{}.cidrRange("fd00:10:244:1::/64")
+	if err != nil {
+		t.Fatalf("cidrRange: %v", err)
+	}
+
+	r := newOffsetRange(cr, map[string]bool{"fd00:10:244:1::2/64": true})
+	if r.size != maxRangeSize {
+		t.Fatalf("expected a /64 to be capped at %d addresses, got %d", uint64(maxRangeSize), r.size)
+	}
+
+	ip, ok := r.next(net.ParseIP("fd00:10:244:1::ff"))
+	if !ok || ip.String() != "fd00:10:244:1::100" {
+		t.Fatalf("expected fd00:10:244:1::100, got %s", ip)
+	}
+}
+
+func TestIPOffsets(t *testing.T) {
+	cases := []struct {
+		ip  string
+		off uint64
+	}{
+		{"10.244.0.255", 255},
+		{"10.244.1.0", 256},
+		{"10.245.0.0", 1 << 16},
+		{"fd00::1:0", 1 << 16},
+	}
+	for _, c := range cases {
+		base := "10.244.0.0"
+		if net.ParseIP(c.ip).To4() == nil {
+			base = "fd00::"
+		}
+
+		if got := addOffset(net.ParseIP(base), c.off); !got.Equal(net.ParseIP(c.ip)) {
+			t.Errorf("%s + %d: expected %s, got %s", base, c.off, c.ip, got)
+		}
+		if got, ok := ipDiff(net.ParseIP(c.ip), net.ParseIP(base)); !ok || got != c.off {
+			t.Errorf("%s - %s: expected %d, got %d (%v)", c.ip, base, c.off, got, ok)
+		}
+	}
+
+	if _, ok := ipDiff(net.ParseIP("10.244.0.1"), net.ParseIP("10.244.0.2")); ok {
+		t.Errorf("expected a negative difference to fail")
+	}
+	if _, ok := ipDiff(net.ParseIP("fd01::"), net.ParseIP("fd00::")); ok {
+		t.Errorf("expected a difference beyond 64 bits to fail")
+	}
+}
+
+// linearFindAvailableIP is the allocator before offsetRange, kept for the benchmarks:
+// it walks the pod CIDR from rangeStart and formats every address to look it up.
+func linearFindAvailableIP(podCidr string, ranges Ranges, reservedIPs map[string]bool) (*net.IPNet, error) {
+	cr, err := ranges.cidrRange(podCidr)
+	if err != nil {
+		return nil, err
+	}
+
+	for ip := cr.start; cr.subnet.Contains(ip) && cniip.Cmp(ip, cr.end) <= 0; ip = cniip.NextIP(ip) {
+		podIP := &net.IPNet{IP: ip, Mask: cr.subnet.Mask}
+		if cr.usable(ip) && !reservedIPs[podIP.String()] {
+			return podIP, nil
+		}
+	}
+
+	return nil, ErrNoAvailableIP
+}
+
+// benchmarkPool returns a pod CIDR of the given prefix length with 90% of its addresses allocated from the start,
+// as on a busy node, and the last allocated address.
+func benchmarkPool(b *testing.B, ones int) (string, map[string]bool, net.IP) {
+	podCidr := fmt.Sprintf("10.244.0.0/%d", ones)
+	count, err := PodIPCount(podCidr)
+	if err != nil {
+		b.Fatalf("PodIPCount: %v", err)
+	}
+
+	_, subnet, _ := net.ParseCIDR(podCidr)
+	reserved := make(map[string]bool, count)
+	var last net.IP
+	for i := uint64(0); i < count*9/10; i++ {
+		last = addOffset(subnet.IP, i+2)
+		reserved[(&net.IPNet{IP: last, Mask: subnet.Mask}).String()] = true
+	}
+
+	return podCidr, reserved, last
+}
+
+func BenchmarkFindAvailableIP(b *testing.B) {
+	for _, ones := range []int{24, 20, 16} {
+		podCidr, reserved, last := benchmarkPool(b, ones)
+
+		b.Run(fmt.Sprintf("linear/%d", ones), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := linearFindAvailableIP(podCidr, Ranges{}, reserved); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("offset/%d", ones), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := findAvailableIP(podCidr, Ranges{}, reserved, last); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
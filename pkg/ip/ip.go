@@ -1,141 +1,313 @@
 package ip
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"net"
-	"os"
-	"strings"
-)
-
-const (
-	IPDirectory = "/tmp/reserved_ips"
+	"time"
 )
 
 type AllocatedIP struct {
-	Version string `json:"version"`
-	Address string `json:"address"`
-	Gateway string `json:"gateway"`
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifName"`
+	Version     string `json:"version"`
+	Address     string `json:"address"`
+	Gateway     string `json:"gateway"`
+	Owner       string `json:"owner,omitempty"` // namespace/name of a pod with sticky IPs
+	Pod         string `json:"pod,omitempty"`   // namespace/name of the pod, for garbage collection
+	Netns       string `json:"netns,omitempty"` // network namespace path of the container
+}
+
+// Request describes the addresses a container interface asks for.
+type Request struct {
+	ContainerID string
+	IfName      string
+	// Owner is the namespace/name identity of a pod that gets its addresses back when it is recreated
+	// within the grace period of a DEL (sticky IPs, see ReturnIPWithGracePeriod). Empty means no sticky IPs.
+	Owner string
+	// Pod (namespace/name) and Netns are recorded with the allocation, so that bvcnid can tell when it was leaked.
+	Pod   string
+	Netns string
+	// IPs are fixed addresses, at most one per IP family. The other families get the next available address.
+	IPs []net.IP
 }
 
 // Refer : https://github.com/morvencao/minicni
 
-// AllocateIPs selects an available IP and a gateway IP from a CIDR.
-func AllocateIPs(podCidr string) (string, string, error) {
-	allIpAddr, err := GetAllIPs(podCidr)
+// ErrNoAvailableIP is returned when every pod CIDR of an IP family is exhausted.
+var ErrNoAvailableIP = errors.New("no available IPs")
+
+var (
+	// ErrIPOutOfRange is returned when a requested IP is not a pod IP of the node's pod CIDRs.
+	ErrIPOutOfRange = errors.New("IP is not inside the pod CIDRs")
+	// ErrIPInUse is returned when a requested IP is allocated to another container.
+	ErrIPInUse = errors.New("IP is already allocated")
+)
+
+// AllocateIPs selects an available IP and a gateway IP for each IP family of the pod CIDRs (IPv4 and IPv6
+// on dual-stack nodes) and records them for containerID/ifName. Either every family gets an address or none does.
+// A node may own several CIDRs of one family (ex. IPPool blocks); they are used in order, the next one once a CIDR is full.
+// If the container interface already owns addresses, those addresses are returned again.
+func (s *Store) AllocateIPs(podCidrs []string, containerID, ifName string) ([]AllocatedIP, error) {
+	return s.Allocate(podCidrs, Ranges{}, Request{ContainerID: containerID, IfName: ifName})
+}
+
+// Allocate is AllocateIPs for a Request, within ranges. Per IP family, the address is the requested IP, else the address
+// reserved for the owner, else the next available one of the dynamic range: addresses are handed out round-robin,
+// so a released address is only reused once the rest of the range has been used. A requested IP must be a pod IP of one of
+// the pod CIDRs that is not excluded, and must not be allocated to (or reserved for) another container.
+func (s *Store) Allocate(podCidrs []string, ranges Ranges, req Request) ([]AllocatedIP, error) {
+	families, err := splitFamilies(podCidrs)
 	if err != nil {
-		return "", "", fmt.Errorf("error getting all IPs: %w", err)
+		return nil, err
 	}
 
-	gwIpAddr := allIpAddr[0]
+	var allocs []AllocatedIP
+	err = s.update(func(state *storeState) (bool, error) {
+		if allocs = state.findAll(req.ContainerID, req.IfName); len(allocs) > 0 {
+			return false, nil
+		}
+
+		reservedIPs := state.reservedIPs()
+		if state.LastIPs == nil {
+			state.LastIPs = map[string]string{}
+		}
+		held := state.takeReservations(req.Owner, req.IfName)
+		for _, r := range held {
+			delete(reservedIPs, r.Address)
+		}
+
+		// Quarantined addresses are only handed out dynamically once nothing else is left
+		dynamicIP := func(familyCidrs []string) (*net.IPNet, *net.IPNet, error) {
+			podIP, gwIP, err := findAvailableIPIn(familyCidrs, ranges, state.withQuarantine(reservedIPs), state.LastIPs)
+			if errors.Is(err, ErrNoAvailableIP) {
+				if podIP, gwIP, ok := state.fromQuarantine(familyCidrs, ranges, reservedIPs); ok {
+					return podIP, gwIP, nil
+				}
+			}
+			return podIP, gwIP, err
+		}
+
+		for _, familyCidrs := range families {
+			var podIP, gwIP *net.IPNet
+			var err error
+			if ip := familyIP(req.IPs, familyCidrs[0]); ip != nil {
+				podIP, gwIP, err = requestedIP(familyCidrs, ranges, ip, reservedIPs)
+			} else if ip = familyIP(reservationIPs(held), familyCidrs[0]); ip != nil {
+				// The reserved address may no longer be usable (ex. the node's pod CIDRs changed)
+				if podIP, gwIP, err = requestedIP(familyCidrs, ranges, ip, reservedIPs); err != nil {
+					podIP, gwIP, err = dynamicIP(familyCidrs)
+				}
+			} else {
+				podIP, gwIP, err = dynamicIP(familyCidrs)
+			}
+			if err != nil {
+				return false, err
+			}
+			reservedIPs[podIP.String()] = true
+			state.unquarantine(podIP.String())
+
+			allocs = append(allocs, AllocatedIP{
+				ContainerID: req.ContainerID,
+				IfName:      req.IfName,
+				Version:     ipVersion(podIP.IP),
+				Address:     podIP.String(),
+				Gateway:     gwIP.String(),
+				Owner:       req.Owner,
+				Pod:         req.Pod,
+				Netns:       req.Netns,
+			})
+		}
 
-	reservedIPs, err := readIPsFromFile()
+		state.Allocations = append(state.Allocations, allocs...)
+		return true, nil
+	})
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 
-	podIP, err := findAvailableIP(allIpAddr[1:], reservedIPs)
+	return allocs, nil
+}
+
+// familyIP returns the IP of ips that has the IP family of podCidr, or nil.
+func familyIP(ips []net.IP, podCidr string) net.IP {
+	_, ipnet, err := net.ParseCIDR(podCidr)
 	if err != nil {
-		return "", "", err
+		return nil
 	}
 
-	if err = writeIPsToFile(append(reservedIPs, podIP)); err != nil {
-		return "", "", err
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (ipnet.IP.To4() != nil) {
+			return ip
+		}
 	}
 
-	return podIP, gwIpAddr, nil
+	return nil
 }
 
-// readIPsFromFile reads the reserved IPs from file.
-func readIPsFromFile() ([]string, error) {
-	content, err := os.ReadFile(IPDirectory)
-	if err != nil {
-		return nil, fmt.Errorf("error reading reserved IPs file: %w", err)
+// requestedIP checks that ip is a usable pod IP of one of the pod CIDRs and is not reserved, and returns it with its gateway.
+func requestedIP(podCidrs []string, ranges Ranges, ip net.IP, reservedIPs map[string]bool) (*net.IPNet, *net.IPNet, error) {
+	for _, podCidr := range podCidrs {
+		cr, err := ranges.cidrRange(podCidr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error getting gateway IP: %w", err)
+		}
+
+		if !cr.subnet.Contains(ip) {
+			continue
+		}
+
+		if !cr.usable(ip) {
+			return nil, nil, fmt.Errorf("%s: %w, it is the network, gateway, broadcast or an excluded address of %s", ip, ErrIPOutOfRange, podCidr)
+		}
+
+		podIP := &net.IPNet{IP: ip, Mask: cr.subnet.Mask}
+		if reservedIPs[podIP.String()] {
+			return nil, nil, fmt.Errorf("%s: %w", ip, ErrIPInUse)
+		}
+
+		return podIP, &net.IPNet{IP: cr.gateway, Mask: cr.subnet.Mask}, nil
 	}
 
-	return strings.Split(strings.TrimSpace(string(content)), "\n"), nil
+	return nil, nil, fmt.Errorf("%s: %w %v", ip, ErrIPOutOfRange, podCidrs)
 }
 
-// findAvailableIP finds an available IP from the given IPs that is not in the reserved IPs.
-func findAvailableIP(ips, reservedIPs []string) (string, error) {
-	for _, ip := range ips {
-		if !isReserved(ip, reservedIPs) {
-			return ip, nil
+// splitFamilies groups the pod CIDRs by IP family, keeping their order. ex) [[10.244.1.0/24 10.244.7.0/24] [fd00:10:244:1::/64]]
+func splitFamilies(podCidrs []string) ([][]string, error) {
+	var v4, v6 []string
+	for _, podCidr := range podCidrs {
+		_, ipnet, err := net.ParseCIDR(podCidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pod CIDR %q: %w", podCidr, err)
+		}
+
+		if ipnet.IP.To4() != nil {
+			v4 = append(v4, podCidr)
+		} else {
+			v6 = append(v6, podCidr)
 		}
 	}
 
-	return "", fmt.Errorf("no available IPs")
+	var families [][]string
+	for _, cidrs := range [][]string{v4, v6} {
+		if len(cidrs) > 0 {
+			families = append(families, cidrs)
+		}
+	}
+
+	return families, nil
 }
 
-// isReserved checks if the given IP is in the reserved IPs.
-func isReserved(ip string, reservedIPs []string) bool {
-	for _, rip := range reservedIPs {
-		if ip == rip {
-			return true
+// findAvailableIPIn returns the next available IP of the first pod CIDR that is not full, and moves that
+// pod CIDR's round-robin pointer (lastIPs) to it.
+func findAvailableIPIn(podCidrs []string, ranges Ranges, reservedIPs map[string]bool, lastIPs map[string]string) (*net.IPNet, *net.IPNet, error) {
+	for _, podCidr := range podCidrs {
+		podIP, gwIP, err := findAvailableIP(podCidr, ranges, reservedIPs, net.ParseIP(lastIPs[podCidr]))
+		if err == nil {
+			lastIPs[podCidr] = podIP.IP.String()
+			return podIP, gwIP, nil
+		}
+		if !errors.Is(err, ErrNoAvailableIP) {
+			return nil, nil, err
 		}
 	}
 
-	return false
+	return nil, nil, fmt.Errorf("%w in %v", ErrNoAvailableIP, podCidrs)
 }
 
-// writeIPsToFile writes the given IPs to file.
-func writeIPsToFile(ips []string) error {
-	if err := os.WriteFile(IPDirectory, []byte(strings.Join(ips, "\n")), 0600); err != nil {
-		return fmt.Errorf("error writing to reserved IPs file: %w", err)
+// PodIPCount returns how many pod IPs podCidr holds, without the network, gateway and IPv4 broadcast
+// addresses. Large IPv6 CIDRs are capped at math.MaxUint32.
+func PodIPCount(podCidr string) (uint64, error) {
+	_, ipnet, err := net.ParseCIDR(podCidr)
+	if err != nil {
+		return 0, err
 	}
 
-	return nil
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones < 2 {
+		return 0, nil
+	}
+	if bits-ones >= 32 {
+		return math.MaxUint32, nil
+	}
+
+	count := uint64(1)<<(bits-ones) - 2
+	if bits == 32 {
+		// broadcast address
+		count--
+	}
+
+	return count, nil
 }
 
-// ReturnIP removes a reserved IP from the reserved IPs file.
-func ReturnIP(ip string) error {
-	reservedIPs, err := readIPsFromFile()
+// findAvailableIP returns the first usable address of the dynamic range after last that is not reserved, wrapping
+// around at the end of the range. The network, gateway, IPv4 broadcast and excluded addresses are never handed out.
+func findAvailableIP(podCidr string, ranges Ranges, reservedIPs map[string]bool, last net.IP) (*net.IPNet, *net.IPNet, error) {
+	cr, err := ranges.cidrRange(podCidr)
 	if err != nil {
-		return err
+		return nil, nil, fmt.Errorf("error getting gateway IP: %w", err)
 	}
 
-	if !removeIP(ip, reservedIPs) {
-		return fmt.Errorf("IP %s is not reserved", ip)
+	ip, ok := newOffsetRange(cr, reservedIPs).next(last)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w in %s", ErrNoAvailableIP, podCidr)
 	}
 
-	if err = writeIPsToFile(reservedIPs); err != nil {
-		return err
-	}
+	return &net.IPNet{IP: ip, Mask: cr.subnet.Mask}, &net.IPNet{IP: cr.gateway, Mask: cr.subnet.Mask}, nil
+}
 
-	return nil
+// ReturnIP releases the addresses owned by containerID/ifName. Releasing an interface without
+// an allocation is not an error, so that repeated DELs succeed.
+func (s *Store) ReturnIP(containerID, ifName string) error {
+	return s.ReturnIPWithGracePeriod(containerID, ifName, 0)
 }
 
-// removeIP removes the given IP from the reserved IPs slice.
-func removeIP(ip string, reservedIPs []string) bool {
-	for i, rip := range reservedIPs {
-		if rip == ip {
-			reservedIPs = append(reservedIPs[:i], reservedIPs[i+1:]...)
-			return true
+// ReturnIPWithGracePeriod is ReturnIP, except that the addresses of an allocation with an owner stay reserved
+// for that owner until the grace period is over, so that a recreated pod gets them back. The other addresses
+// go into quarantine, if the store has one (see SetQuarantine).
+func (s *Store) ReturnIPWithGracePeriod(containerID, ifName string, gracePeriod time.Duration) error {
+	return s.update(func(state *storeState) (bool, error) {
+		kept := state.Allocations[:0]
+		var released []AllocatedIP
+		for _, alloc := range state.Allocations {
+			if alloc.ContainerID != containerID || alloc.IfName != ifName {
+				kept = append(kept, alloc)
+				continue
+			}
+			released = append(released, alloc)
 		}
-	}
+		state.Allocations = kept
 
-	return false
+		var freed []AllocatedIP
+		for _, alloc := range released {
+			if alloc.Owner != "" && gracePeriod > 0 {
+				state.Reservations = append(state.Reservations, Reservation{AllocatedIP: alloc, Expires: now().Add(gracePeriod)})
+				continue
+			}
+			freed = append(freed, alloc)
+		}
+		state.quarantineIPs(freed, s.quarantine)
+
+		return len(released) > 0, nil
+	})
 }
 
-func GetAllIPs(cidr string) ([]string, error) {
-	ip, ipnet, err := net.ParseCIDR(cidr)
-	if err != nil {
-		return nil, err
-	}
-	var ips []string
-	for ip = ip.Mask(ipnet.Mask); ipnet.Contains(ip); inc(ip) {
-		tempIPNet := &net.IPNet{IP: ip, Mask: ipnet.Mask}
-		ips = append(ips, tempIPNet.String())
+// lastIP returns the last address of ipnet.
+func lastIP(ipnet *net.IPNet) net.IP {
+	ip := make(net.IP, len(ipnet.IP))
+	for i := range ipnet.IP {
+		ip[i] = ipnet.IP[i] | ^ipnet.Mask[i]
 	}
-	// remove network address and broadcast address
-	return ips[1 : len(ips)-1], nil
+
+	return ip
 }
 
-func inc(ip net.IP) {
-	ip = ip.To4()
-	for i := len(ip) - 1; i >= 0; i-- {
-		ip[i]++
-		if ip[i] > 0 {
-			break
-		}
+// ipVersion returns "4" or "6", the version used in CNI results.
+func ipVersion(ip net.IP) string {
+	if ip.To4() != nil {
+		return "4"
 	}
+
+	return "6"
 }
@@ -0,0 +1,78 @@
+package ip
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestPodIPCount(t *testing.T) {
+	cases := []struct {
+		podCidr string
+		want    uint64
+	}{
+		{"10.244.1.0/24", 253},
+		{"10.244.1.64/26", 61},
+		{"10.244.2.0/23", 509},
+		{"10.244.1.0/30", 1},
+		{"10.244.1.0/31", 0},
+		{"fd00:10:244:1::/120", 254},
+		{"fd00:10:244:1::/64", math.MaxUint32},
+	}
+
+	for _, c := range cases {
+		count, err := PodIPCount(c.podCidr)
+		if err != nil {
+			t.Fatalf("PodIPCount(%s): %v", c.podCidr, err)
+		}
+		if count != c.want {
+			t.Errorf("PodIPCount(%s): expected %d, got %d", c.podCidr, c.want, count)
+		}
+	}
+}
+
+func TestAllocatePrefixLength(t *testing.T) {
+	cases := []struct {
+		podCidr string
+		// first pod IP and gateway, with the prefix length of the pod CIDR
+		address, gateway string
+	}{
+		{"10.244.1.64/26", "10.244.1.66/26", "10.244.1.65/26"},
+		{"10.244.2.0/23", "10.244.2.2/23", "10.244.2.1/23"},
+		{"fd00:10:244:1::/64", "fd00:10:244:1::2/64", "fd00:10:244:1::1/64"},
+	}
+
+	for _, c := range cases {
+		store, err := NewStore(t.TempDir())
+		if err != nil {
+			t.Fatalf("NewStore: %v", err)
+		}
+
+		allocs, err := store.AllocateIPs([]string{c.podCidr}, "container-0", "eth0")
+		if err != nil {
+			t.Fatalf("AllocateIPs(%s): %v", c.podCidr, err)
+		}
+		if allocs[0].Address != c.address || allocs[0].Gateway != c.gateway {
+			t.Errorf("%s: expected %s via %s, got %s via %s", c.podCidr, c.address, c.gateway, allocs[0].Address, allocs[0].Gateway)
+		}
+	}
+
+	// A /26 holds 61 pod IPs; the allocator stops at its broadcast address instead of walking on to the next /24 boundary.
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	for i := 0; i < 61; i++ {
+		allocs, err := store.AllocateIPs([]string{"10.244.1.64/26"}, fmt.Sprintf("container-%d", i), "eth0")
+		if err != nil {
+			t.Fatalf("AllocateIPs: %v", err)
+		}
+		if allocs[0].Address == "10.244.1.127/26" {
+			t.Fatalf("the broadcast address of 10.244.1.64/26 was handed out")
+		}
+	}
+	if _, err = store.AllocateIPs([]string{"10.244.1.64/26"}, "container-61", "eth0"); !errors.Is(err, ErrNoAvailableIP) {
+		t.Fatalf("expected ErrNoAvailableIP once the /26 is exhausted, got %v", err)
+	}
+}
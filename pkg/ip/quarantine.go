@@ -0,0 +1,89 @@
+package ip
+
+import (
+	"net"
+	"sort"
+	"time"
+)
+
+// QuarantinedIP is a released address that is not handed out dynamically until Until, so that stale conntrack
+// entries and cached client connections of the old pod do not reach the next one. When a pod CIDR is otherwise
+// exhausted, the addresses that leave quarantine first are handed out anyway.
+type QuarantinedIP struct {
+	Address string    `json:"address"`
+	Until   time.Time `json:"until"`
+}
+
+// SetQuarantine keeps the addresses released from now on in quarantine for period. 0 disables the quarantine.
+func (s *Store) SetQuarantine(period time.Duration) {
+	s.quarantine = period
+}
+
+// quarantineIPs puts the addresses of allocs in quarantine for period.
+func (state *storeState) quarantineIPs(allocs []AllocatedIP, period time.Duration) {
+	if period <= 0 {
+		return
+	}
+
+	for _, alloc := range allocs {
+		state.unquarantine(alloc.Address)
+		state.Quarantine = append(state.Quarantine, QuarantinedIP{Address: alloc.Address, Until: now().Add(period)})
+	}
+}
+
+// unquarantine takes address out of quarantine, ex) once it is allocated again.
+func (state *storeState) unquarantine(address string) {
+	kept := state.Quarantine[:0]
+	for _, q := range state.Quarantine {
+		if q.Address != address {
+			kept = append(kept, q)
+		}
+	}
+	state.Quarantine = kept
+}
+
+// dropExpiredQuarantine releases the addresses whose cooldown is over, and reports whether there were any.
+func (state *storeState) dropExpiredQuarantine() bool {
+	kept := state.Quarantine[:0]
+	for _, q := range state.Quarantine {
+		if now().Before(q.Until) {
+			kept = append(kept, q)
+		}
+	}
+
+	dropped := len(kept) != len(state.Quarantine)
+	state.Quarantine = kept
+	return dropped
+}
+
+// withQuarantine returns reservedIPs plus the quarantined addresses, the addresses dynamic allocation skips.
+func (state *storeState) withQuarantine(reservedIPs map[string]bool) map[string]bool {
+	ips := make(map[string]bool, len(reservedIPs)+len(state.Quarantine))
+	for ip := range reservedIPs {
+		ips[ip] = true
+	}
+	for _, q := range state.Quarantine {
+		ips[q.Address] = true
+	}
+
+	return ips
+}
+
+// fromQuarantine returns the quarantined address of the pod CIDRs that leaves quarantine first and is still usable.
+func (state *storeState) fromQuarantine(podCidrs []string, ranges Ranges, reservedIPs map[string]bool) (*net.IPNet, *net.IPNet, bool) {
+	quarantine := append([]QuarantinedIP(nil), state.Quarantine...)
+	sort.Slice(quarantine, func(i, j int) bool { return quarantine[i].Until.Before(quarantine[j].Until) })
+
+	for _, q := range quarantine {
+		ip, _, err := net.ParseCIDR(q.Address)
+		if err != nil || familyIP([]net.IP{ip}, podCidrs[0]) == nil {
+			continue
+		}
+
+		if podIP, gwIP, err := requestedIP(podCidrs, ranges, ip, reservedIPs); err == nil {
+			return podIP, gwIP, true
+		}
+	}
+
+	return nil, nil, false
+}
@@ -0,0 +1,226 @@
+package ip
+
+import (
+	"fmt"
+	cniip "github.com/containernetworking/plugins/pkg/ip"
+	"net"
+	"strings"
+)
+
+// Ranges carve the pod CIDRs, ex) to keep addresses for infrastructure. Each setting applies to the pod CIDR
+// that contains it; pod CIDRs without settings hand out every address after the gateway (the first usable address).
+type Ranges struct {
+	RangeStart string   `json:"rangeStart,omitempty"` // first address handed out dynamically
+	RangeEnd   string   `json:"rangeEnd,omitempty"`   // last address handed out dynamically
+	Exclude    []string `json:"exclude,omitempty"`    // addresses or sub-CIDRs never handed out, ex) ["10.244.1.10", "10.244.1.64/28"]
+	Gateway    string   `json:"gateway,omitempty"`    // cni0 address, instead of the first usable address
+}
+
+// cidrRange is a pod CIDR with the Ranges settings that fall inside it.
+type cidrRange struct {
+	subnet  *net.IPNet
+	gateway net.IP
+	first   net.IP // first and last address that are not the network or IPv4 broadcast address
+	last    net.IP
+	start   net.IP // dynamic allocation range
+	end     net.IP
+	exclude []*net.IPNet
+}
+
+// Validate checks the settings against the pod CIDRs: every address must be inside a pod CIDR, rangeStart
+// must not be after rangeEnd, and the exclusions must neither overlap each other nor contain the gateway.
+func (r Ranges) Validate(podCidrs []string) error {
+	var subnets []*net.IPNet
+	for _, podCidr := range podCidrs {
+		_, subnet, err := net.ParseCIDR(podCidr)
+		if err != nil {
+			return fmt.Errorf("invalid pod CIDR %q: %w", podCidr, err)
+		}
+		subnets = append(subnets, subnet)
+	}
+
+	containing := func(name, value string) (net.IP, *net.IPNet, error) {
+		if value == "" {
+			return nil, nil, nil
+		}
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, nil, fmt.Errorf("invalid %s %q", name, value)
+		}
+		for _, subnet := range subnets {
+			if subnet.Contains(ip) {
+				return ip, subnet, nil
+			}
+		}
+		return nil, nil, fmt.Errorf("%s %s is outside the pod CIDRs %v", name, value, podCidrs)
+	}
+
+	start, startNet, err := containing("rangeStart", r.RangeStart)
+	if err != nil {
+		return err
+	}
+	end, endNet, err := containing("rangeEnd", r.RangeEnd)
+	if err != nil {
+		return err
+	}
+	gateway, gatewayNet, err := containing("gateway", r.Gateway)
+	if err != nil {
+		return err
+	}
+
+	if start != nil && end != nil && (start.To4() != nil) == (end.To4() != nil) {
+		if startNet.String() != endNet.String() {
+			return fmt.Errorf("rangeStart %s and rangeEnd %s are in different pod CIDRs", start, end)
+		}
+		if cniip.Cmp(start, end) > 0 {
+			return fmt.Errorf("rangeStart %s is after rangeEnd %s", start, end)
+		}
+	}
+
+	if gateway != nil {
+		first, last := usableBounds(gatewayNet)
+		if cniip.Cmp(gateway, first) < 0 || cniip.Cmp(gateway, last) > 0 {
+			return fmt.Errorf("gateway %s is the network or broadcast address of %s", gateway, gatewayNet)
+		}
+	}
+
+	excludes, err := parseExcludes(r.Exclude)
+	if err != nil {
+		return err
+	}
+
+	for i, exclude := range excludes {
+		inside := false
+		for _, subnet := range subnets {
+			inside = inside || containsNet(subnet, exclude)
+		}
+		if !inside {
+			return fmt.Errorf("exclude %s is outside the pod CIDRs %v", exclude, podCidrs)
+		}
+
+		if gateway != nil && exclude.Contains(gateway) {
+			return fmt.Errorf("exclude %s contains the gateway %s", exclude, gateway)
+		}
+
+		for _, other := range excludes[:i] {
+			if exclude.Contains(other.IP) || other.Contains(exclude.IP) {
+				return fmt.Errorf("exclude %s overlaps %s", exclude, other)
+			}
+		}
+	}
+
+	return nil
+}
+
+// GatewayIP returns the gateway (the cni0 address) of a pod CIDR, with the CIDR's prefix length: the configured gateway
+// if it is inside the pod CIDR, the first usable address otherwise.
+// ex) 10.244.1.0/24 -> 10.244.1.1/24, fd00:10:244:1::/64 -> fd00:10:244:1::1/64
+func (r Ranges) GatewayIP(podCidr string) (*net.IPNet, error) {
+	cr, err := r.cidrRange(podCidr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &net.IPNet{IP: cr.gateway, Mask: cr.subnet.Mask}, nil
+}
+
+// cidrRange applies the settings that fall inside podCidr.
+func (r Ranges) cidrRange(podCidr string) (*cidrRange, error) {
+	_, subnet, err := net.ParseCIDR(podCidr)
+	if err != nil {
+		return nil, err
+	}
+
+	if ones, bits := subnet.Mask.Size(); bits-ones < 2 {
+		return nil, fmt.Errorf("CIDR %s has no room for a gateway and pod IPs", podCidr)
+	}
+
+	cr := &cidrRange{subnet: subnet}
+	cr.first, cr.last = usableBounds(subnet)
+	cr.gateway = cr.first
+	cr.start, cr.end = cr.first, cr.last
+
+	if ip := net.ParseIP(r.Gateway); ip != nil && subnet.Contains(ip) {
+		cr.gateway = ip
+	}
+	if ip := net.ParseIP(r.RangeStart); ip != nil && subnet.Contains(ip) {
+		cr.start = ip
+	}
+	if ip := net.ParseIP(r.RangeEnd); ip != nil && subnet.Contains(ip) {
+		cr.end = ip
+	}
+
+	excludes, err := parseExcludes(r.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	for _, exclude := range excludes {
+		if subnet.Contains(exclude.IP) || exclude.Contains(subnet.IP) {
+			cr.exclude = append(cr.exclude, exclude)
+		}
+	}
+
+	return cr, nil
+}
+
+// usable reports whether ip may be given to a pod: inside the pod CIDR, neither the network, broadcast
+// nor gateway address, and not excluded. The dynamic range is not checked, static IPs may be outside of it.
+func (cr *cidrRange) usable(ip net.IP) bool {
+	if !cr.subnet.Contains(ip) || cniip.Cmp(ip, cr.first) < 0 || cniip.Cmp(ip, cr.last) > 0 || ip.Equal(cr.gateway) {
+		return false
+	}
+
+	for _, exclude := range cr.exclude {
+		if exclude.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// usableBounds returns the first and last address of subnet without the network and IPv4 broadcast addresses.
+func usableBounds(subnet *net.IPNet) (net.IP, net.IP) {
+	last := lastIP(subnet)
+	if subnet.IP.To4() != nil {
+		// broadcast address
+		last = cniip.PrevIP(last)
+	}
+
+	return cniip.NextIP(subnet.IP), last
+}
+
+// parseExcludes parses addresses (as /32 or /128) and CIDRs.
+func parseExcludes(excludes []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, exclude := range excludes {
+		if !strings.Contains(exclude, "/") {
+			ip := net.ParseIP(exclude)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid exclude %q", exclude)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(exclude)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude %q: %w", exclude, err)
+		}
+		nets = append(nets, ipnet)
+	}
+
+	return nets, nil
+}
+
+// containsNet reports whether inner is a subnet of outer.
+func containsNet(outer, inner *net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+
+	return outerBits == innerBits && outerOnes <= innerOnes && outer.Contains(inner.IP)
+}
@@ -0,0 +1,63 @@
+package ip
+
+import (
+	"testing"
+)
+
+func TestRangesValidate(t *testing.T) {
+	podCidrs := []string{"10.244.1.0/24", "fd00:10:244:1::/64"}
+
+	valid := []Ranges{
+		{},
+		{RangeStart: "10.244.1.10", RangeEnd: "10.244.1.200", Gateway: "10.244.1.254"},
+		{RangeStart: "fd00:10:244:1::100", Exclude: []string{"10.244.1.0/28", "10.244.1.100"}},
+	}
+	for _, r := range valid {
+		if err := r.Validate(podCidrs); err != nil {
+			t.Errorf("%+v: unexpected error %v", r, err)
+		}
+	}
+
+	invalid := []Ranges{
+		{RangeStart: "10.244.2.10"},                                          // outside the pod CIDRs
+		{RangeStart: "10.244.1.200", RangeEnd: "10.244.1.10"},                // start after end
+		{Gateway: "10.244.2.1"},                                              // gateway outside the pod CIDRs
+		{Gateway: "10.244.1.255"},                                            // broadcast
+		{Gateway: "10.244.1.1", Exclude: []string{"10.244.1.0/30"}},          // gateway excluded
+		{Exclude: []string{"10.244.1.0/28", "10.244.1.8/29"}},                // overlapping exclusions
+		{Exclude: []string{"10.244.0.0/16"}},                                 // larger than the pod CIDR
+		{Exclude: []string{"10.244.1.x"}},                                    // not an address
+		{RangeStart: "10.244.1.10", RangeEnd: "10.244.1.20", Gateway: "bad"}, // not an address
+	}
+	for _, r := range invalid {
+		if err := r.Validate(podCidrs); err == nil {
+			t.Errorf("%+v: expected an error", r)
+		}
+	}
+}
+
+func TestGatewayIP(t *testing.T) {
+	cases := []struct {
+		ranges  Ranges
+		podCidr string
+		want    string
+	}{
+		{Ranges{}, "10.244.1.0/24", "10.244.1.1/24"},
+		{Ranges{}, "fd00:10:244:1::/64", "fd00:10:244:1::1/64"},
+		{Ranges{}, "10.244.1.64/26", "10.244.1.65/26"},
+		{Ranges{}, "10.244.2.0/23", "10.244.2.1/23"},
+		{Ranges{Gateway: "10.244.1.254"}, "10.244.1.0/24", "10.244.1.254/24"},
+		// The gateway of another pod CIDR does not apply
+		{Ranges{Gateway: "10.244.1.254"}, "10.244.7.0/24", "10.244.7.1/24"},
+	}
+
+	for _, c := range cases {
+		gw, err := c.ranges.GatewayIP(c.podCidr)
+		if err != nil {
+			t.Fatalf("GatewayIP(%s): %v", c.podCidr, err)
+		}
+		if gw.String() != c.want {
+			t.Errorf("GatewayIP(%s) with %+v: expected %s, got %s", c.podCidr, c.ranges, c.want, gw)
+		}
+	}
+}
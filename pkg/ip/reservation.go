@@ -0,0 +1,62 @@
+package ip
+
+import (
+	"net"
+	"time"
+)
+
+// Reservation keeps the address of a deleted pod with sticky IPs for its owner until Expires.
+// Nobody else gets the address in the meantime.
+type Reservation struct {
+	AllocatedIP
+	Expires time.Time `json:"expires"`
+}
+
+// now is a variable so that tests can move the clock.
+var now = time.Now
+
+// takeReservations removes and returns the reservations of owner/ifName.
+func (state *storeState) takeReservations(owner, ifName string) []Reservation {
+	if owner == "" {
+		return nil
+	}
+
+	var taken []Reservation
+	kept := state.Reservations[:0]
+	for _, r := range state.Reservations {
+		if r.Owner == owner && r.IfName == ifName {
+			taken = append(taken, r)
+			continue
+		}
+		kept = append(kept, r)
+	}
+	state.Reservations = kept
+
+	return taken
+}
+
+// dropExpiredReservations garbage-collects the reservations whose grace period is over, and reports whether there were any.
+func (state *storeState) dropExpiredReservations() bool {
+	kept := state.Reservations[:0]
+	for _, r := range state.Reservations {
+		if now().Before(r.Expires) {
+			kept = append(kept, r)
+		}
+	}
+
+	dropped := len(kept) != len(state.Reservations)
+	state.Reservations = kept
+	return dropped
+}
+
+// reservationIPs returns the addresses of the reservations.
+func reservationIPs(reservations []Reservation) []net.IP {
+	var ips []net.IP
+	for _, r := range reservations {
+		if ip, _, err := net.ParseCIDR(r.Address); err == nil {
+			ips = append(ips, ip)
+		}
+	}
+
+	return ips
+}
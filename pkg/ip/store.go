@@ -0,0 +1,177 @@
+package ip
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultDataDir keeps the allocation state across reboots of the CNI plugin process.
+	DefaultDataDir = "/var/lib/cni/bvcni"
+
+	storeFile = "allocations.json"
+	lockFile  = "allocations.lock"
+)
+
+// Store is a file based IPAM store shared by every bvcni plugin process on the node.
+// All reads and writes are serialized with flock(2) and every write replaces the
+// state file atomically (temp file + rename), so a crash never leaves a half-written file.
+type Store struct {
+	dir        string
+	quarantine time.Duration // see SetQuarantine
+}
+
+// storeState is the on-disk layout of the allocations file.
+type storeState struct {
+	Allocations  []AllocatedIP     `json:"allocations"`
+	Reservations []Reservation     `json:"reservations,omitempty"` // sticky IPs of deleted pods
+	LastIPs      map[string]string `json:"lastIPs,omitempty"`      // last address handed out dynamically, per pod CIDR
+	Quarantine   []QuarantinedIP   `json:"quarantine,omitempty"`   // released addresses in their cooldown
+}
+
+// NewStore creates the data directory if needed and returns a Store rooted at it.
+func NewStore(dir string) (*Store, error) {
+	if dir == "" {
+		dir = DefaultDataDir
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating IPAM data directory %s: %w", dir, err)
+	}
+
+	return &Store{dir: dir}, nil
+}
+
+// Get returns the allocations (one per IP family) owned by containerID/ifName.
+func (s *Store) Get(containerID, ifName string) ([]AllocatedIP, error) {
+	var found []AllocatedIP
+	err := s.update(func(state *storeState) (bool, error) {
+		found = state.findAll(containerID, ifName)
+		return false, nil
+	})
+
+	return found, err
+}
+
+// List returns every allocation in the store.
+func (s *Store) List() ([]AllocatedIP, error) {
+	var allocs []AllocatedIP
+	err := s.update(func(state *storeState) (bool, error) {
+		allocs = append(allocs, state.Allocations...)
+		return false, nil
+	})
+
+	return allocs, err
+}
+
+// update runs fn with the store locked. The state is written back only if fn reports a change.
+func (s *Store) update(fn func(state *storeState) (bool, error)) error {
+	lock, err := os.OpenFile(filepath.Join(s.dir, lockFile), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening IPAM lock file: %w", err)
+	}
+	defer lock.Close()
+
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("error locking IPAM store: %w", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	state, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	// Expired sticky IP reservations and quarantined addresses are collected on every update
+	expired := state.dropExpiredReservations()
+	expired = state.dropExpiredQuarantine() || expired
+
+	changed, err := fn(state)
+	if err != nil || !(changed || expired) {
+		return err
+	}
+
+	return s.write(state)
+}
+
+// read loads the state file. A missing file is an empty store.
+func (s *Store) read() (*storeState, error) {
+	state := &storeState{}
+
+	content, err := os.ReadFile(filepath.Join(s.dir, storeFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, fmt.Errorf("error reading IPAM store: %w", err)
+	}
+
+	if err = json.Unmarshal(content, state); err != nil {
+		return nil, fmt.Errorf("error decoding IPAM store: %w", err)
+	}
+
+	return state, nil
+}
+
+// write replaces the state file with a temp file + rename so readers never see a partial write.
+func (s *Store) write(state *storeState) error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding IPAM store: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(s.dir, storeFile+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating IPAM temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing IPAM temp file: %w", err)
+	}
+
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error syncing IPAM temp file: %w", err)
+	}
+
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("error closing IPAM temp file: %w", err)
+	}
+
+	if err = os.Rename(tmp.Name(), filepath.Join(s.dir, storeFile)); err != nil {
+		return fmt.Errorf("error replacing IPAM store: %w", err)
+	}
+
+	return nil
+}
+
+// findAll returns the allocations owned by containerID/ifName.
+func (state *storeState) findAll(containerID, ifName string) []AllocatedIP {
+	var allocs []AllocatedIP
+	for _, alloc := range state.Allocations {
+		if alloc.ContainerID == containerID && alloc.IfName == ifName {
+			allocs = append(allocs, alloc)
+		}
+	}
+
+	return allocs
+}
+
+// reservedIPs returns every allocated address and every address reserved for a sticky IP owner.
+func (state *storeState) reservedIPs() map[string]bool {
+	ips := make(map[string]bool, len(state.Allocations)+len(state.Reservations))
+	for _, alloc := range state.Allocations {
+		ips[alloc.Address] = true
+	}
+	for _, r := range state.Reservations {
+		ips[r.Address] = true
+	}
+
+	return ips
+}
@@ -0,0 +1,418 @@
+package ip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAllocateIPsParallel(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+
+	const workers = 250
+
+	var wg sync.WaitGroup
+	ips := make([]string, workers)
+	errs := make([]error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			allocs, err := store.AllocateIPs([]string{"10.244.1.0/24"}, fmt.Sprintf("container-%d", i), "eth0")
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			ips[i] = allocs[0].Address
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]int)
+	for i, ip := range ips {
+		if errs[i] != nil {
+			t.Fatalf("AllocateIPs for container-%d: %v", i, errs[i])
+		}
+		if owner, ok := seen[ip]; ok {
+			t.Fatalf("IP %s handed out to container-%d and container-%d", ip, owner, i)
+		}
+		seen[ip] = i
+	}
+
+	allocs, err := store.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(allocs) != workers {
+		t.Fatalf("expected %d allocations in the store, got %d", workers, len(allocs))
+	}
+}
+
+func TestAllocateIPsExhausted(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+
+	// 10.244.1.0/29 has 6 usable addresses, one of which is the gateway.
+	for i := 0; i < 5; i++ {
+		if _, err = store.AllocateIPs([]string{"10.244.1.0/29"}, fmt.Sprintf("container-%d", i), "eth0"); err != nil {
+			t.Fatalf("AllocateIPs: %v", err)
+		}
+	}
+
+	if _, err = store.AllocateIPs([]string{"10.244.1.0/29"}, "container-5", "eth0"); !errors.Is(err, ErrNoAvailableIP) {
+		t.Fatalf("expected ErrNoAvailableIP once the pool is exhausted, got %v", err)
+	}
+}
+
+func TestAllocateIPsNextCIDR(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+
+	podCidrs := []string{"10.244.1.0/29", "10.244.7.0/29"}
+	for i := 0; i < 5; i++ {
+		if _, err = store.AllocateIPs(podCidrs, fmt.Sprintf("container-%d", i), "eth0"); err != nil {
+			t.Fatalf("AllocateIPs: %v", err)
+		}
+	}
+
+	// The first CIDR is full, so the address and the gateway come from the second one.
+	allocs, err := store.AllocateIPs(podCidrs, "container-5", "eth0")
+	if err != nil {
+		t.Fatalf("AllocateIPs: %v", err)
+	}
+	if len(allocs) != 1 || allocs[0].Address != "10.244.7.2/29" || allocs[0].Gateway != "10.244.7.1/29" {
+		t.Fatalf("expected 10.244.7.2/29 via 10.244.7.1, got %+v", allocs)
+	}
+}
+
+func TestAllocateIPsIdempotent(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+
+	first, err := store.AllocateIPs([]string{"10.244.1.0/24"}, "container", "eth0")
+	if err != nil {
+		t.Fatalf("AllocateIPs: %v", err)
+	}
+	if first[0].Gateway != "10.244.1.1/24" || first[0].Address != "10.244.1.2/24" {
+		t.Fatalf("unexpected allocation %s via %s", first[0].Address, first[0].Gateway)
+	}
+
+	second, err := store.AllocateIPs([]string{"10.244.1.0/24"}, "container", "eth0")
+	if err != nil {
+		t.Fatalf("AllocateIPs: %v", err)
+	}
+	if first[0].Address != second[0].Address {
+		t.Fatalf("expected the same IP for the same container, got %s and %s", first[0].Address, second[0].Address)
+	}
+}
+
+func TestAllocateIPsDualStack(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+
+	allocs, err := store.AllocateIPs([]string{"10.244.1.0/24", "fd00:10:244:1::/64"}, "container", "eth0")
+	if err != nil {
+		t.Fatalf("AllocateIPs: %v", err)
+	}
+	if len(allocs) != 2 {
+		t.Fatalf("expected an IPv4 and an IPv6 allocation, got %d", len(allocs))
+	}
+	if allocs[0].Version != "4" || allocs[0].Address != "10.244.1.2/24" {
+		t.Fatalf("unexpected IPv4 allocation %+v", allocs[0])
+	}
+	if allocs[1].Version != "6" || allocs[1].Address != "fd00:10:244:1::2/64" || allocs[1].Gateway != "fd00:10:244:1::1/64" {
+		t.Fatalf("unexpected IPv6 allocation %+v", allocs[1])
+	}
+
+	// The IPv4 pool is exhausted: the IPv6 address must not be reserved either.
+	if _, err = store.AllocateIPs([]string{"10.244.2.0/30"}, "other", "eth0"); err != nil {
+		t.Fatalf("AllocateIPs: %v", err)
+	}
+	if _, err = store.AllocateIPs([]string{"fd00:10:244:1::/64", "10.244.2.0/30"}, "third", "eth0"); err == nil {
+		t.Fatalf("expected an error once the IPv4 pool is exhausted")
+	}
+	if got, _ := store.Get("third", "eth0"); len(got) != 0 {
+		t.Fatalf("expected no partial allocation, got %+v", got)
+	}
+}
+
+func TestReturnIP(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+
+	if _, err = store.AllocateIPs([]string{"10.244.1.0/24", "fd00:10:244:1::/64"}, "container", "eth0"); err != nil {
+		t.Fatalf("AllocateIPs: %v", err)
+	}
+
+	if err = store.ReturnIP("container", "eth1"); err != nil {
+		t.Fatalf("ReturnIP for an interface without an allocation: %v", err)
+	}
+
+	if err = store.ReturnIP("container", "eth0"); err != nil {
+		t.Fatalf("ReturnIP: %v", err)
+	}
+
+	got, err := store.Get("container", "eth0")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("expected no allocation after ReturnIP, got %+v", got)
+	}
+
+	// Addresses are handed out round-robin: the released one comes back only after the rest of the range.
+	// 10.244.1.0/29 has .2-.6 for pods.
+	podCidrs := []string{"10.244.1.0/29"}
+	var addrs []string
+	for i := 0; i < 5; i++ {
+		if i == 1 {
+			if err = store.ReturnIP("pod-0", "eth0"); err != nil {
+				t.Fatalf("ReturnIP: %v", err)
+			}
+		}
+
+		allocs, err := store.AllocateIPs(podCidrs, fmt.Sprintf("pod-%d", i), "eth0")
+		if err != nil {
+			t.Fatalf("AllocateIPs pod-%d: %v", i, err)
+		}
+		addrs = append(addrs, allocs[0].Address)
+	}
+
+	want := []string{"10.244.1.2/29", "10.244.1.3/29", "10.244.1.4/29", "10.244.1.5/29", "10.244.1.6/29"}
+	if fmt.Sprint(addrs) != fmt.Sprint(want) {
+		t.Fatalf("expected %v, got %v", want, addrs)
+	}
+
+	again, err := store.AllocateIPs(podCidrs, "pod-5", "eth0")
+	if err != nil {
+		t.Fatalf("AllocateIPs: %v", err)
+	}
+	if again[0].Address != "10.244.1.2/29" {
+		t.Fatalf("expected the released 10.244.1.2/29 after wrapping around, got %s", again[0].Address)
+	}
+}
+
+func TestAllocateRequestedIPs(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+
+	podCidrs := []string{"10.244.1.0/24", "fd00:10:244:1::/64"}
+	allocs, err := store.Allocate(podCidrs, Ranges{}, Request{ContainerID: "static", IfName: "eth0", IPs: []net.IP{net.ParseIP("10.244.1.50")}})
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	// IPv6 was not requested, so it gets the first available address.
+	if len(allocs) != 2 || allocs[0].Address != "10.244.1.50/24" || allocs[1].Address != "fd00:10:244:1::2/64" {
+		t.Fatalf("unexpected allocations %+v", allocs)
+	}
+
+	cases := []struct {
+		ip   string
+		want error
+	}{
+		{"10.244.1.50", ErrIPInUse},
+		{"10.244.2.50", ErrIPOutOfRange},
+		{"10.244.1.1", ErrIPOutOfRange},   // gateway
+		{"10.244.1.255", ErrIPOutOfRange}, // broadcast
+	}
+	for _, c := range cases {
+		_, err = store.Allocate(podCidrs, Ranges{}, Request{ContainerID: "other", IfName: "eth0", IPs: []net.IP{net.ParseIP(c.ip)}})
+		if !errors.Is(err, c.want) {
+			t.Errorf("%s: expected %v, got %v", c.ip, c.want, err)
+		}
+	}
+
+	// Nothing was recorded for the failed requests.
+	if allocs, err = store.Get("other", "eth0"); err != nil || len(allocs) != 0 {
+		t.Fatalf("expected no allocations for the failed requests, got %+v, %v", allocs, err)
+	}
+}
+
+func TestStickyIPs(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+
+	clock := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	podCidrs := []string{"10.244.1.0/24"}
+	web0 := Request{ContainerID: "web-0-a", IfName: "eth0", Owner: "default/web-0"}
+
+	// Move web-0 off the first address so that "first available" and "sticky" differ.
+	if _, err = store.AllocateIPs(podCidrs, "other", "eth0"); err != nil {
+		t.Fatalf("AllocateIPs: %v", err)
+	}
+	first, err := store.Allocate(podCidrs, Ranges{}, web0)
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if err = store.ReturnIP("other", "eth0"); err != nil {
+		t.Fatalf("ReturnIP: %v", err)
+	}
+
+	if err = store.ReturnIPWithGracePeriod(web0.ContainerID, web0.IfName, time.Minute); err != nil {
+		t.Fatalf("ReturnIPWithGracePeriod: %v", err)
+	}
+
+	// Nobody else gets the reserved address.
+	stranger, err := store.AllocateIPs(podCidrs, "stranger", "eth0")
+	if err != nil {
+		t.Fatalf("AllocateIPs: %v", err)
+	}
+	if stranger[0].Address == first[0].Address {
+		t.Fatalf("reserved address %s was handed out to another container", first[0].Address)
+	}
+
+	// The recreated pod gets it back.
+	web0.ContainerID = "web-0-b"
+	again, err := store.Allocate(podCidrs, Ranges{}, web0)
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if again[0].Address != first[0].Address {
+		t.Fatalf("expected the sticky address %s, got %s", first[0].Address, again[0].Address)
+	}
+
+	// Once the grace period is over, the reservation is collected.
+	if err = store.ReturnIPWithGracePeriod(web0.ContainerID, web0.IfName, time.Minute); err != nil {
+		t.Fatalf("ReturnIPWithGracePeriod: %v", err)
+	}
+	clock = clock.Add(2 * time.Minute)
+
+	ip, _, _ := net.ParseCIDR(first[0].Address)
+	if _, err = store.Allocate(podCidrs, Ranges{}, Request{ContainerID: "late", IfName: "eth0", IPs: []net.IP{ip}}); err != nil {
+		t.Fatalf("expected the expired reservation %s to be available again: %v", first[0].Address, err)
+	}
+}
+
+func TestAllocateRanges(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+
+	podCidrs := []string{"10.244.1.0/24"}
+	ranges := Ranges{
+		RangeStart: "10.244.1.10",
+		RangeEnd:   "10.244.1.14",
+		Exclude:    []string{"10.244.1.11", "10.244.1.12/31"},
+		Gateway:    "10.244.1.254",
+	}
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		allocs, err := store.Allocate(podCidrs, ranges, Request{ContainerID: fmt.Sprintf("container-%d", i), IfName: "eth0"})
+		if err != nil {
+			t.Fatalf("Allocate: %v", err)
+		}
+		if allocs[0].Gateway != "10.244.1.254/24" {
+			t.Fatalf("expected the configured gateway, got %s", allocs[0].Gateway)
+		}
+		got = append(got, allocs[0].Address)
+	}
+
+	// .11, .12 and .13 are excluded
+	if got[0] != "10.244.1.10/24" || got[1] != "10.244.1.14/24" {
+		t.Fatalf("expected 10.244.1.10 and 10.244.1.14, got %v", got)
+	}
+
+	if _, err = store.Allocate(podCidrs, ranges, Request{ContainerID: "full", IfName: "eth0"}); !errors.Is(err, ErrNoAvailableIP) {
+		t.Fatalf("expected ErrNoAvailableIP once the range is used up, got %v", err)
+	}
+
+	// A static IP may be outside the dynamic range, but not excluded or the gateway.
+	if _, err = store.Allocate(podCidrs, ranges, Request{ContainerID: "static", IfName: "eth0", IPs: []net.IP{net.ParseIP("10.244.1.100")}}); err != nil {
+		t.Fatalf("Allocate static IP outside the range: %v", err)
+	}
+	for _, ip := range []string{"10.244.1.12", "10.244.1.254"} {
+		_, err = store.Allocate(podCidrs, ranges, Request{ContainerID: "static-" + ip, IfName: "eth0", IPs: []net.IP{net.ParseIP(ip)}})
+		if !errors.Is(err, ErrIPOutOfRange) {
+			t.Errorf("%s: expected ErrIPOutOfRange, got %v", ip, err)
+		}
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	store.SetQuarantine(time.Minute)
+
+	clock := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	// 10.244.1.0/29 has .2-.6 for pods
+	podCidrs := []string{"10.244.1.0/29"}
+	allocate := func(containerID string) string {
+		t.Helper()
+		allocs, err := store.AllocateIPs(podCidrs, containerID, "eth0")
+		if err != nil {
+			t.Fatalf("AllocateIPs %s: %v", containerID, err)
+		}
+		return allocs[0].Address
+	}
+	release := func(containerID string) {
+		t.Helper()
+		if err := store.ReturnIP(containerID, "eth0"); err != nil {
+			t.Fatalf("ReturnIP %s: %v", containerID, err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		allocate(fmt.Sprintf("pod-%d", i))
+	}
+
+	// .2 goes into quarantine; .3 is released while the quarantine is off
+	release("pod-0")
+	store.SetQuarantine(0)
+	release("pod-1")
+	store.SetQuarantine(time.Minute)
+
+	if ip := allocate("a"); ip != "10.244.1.3/29" {
+		t.Fatalf("expected the free 10.244.1.3/29 instead of the quarantined 10.244.1.2/29, got %s", ip)
+	}
+
+	// Nothing else is left: the quarantined address is handed out rather than failing
+	if ip := allocate("b"); ip != "10.244.1.2/29" {
+		t.Fatalf("expected the quarantined 10.244.1.2/29 once the pod CIDR is exhausted, got %s", ip)
+	}
+
+	// The cooldown is over: the address leaves quarantine
+	release("a")
+	clock = clock.Add(2 * time.Minute)
+	if ip := allocate("c"); ip != "10.244.1.3/29" {
+		t.Fatalf("expected 10.244.1.3/29 after its quarantine, got %s", ip)
+	}
+
+	if err = store.update(func(state *storeState) (bool, error) {
+		if len(state.Quarantine) != 0 {
+			t.Errorf("expected an empty quarantine, got %+v", state.Quarantine)
+		}
+		return false, nil
+	}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+}
@@ -0,0 +1,394 @@
+package ippool
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/royroyee/bvcni/pkg/config"
+	ipa "github.com/royroyee/bvcni/pkg/ip"
+	pkg "github.com/royroyee/bvcni/pkg/k8s"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+	"net"
+	"strings"
+	"time"
+)
+
+// An IPPool is a cluster-wide pod network (ex. 10.244.0.0/16) that bvcnid splits into blocks of
+// blockSize (ex. /24) and hands out to the nodes, in place of kube-controller-manager's node CIDR allocation.
+// The owner of every block is recorded in the IPPool status. Every change is an update with the
+// resourceVersion that was read, so two nodes claiming a block at the same time conflict and one of them retries.
+
+var ipPoolResource = schema.GroupVersionResource{Group: "bvcni.io", Version: "v1alpha1", Resource: "ippools"}
+
+const (
+	// growInterval is how often the free addresses of the node's blocks are checked.
+	growInterval = 30 * time.Second
+
+	// A node claims another block once less than 1/growThreshold of a block is free.
+	growThreshold = 10
+)
+
+type IPPool struct {
+	metaV1.TypeMeta   `json:",inline"`
+	metaV1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   IPPoolSpec   `json:"spec"`
+	Status IPPoolStatus `json:"status,omitempty"`
+}
+
+type IPPoolSpec struct {
+	CIDR      string `json:"cidr"`      // ex) 10.244.0.0/16
+	BlockSize int    `json:"blockSize"` // prefix length of a node block, ex) 24
+}
+
+type IPPoolStatus struct {
+	Blocks []Block `json:"blocks,omitempty"`
+}
+
+type Block struct {
+	CIDR string `json:"cidr"`
+	Node string `json:"node"`
+}
+
+// Allocator claims and releases the IPPool blocks of nodes.
+type Allocator struct {
+	client   dynamic.Interface
+	pools    []string
+	nodeName string
+}
+
+func NewAllocator(client dynamic.Interface, pools []string, nodeName string) *Allocator {
+	return &Allocator{client: client, pools: pools, nodeName: nodeName}
+}
+
+// NodeBlocks returns the blocks of the current node in every pool. A pool where the node
+// does not own a block yet gets one claimed.
+func (a *Allocator) NodeBlocks(ctx context.Context) ([]string, error) {
+	var blocks []string
+	for _, name := range a.pools {
+		pool, err := a.get(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		owned := pool.nodeBlocks(a.nodeName)
+		if len(owned) == 0 {
+			block, err := a.claim(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			owned = []string{block}
+		}
+
+		blocks = append(blocks, owned...)
+	}
+
+	return blocks, nil
+}
+
+// Release gives every block of nodeName back to the pools.
+func (a *Allocator) Release(ctx context.Context, nodeName string) error {
+	for _, name := range a.pools {
+		err := a.update(ctx, name, func(pool *IPPool) (bool, error) {
+			kept := pool.Status.Blocks[:0]
+			for _, block := range pool.Status.Blocks {
+				if block.Node != nodeName {
+					kept = append(kept, block)
+					continue
+				}
+				klog.Infof("release block %s of node %s from IPPool %s", block.CIDR, nodeName, name)
+			}
+
+			changed := len(kept) != len(pool.Status.Blocks)
+			pool.Status.Blocks = kept
+			return changed, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReleaseDeletedNodes releases the blocks of nodes that were deleted while no bvcnid watched.
+func (a *Allocator) ReleaseDeletedNodes(ctx context.Context, nodeDeleted func(nodeName string) (bool, error)) error {
+	for _, name := range a.pools {
+		pool, err := a.get(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		for _, nodeName := range pool.nodes() {
+			deleted, err := nodeDeleted(nodeName)
+			if err != nil {
+				return err
+			}
+			if !deleted {
+				continue
+			}
+
+			if err = a.Release(ctx, nodeName); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Run claims another block for a pool whenever the blocks the node owns in it are nearly full,
+// and calls onChange with all the node's blocks. It returns when stopCh is closed.
+func (a *Allocator) Run(stopCh <-chan struct{}, store *ipa.Store, onChange func(blocks []string)) {
+	ticker := time.NewTicker(growInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		grown, err := a.grow(context.TODO(), store)
+		if err != nil {
+			klog.Errorf("IPPool grow error : %s", err.Error())
+			continue
+		}
+		if !grown {
+			continue
+		}
+
+		blocks, err := a.NodeBlocks(context.TODO())
+		if err != nil {
+			klog.Errorf("IPPool NodeBlocks error : %s", err.Error())
+			continue
+		}
+		onChange(blocks)
+	}
+}
+
+// grow claims a block in every pool where less than 1/growThreshold of a block is free.
+func (a *Allocator) grow(ctx context.Context, store *ipa.Store) (bool, error) {
+	allocs, err := store.List()
+	if err != nil {
+		return false, err
+	}
+
+	grown := false
+	for _, name := range a.pools {
+		pool, err := a.get(ctx, name)
+		if err != nil {
+			return grown, err
+		}
+
+		blocks := pool.nodeBlocks(a.nodeName)
+		if len(blocks) == 0 {
+			continue
+		}
+
+		free, err := freeIPs(blocks, allocs)
+		if err != nil {
+			return grown, err
+		}
+
+		blockIPs, err := ipa.PodIPCount(blocks[0])
+		if err != nil {
+			return grown, err
+		}
+
+		if free*growThreshold >= blockIPs {
+			continue
+		}
+
+		klog.Infof("%d free IPs left in %v of IPPool %s, claiming another block", free, blocks, name)
+		if _, err = a.claim(ctx, name); err != nil {
+			return grown, err
+		}
+		grown = true
+	}
+
+	return grown, nil
+}
+
+// claim assigns the first free block of the pool to the current node.
+func (a *Allocator) claim(ctx context.Context, name string) (string, error) {
+	var claimed string
+	err := a.update(ctx, name, func(pool *IPPool) (bool, error) {
+		block, err := pool.nextFreeBlock()
+		if err != nil {
+			return false, err
+		}
+
+		claimed = block.String()
+		pool.Status.Blocks = append(pool.Status.Blocks, Block{CIDR: claimed, Node: a.nodeName})
+		return true, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	klog.Infof("claimed block %s of IPPool %s for node %s", claimed, name, a.nodeName)
+	return claimed, nil
+}
+
+// update applies fn to the latest version of the pool and writes it back if fn reports a change.
+// A conflict means that another node changed the pool in between, so fn runs again on the new version.
+func (a *Allocator) update(ctx context.Context, name string, fn func(pool *IPPool) (bool, error)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pool, err := a.get(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		changed, err := fn(pool)
+		if err != nil || !changed {
+			return err
+		}
+
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+		if err != nil {
+			return errors.Wrapf(err, "encode IPPool %s error", name)
+		}
+
+		_, err = a.client.Resource(ipPoolResource).Update(ctx, &unstructured.Unstructured{Object: obj}, metaV1.UpdateOptions{})
+		return err
+	})
+}
+
+func (a *Allocator) get(ctx context.Context, name string) (*IPPool, error) {
+	obj, err := a.client.Resource(ipPoolResource).Get(ctx, name, metaV1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "get IPPool %s error", name)
+	}
+
+	pool := &IPPool{}
+	if err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, pool); err != nil {
+		return nil, errors.Wrapf(err, "decode IPPool %s error", name)
+	}
+
+	return pool, nil
+}
+
+// nodeBlocks returns the blocks owned by nodeName, in claim order.
+func (pool *IPPool) nodeBlocks(nodeName string) []string {
+	var blocks []string
+	for _, block := range pool.Status.Blocks {
+		if block.Node == nodeName {
+			blocks = append(blocks, block.CIDR)
+		}
+	}
+
+	return blocks
+}
+
+// nodes returns every node that owns a block.
+func (pool *IPPool) nodes() []string {
+	seen := map[string]bool{}
+	var nodes []string
+	for _, block := range pool.Status.Blocks {
+		if !seen[block.Node] {
+			seen[block.Node] = true
+			nodes = append(nodes, block.Node)
+		}
+	}
+
+	return nodes
+}
+
+// nextFreeBlock returns the lowest block of the pool that no node owns.
+func (pool *IPPool) nextFreeBlock() (*net.IPNet, error) {
+	_, poolNet, err := net.ParseCIDR(pool.Spec.CIDR)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid CIDR of IPPool %s", pool.Name)
+	}
+
+	ones, bits := poolNet.Mask.Size()
+	if pool.Spec.BlockSize < ones || pool.Spec.BlockSize > bits-2 {
+		return nil, errors.Errorf("block size /%d of IPPool %s must be between /%d and /%d", pool.Spec.BlockSize, pool.Name, ones, bits-2)
+	}
+
+	owned := map[string]bool{}
+	for _, block := range pool.Status.Blocks {
+		owned[block.CIDR] = true
+	}
+
+	mask := net.CIDRMask(pool.Spec.BlockSize, bits)
+	for ip := poolNet.IP; poolNet.Contains(ip); ip = nextBlockIP(ip, mask) {
+		block := &net.IPNet{IP: ip, Mask: mask}
+		if !owned[block.String()] {
+			return block, nil
+		}
+	}
+
+	return nil, errors.Errorf("IPPool %s (%s) has no free /%d block", pool.Name, pool.Spec.CIDR, pool.Spec.BlockSize)
+}
+
+// nextBlockIP returns the network address of the block after the one of ip. It wraps to the zero address at the end.
+func nextBlockIP(ip net.IP, mask net.IPMask) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+
+	// Add one to the last network bit, carrying over to the higher bytes
+	ones, bits := mask.Size()
+	i := (ones - 1) / 8
+	inc := byte(1) << uint(bits-ones-(len(ip)-1-i)*8)
+	for ; i >= 0; i-- {
+		next[i] += inc
+		if next[i] >= inc {
+			break
+		}
+		inc = 1
+	}
+
+	return next
+}
+
+// freeIPs counts the addresses of blocks that are not allocated.
+func freeIPs(blocks []string, allocs []ipa.AllocatedIP) (uint64, error) {
+	var free uint64
+	for _, block := range blocks {
+		_, blockNet, err := net.ParseCIDR(block)
+		if err != nil {
+			return 0, err
+		}
+
+		count, err := ipa.PodIPCount(block)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, alloc := range allocs {
+			ip, _, err := net.ParseCIDR(alloc.Address)
+			if err == nil && blockNet.Contains(ip) && count > 0 {
+				count--
+			}
+		}
+		free += count
+	}
+
+	return free, nil
+}
+
+// StoreNodeBlocks records the blocks in the node annotation, so that the other nodes route them over VXLAN,
+// and returns the node with the new annotation.
+func StoreNodeBlocks(node *coreV1.Node, blocks []string) (*coreV1.Node, error) {
+	newNode := node.DeepCopy()
+	if newNode.Annotations == nil {
+		newNode.Annotations = map[string]string{}
+	}
+	newNode.Annotations[config.PodCIDRsAnnotationKey] = strings.Join(blocks, ",")
+
+	if err := pkg.PatchNode(node, newNode); err != nil {
+		return nil, fmt.Errorf("error storing the IPPool blocks of node %s: %w", node.Name, err)
+	}
+
+	return newNode, nil
+}
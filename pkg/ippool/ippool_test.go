@@ -0,0 +1,86 @@
+package ippool
+
+import (
+	"testing"
+
+	ipa "github.com/royroyee/bvcni/pkg/ip"
+)
+
+func TestNextFreeBlock(t *testing.T) {
+	pool := &IPPool{Spec: IPPoolSpec{CIDR: "10.244.0.0/16", BlockSize: 24}}
+	pool.Status.Blocks = []Block{
+		{CIDR: "10.244.0.0/24", Node: "node1"},
+		{CIDR: "10.244.2.0/24", Node: "node2"},
+	}
+
+	block, err := pool.nextFreeBlock()
+	if err != nil {
+		t.Fatalf("nextFreeBlock: %v", err)
+	}
+	if block.String() != "10.244.1.0/24" {
+		t.Fatalf("expected the first hole 10.244.1.0/24, got %s", block)
+	}
+}
+
+func TestNextFreeBlockSizes(t *testing.T) {
+	cases := []struct {
+		cidr      string
+		blockSize int
+		owned     []string
+		want      string
+	}{
+		{"10.244.0.0/16", 20, []string{"10.244.0.0/20"}, "10.244.16.0/20"},
+		{"10.244.0.0/16", 26, []string{"10.244.0.0/26", "10.244.0.64/26", "10.244.0.128/26", "10.244.0.192/26"}, "10.244.1.0/26"},
+		{"fd00:10:244::/56", 64, []string{"fd00:10:244::/64"}, "fd00:10:244:1::/64"},
+	}
+
+	for _, c := range cases {
+		pool := &IPPool{Spec: IPPoolSpec{CIDR: c.cidr, BlockSize: c.blockSize}}
+		for _, owned := range c.owned {
+			pool.Status.Blocks = append(pool.Status.Blocks, Block{CIDR: owned, Node: "node1"})
+		}
+
+		block, err := pool.nextFreeBlock()
+		if err != nil {
+			t.Fatalf("%s /%d: %v", c.cidr, c.blockSize, err)
+		}
+		if block.String() != c.want {
+			t.Errorf("%s /%d: expected %s, got %s", c.cidr, c.blockSize, c.want, block)
+		}
+	}
+}
+
+func TestNextFreeBlockExhausted(t *testing.T) {
+	pool := &IPPool{Spec: IPPoolSpec{CIDR: "10.244.0.0/23", BlockSize: 24}}
+	pool.Status.Blocks = []Block{
+		{CIDR: "10.244.0.0/24", Node: "node1"},
+		{CIDR: "10.244.1.0/24", Node: "node2"},
+	}
+
+	if _, err := pool.nextFreeBlock(); err == nil {
+		t.Fatalf("expected an error once every block is owned")
+	}
+
+	pool.Spec.BlockSize = 16
+	if _, err := pool.nextFreeBlock(); err == nil {
+		t.Fatalf("expected an error for a block larger than the pool")
+	}
+}
+
+func TestFreeIPs(t *testing.T) {
+	allocs := []ipa.AllocatedIP{
+		{Address: "10.244.1.2/24"},
+		{Address: "10.244.1.3/24"},
+		{Address: "10.244.2.2/24"}, // other block
+	}
+
+	free, err := freeIPs([]string{"10.244.1.0/24"}, allocs)
+	if err != nil {
+		t.Fatalf("freeIPs: %v", err)
+	}
+
+	// 256 - network, gateway, broadcast - 2 allocated
+	if free != 251 {
+		t.Fatalf("expected 251 free IPs, got %d", free)
+	}
+}
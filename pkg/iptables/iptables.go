@@ -3,38 +3,67 @@ package iptables
 import (
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/pkg/errors"
+	"github.com/royroyee/bvcni/pkg/config"
 	"net"
 	"os/exec"
 )
 
-func UpdateIptables(podCidr string) error {
+// UpdateIptables accepts forwarding within the cluster pod network (clusterCidrs) and masquerades
+// traffic from the node's pods (podCidrs) that leaves it. IPv6 pod CIDRs are handled with ip6tables.
+func UpdateIptables(podCidrs []string, clusterCidrs []*net.IPNet) error {
+	for _, podCidr := range podCidrs {
+		podIP, _, err := net.ParseCIDR(podCidr)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid pod CIDR %s", podCidr)
+		}
+
+		clusterCidr := config.FamilyNet(clusterCidrs, podIP)
+		if clusterCidr == nil {
+			return errors.Errorf("no cluster CIDR for pod CIDR %s", podCidr)
+		}
+
+		if err = updateIptables(podCidr, clusterCidr, podIP.To4() == nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func updateIptables(podCidr string, clusterCidr *net.IPNet, ipv6 bool) error {
 
-	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	protocol := iptables.ProtocolIPv4
+	if ipv6 {
+		protocol = iptables.ProtocolIPv6
+	}
+
+	ipt, err := iptables.NewWithProtocol(protocol)
 	if err != nil {
 		// If iptables is not found, return an error and exit.
 		return errors.Wrapf(err, "Failed to setup IPtables. iptables binary was not found")
 	}
 
-	// Add forward rule for the /16 subnet instead of the pod CIDR range for VXLAN
-	err = appendForwardRule(ipt, podCidr)
+	// Add forward rule for the cluster pod network instead of the pod CIDR range for VXLAN
+	err = appendForwardRule(ipt, clusterCidr)
 	if err != nil {
 		return errors.Wrapf(err, "Failed to add FORWARD rule")
 	}
 
-	// Add a rule to the nat POSTROUTING chain to masquerade traffic from the specified source IP range (podCIDR).
-	err = appendMasqueradeRule(ipt, podCidr)
+	// Add a rule to the nat POSTROUTING chain to masquerade traffic from the specified source IP range (podCIDR),
+	// except traffic to other pods.
+	err = appendMasqueradeRule(ipt, podCidr, clusterCidr)
 	if err != nil {
 		return errors.Wrapf(err, "Failed to add MASQUERADE rule")
 	}
 
 	// Check IP forwarding and enable if necessary.
-	err = enableIPForwarding()
+	err = enableIPForwarding(ipv6)
 	if err != nil {
 		return errors.Wrapf(err, "Failed to enable IP forwarding")
 	}
 
 	// Set the FORWARD chain policy.
-	err = setForwardChainPolicy()
+	err = setForwardChainPolicy(ipt)
 	if err != nil {
 		return errors.Wrapf(err, "Failed to set FORWARD chain policy")
 	}
@@ -42,9 +71,15 @@ func UpdateIptables(podCidr string) error {
 	return nil
 }
 
-func appendMasqueradeRule(ipt *iptables.IPTables, podCidr string) error {
+func appendMasqueradeRule(ipt *iptables.IPTables, podCidr string, clusterCidr *net.IPNet) error {
+
+	// Earlier versions masqueraded pod-to-pod traffic as well.
+	err := ipt.DeleteIfExists("nat", "POSTROUTING", "-s", podCidr, "-j", "MASQUERADE")
+	if err != nil {
+		return errors.Wrap(err, "deleteMasqueradeRule Error")
+	}
 
-	err := ipt.AppendUnique("nat", "POSTROUTING", "-s", podCidr, "-j", "MASQUERADE")
+	err = ipt.AppendUnique("nat", "POSTROUTING", "-s", podCidr, "!", "-d", clusterCidr.String(), "-j", "MASQUERADE")
 	if err != nil {
 		return errors.Wrap(err, "appendMasqueradeRule Error")
 	}
@@ -52,26 +87,14 @@ func appendMasqueradeRule(ipt *iptables.IPTables, podCidr string) error {
 	return nil
 }
 
-func appendForwardRule(ipt *iptables.IPTables, podCidr string) error {
+func appendForwardRule(ipt *iptables.IPTables, clusterCidr *net.IPNet) error {
 
-	_, ipNet, err := net.ParseCIDR(podCidr)
-	if err != nil {
-		return errors.Wrap(err, "Invalid CIDR")
-	}
-
-	maskSize, _ := ipNet.Mask.Size()
-	if maskSize == 24 {
-		newMask := net.CIDRMask(16, 32)
-		ipNet.Mask = newMask
-		podCidr = ipNet.String()
-	}
-
-	err = ipt.AppendUnique("filter", "FORWARD", "-s", podCidr, "-j", "ACCEPT")
+	err := ipt.AppendUnique("filter", "FORWARD", "-s", clusterCidr.String(), "-j", "ACCEPT")
 	if err != nil {
 		return errors.Wrap(err, "appendForwardSourceRule Error")
 	}
 
-	err = ipt.AppendUnique("filter", "FORWARD", "-d", podCidr, "-j", "ACCEPT")
+	err = ipt.AppendUnique("filter", "FORWARD", "-d", clusterCidr.String(), "-j", "ACCEPT")
 	if err != nil {
 		return errors.Wrap(err, "appendForwardDestinationRule Error")
 	}
@@ -80,18 +103,22 @@ func appendForwardRule(ipt *iptables.IPTables, podCidr string) error {
 }
 
 // enables IP forwarding by executing the sysctl command.
-func enableIPForwarding() error {
-	cmd := exec.Command("sysctl", "-w", "net.ipv4.ip_forward=1")
+func enableIPForwarding(ipv6 bool) error {
+	key := "net.ipv4.ip_forward"
+	if ipv6 {
+		key = "net.ipv6.conf.all.forwarding"
+	}
+
+	cmd := exec.Command("sysctl", "-w", key+"=1")
 	if err := cmd.Run(); err != nil {
 		return errors.Wrapf(err, "Failed to enable IP forwarding")
 	}
 	return nil
 }
 
-// Set the FORWARD chain policy to ACCEPT using the iptables command.
-func setForwardChainPolicy() error {
-	cmd := exec.Command("iptables", "--policy", "FORWARD", "ACCEPT")
-	if err := cmd.Run(); err != nil {
+// Set the FORWARD chain policy to ACCEPT using the iptables (or ip6tables) command.
+func setForwardChainPolicy(ipt *iptables.IPTables) error {
+	if err := ipt.ChangePolicy("filter", "FORWARD", "ACCEPT"); err != nil {
 		return errors.Wrapf(err, "Failed to set FORWARD chain policy")
 	}
 	return nil
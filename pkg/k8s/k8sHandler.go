@@ -3,27 +3,26 @@ package pkg
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"github.com/pkg/errors"
-	"github.com/royroyee/bvcni/pkg/utils"
-	"github.com/vishvananda/netlink"
+	"github.com/royroyee/bvcni/pkg/backend"
+	bvconfig "github.com/royroyee/bvcni/pkg/config"
 	coreV1 "k8s.io/api/core/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	v1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 	"k8s.io/klog/v2"
-	"net"
 	"os"
-)
-
-const (
-	bvcniVtepMacAnnotationKey = "bvcni.vtep.mac"
-	bvcniHostIPAnnotationKey  = "bvcni.host.ip"
+	"reflect"
 )
 
 var (
@@ -32,6 +31,7 @@ var (
 	factory      informers.SharedInformerFactory
 	nodeInformer cache.SharedIndexInformer
 	nodeLister   v1.NodeLister
+	podLister    v1.PodLister
 )
 
 // In Cluster
@@ -53,6 +53,60 @@ func InitK8sClient() *kubernetes.Clientset {
 	return clientSet
 }
 
+// InitDynamicClient creates the client for custom resources (IPPool) in cluster.
+func InitDynamicClient() dynamic.Interface {
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		panic(errors.Wrap(err, "k8s-InClusterConfig error"))
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		panic(errors.Wrap(err, "k8s-dynamic NewForConfig error"))
+	}
+
+	return dynamicClient
+}
+
+// WriteKubeconfig writes a kubeconfig with the bvcnid service account for the plugin, which runs outside of any pod.
+// The service account token rotates, so it should be written again from time to time.
+func WriteKubeconfig(path string) error {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return errors.Wrap(err, "k8s-InClusterConfig error")
+	}
+
+	token, err := os.ReadFile(config.BearerTokenFile)
+	if err != nil {
+		return errors.Wrap(err, "read service account token error")
+	}
+
+	ca, err := os.ReadFile(config.TLSClientConfig.CAFile)
+	if err != nil {
+		return errors.Wrap(err, "read service account CA error")
+	}
+
+	kubeconfig := clientcmdapi.NewConfig()
+	kubeconfig.Clusters["local"] = &clientcmdapi.Cluster{Server: config.Host, CertificateAuthorityData: ca}
+	kubeconfig.AuthInfos["bvcni"] = &clientcmdapi.AuthInfo{Token: string(token)}
+	kubeconfig.Contexts["bvcni"] = &clientcmdapi.Context{Cluster: "local", AuthInfo: "bvcni"}
+	kubeconfig.CurrentContext = "bvcni"
+
+	content, err := clientcmd.Write(*kubeconfig)
+	if err != nil {
+		return errors.Wrap(err, "encode kubeconfig error")
+	}
+
+	// Replace the file atomically, the plugin may be reading it
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, content, 0600); err != nil {
+		return errors.Wrap(err, "write kubeconfig error")
+	}
+
+	return errors.Wrap(os.Rename(tmp, path), "replace kubeconfig error")
+}
+
 func InitNodeInformer(clientSet *kubernetes.Clientset, stopCh <-chan struct{}) error {
 
 	factory = informers.NewSharedInformerFactory(clientSet, 0)
@@ -68,8 +122,46 @@ func InitNodeInformer(clientSet *kubernetes.Clientset, stopCh <-chan struct{}) e
 	return nil
 }
 
-func SetUpNodeHandler(nodeName string, vxlan *netlink.Vxlan, vxlanAddr net.IP) {
+// InitPodInformer watches the pods scheduled to nodeName, which bvcnid compares the IPAM allocations against.
+func InitPodInformer(clientSet *kubernetes.Clientset, nodeName string, stopCh <-chan struct{}) error {
+
+	podFactory := informers.NewSharedInformerFactoryWithOptions(clientSet, 0,
+		informers.WithTweakListOptions(func(options *metaV1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", nodeName).String()
+		}))
+
+	podInformer := podFactory.Core().V1().Pods().Informer()
+	go podInformer.Run(stopCh)
+
+	if !cache.WaitForCacheSync(stopCh, podInformer.HasSynced) {
+		return errors.Errorf("WaitForCacheSync syncronization error")
+	}
+
+	podLister = podFactory.Core().V1().Pods().Lister()
+	return nil
+}
+
+// PodRunning reports whether the pod (namespace/name) is on the current node and has not terminated.
+func PodRunning(pod string) bool {
+	namespace, name, err := cache.SplitMetaNamespaceKey(pod)
+	if err != nil {
+		return false
+	}
+
+	p, err := podLister.Pods(namespace).Get(name)
+	if err != nil {
+		return false
+	}
+
+	return p.Status.Phase != coreV1.PodSucceeded && p.Status.Phase != coreV1.PodFailed
+}
+
+// SetUpNodeHandler keeps the peers of the overlay backend in sync with the other nodes of the cluster.
+func SetUpNodeHandler(nodeName string, b backend.Backend) {
 	filterFunc := func(obj interface{}) bool {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
 
 		node, ok := obj.(*coreV1.Node)
 		if !ok {
@@ -83,26 +175,22 @@ func SetUpNodeHandler(nodeName string, vxlan *netlink.Vxlan, vxlanAddr net.IP) {
 	}
 
 	addFunc := func(obj interface{}) {
-		if err := nodeAddOrUpdate(vxlan, vxlanAddr, obj); err != nil {
-			klog.Errorf("nodeAddOrUpdate error %s", err.Error())
+		if err := b.AddPeer(obj.(*coreV1.Node)); err != nil {
+			klog.Errorf("AddPeer error %s", err.Error())
 		}
 	}
 	delFunc := func(obj interface{}) {
-		if err := nodeDel(vxlan); err != nil {
-			klog.Errorf("nodeDel error %s", err)
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+
+		if err := b.RemovePeer(obj.(*coreV1.Node)); err != nil {
+			klog.Errorf("RemovePeer error %s", err.Error())
 		}
 	}
 	updateFunc := func(oldObj, newObj interface{}) {
-		oldNode := oldObj.(*coreV1.Node)
-		newNode := newObj.(*coreV1.Node)
-		if oldNode.Annotations[bvcniVtepMacAnnotationKey] == newNode.Annotations[bvcniVtepMacAnnotationKey] {
-			return
-		}
-
-		klog.Infof("node update event: %s", newNode.Name)
-
-		if err := nodeAddOrUpdate(vxlan, vxlanAddr, newObj); err != nil {
-			klog.Errorf("nodeAddOrUpdate error %s", err.Error())
+		if err := b.UpdatePeer(oldObj.(*coreV1.Node), newObj.(*coreV1.Node)); err != nil {
+			klog.Errorf("UpdatePeer error %s", err.Error())
 		}
 	}
 
@@ -116,84 +204,36 @@ func SetUpNodeHandler(nodeName string, vxlan *netlink.Vxlan, vxlanAddr net.IP) {
 	})
 }
 
-type NodeData struct {
-	IPNet   *net.IPNet
-	VtepMac net.HardwareAddr
-	HostIP  net.IP
-}
-
-func extractNodeData(node *coreV1.Node) (*NodeData, error) {
-	_, ipnet, err := net.ParseCIDR(node.Spec.PodCIDR)
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse CIDR %s for node %s: %w", node.Spec.PodCIDR, node.Name, err)
-	}
-
-	vtepMac, err := net.ParseMAC(node.Annotations[bvcniVtepMacAnnotationKey])
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse MAC %s for node %s: %w", node.Annotations[bvcniVtepMacAnnotationKey], node.Name, err)
-	}
-
-	hostIP := net.ParseIP(node.Annotations[bvcniHostIPAnnotationKey])
-	if hostIP == nil {
-		return nil, fmt.Errorf("host IP for node %s is nil", node.Name)
-	}
-
-	return &NodeData{
-		IPNet:   ipnet,
-		VtepMac: vtepMac,
-		HostIP:  hostIP,
-	}, nil
-}
-
-func nodeAddOrUpdate(vxlanDevice *netlink.Vxlan, vxlanAddr net.IP, obj interface{}) error {
-	node := obj.(*coreV1.Node)
-
-	data, err := extractNodeData(node)
-	if err != nil {
-		return err
-	}
-
-	if err = utils.AddArp(vxlanDevice.Index, data.IPNet.IP, data.VtepMac); err != nil {
-		return fmt.Errorf("error adding ARP for node %s: %w", node.Name, err)
-	}
-
-	if err = utils.AddFDB(vxlanDevice.Index, data.HostIP, data.VtepMac); err != nil {
-		return fmt.Errorf("error adding FDB for node %s: %w", node.Name, err)
-	}
-
-	if err = utils.ReplaceRoute(vxlanDevice.Index, data.IPNet); err != nil {
-		return fmt.Errorf("error replacing route for node %s: %w", node.Name, err)
-	}
-
-	return nil
+// AddNodePodCIDRsHandler calls fn whenever the pod CIDRs of the current node change, ex) kube-controller-manager
+// assigned another CIDR or a block was added to the bvcni.pod.cidrs annotation.
+func AddNodePodCIDRsHandler(nodeName string, fn func(node *coreV1.Node)) {
+	nodeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNode := oldObj.(*coreV1.Node)
+			newNode := newObj.(*coreV1.Node)
+			if newNode.Name != nodeName || reflect.DeepEqual(bvconfig.NodePodCIDRs(oldNode), bvconfig.NodePodCIDRs(newNode)) {
+				return
+			}
+
+			klog.Infof("pod CIDRs of node %s changed: %v", nodeName, bvconfig.NodePodCIDRs(newNode))
+			fn(newNode)
+		},
+	})
 }
 
-func nodeDel(vxlanDevice *netlink.Vxlan) func(obj interface{}) {
-	return func(obj interface{}) {
-		node := obj.(*coreV1.Node)
-		data, err := extractNodeData(node)
-		if err != nil {
-			klog.Errorf("Error extracting data from node %s: %v", node.Name, err)
-			return
-		}
-
-		klog.Infof("Node delete event: %s", node.Name)
-
-		if err = utils.DelArp(vxlanDevice.Index, data.IPNet.IP, data.VtepMac); err != nil {
-			klog.Errorf("Error deleting ARP for node %s: %v", node.Name, err)
-			return
-		}
-
-		if err = utils.DelFDB(vxlanDevice.Index, data.HostIP, data.VtepMac); err != nil {
-			klog.Errorf("Error deleting FDB for node %s: %v", node.Name, err)
-			return
-		}
-
-		if err = utils.DelRoute(vxlanDevice.Index, data.IPNet, data.IPNet.IP); err != nil {
-			klog.Errorf("Error deleting route for node %s: %v", node.Name, err)
-			return
-		}
-	}
+// AddNodeDeleteHandler calls fn for every node deleted from the cluster, including the current node.
+func AddNodeDeleteHandler(fn func(node *coreV1.Node)) {
+	nodeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+
+			if node, ok := obj.(*coreV1.Node); ok {
+				fn(node)
+			}
+		},
+	})
 }
 
 func GetCurrentNode() (*coreV1.Node, error) {
@@ -210,6 +250,19 @@ func GetCurrentNode() (*coreV1.Node, error) {
 	return node, nil
 }
 
+// NodeDeleted asks the API server (not the informer cache, which may lag behind) whether the node is gone.
+func NodeDeleted(nodeName string) (bool, error) {
+	_, err := clientSet.CoreV1().Nodes().Get(context.TODO(), nodeName, metaV1.GetOptions{})
+	if apiErrors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "get node %s error", nodeName)
+	}
+
+	return false, nil
+}
+
 // Get Node Info (Current Node)
 func GetCurrentNodeName() (string, error) {
 	nodeName := os.Getenv("NODE_NAME")
@@ -234,6 +287,19 @@ func GetCurrentNodeName() (string, error) {
 	return nodeName, nil
 }
 
+// AnnotateNode sets the annotations on the node, ex) what the other nodes need to reach it over the overlay.
+func AnnotateNode(node *coreV1.Node, annotations map[string]string) error {
+	newNode := node.DeepCopy()
+	if newNode.Annotations == nil {
+		newNode.Annotations = map[string]string{}
+	}
+	for key, value := range annotations {
+		newNode.Annotations[key] = value
+	}
+
+	return PatchNode(node, newNode)
+}
+
 func PatchNode(oldNode, newNode *coreV1.Node) error {
 	oldData, err := json.Marshal(oldNode)
 	if err != nil {
@@ -257,3 +323,32 @@ func PatchNode(oldNode, newNode *coreV1.Node) error {
 
 	return nil
 }
+
+// RecordNodeEvent records an event of bvcnid on the node, shown by kubectl describe node.
+// eventType is coreV1.EventTypeNormal or coreV1.EventTypeWarning.
+func RecordNodeEvent(node *coreV1.Node, eventType, reason, message string) error {
+	now := metaV1.Now()
+	event := &coreV1.Event{
+		// Node events live in the default namespace, like those of kubelet
+		ObjectMeta: metaV1.ObjectMeta{GenerateName: node.Name + ".", Namespace: metaV1.NamespaceDefault},
+		InvolvedObject: coreV1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Node",
+			Name:       node.Name,
+			UID:        node.UID,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         coreV1.EventSource{Component: "bvcnid", Host: node.Name},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	if _, err := clientSet.CoreV1().Events(metaV1.NamespaceDefault).Create(context.TODO(), event, metaV1.CreateOptions{}); err != nil {
+		return errors.Wrapf(err, "failed to record event %s of node %s", reason, node.Name)
+	}
+
+	return nil
+}
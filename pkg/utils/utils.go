@@ -87,12 +87,10 @@ func ReplaceRoute(localVtepID int, dst *net.IPNet) error {
 	})
 }
 
-func DelRoute(vtepDeviceIndex int, dst *net.IPNet, gateway net.IP) error {
+// DelRoute deletes the route ReplaceRoute added for dst.
+func DelRoute(vtepDeviceIndex int, dst *net.IPNet) error {
 	return netlink.RouteDel(&netlink.Route{
 		LinkIndex: vtepDeviceIndex,
-		Scope:     netlink.SCOPE_UNIVERSE,
 		Dst:       dst,
-		Gw:        gateway,
-		Flags:     syscall.RTNH_F_ONLINK,
 	})
 }
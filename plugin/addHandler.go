@@ -8,19 +8,33 @@ import (
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/royroyee/bvcni/pkg/bandwidth"
 	"github.com/royroyee/bvcni/pkg/bridge"
 	"github.com/royroyee/bvcni/pkg/config"
+	"github.com/royroyee/bvcni/pkg/hostport"
 	ipa "github.com/royroyee/bvcni/pkg/ip"
 	log "github.com/royroyee/bvcni/pkg/log"
 	"github.com/vishvananda/netlink"
 	"net"
+	"syscall"
 )
 
-const (
-	mtu = 1500
+// Steps of ADD that touch the system. They are variables so that tests can inject failures.
+var (
+	setUpBridge       = bridge.SetUpBridge
+	setupVethWithName = ip.SetupVethWithName
+	addrAdd           = netlink.AddrAdd
+	linkSetUp         = netlink.LinkSetUp
+	addDefaultRoute   = ip.AddDefaultRoute
+	linkSetMaster     = netlink.LinkSetMaster
+	setUpBandwidth    = bandwidth.SetUp
+	setUpHostPorts    = hostport.SetUp
 )
 
-func CmdAdd(args *skel.CmdArgs) error {
+// CmdAdd connects the container to cni0. If a step fails, everything the earlier steps
+// created (IP allocation, veth pair and the routes on it) is undone in reverse order.
+func CmdAdd(args *skel.CmdArgs) (err error) {
 
 	//// debug
 	log.Debugf("cmdAdd details: containerID = %s, netNs = %s, ifName = %s, args = %s, path = %s, stdin = %s",
@@ -32,65 +46,114 @@ func CmdAdd(args *skel.CmdArgs) error {
 		string(args.StdinData),
 	)
 
+	var rollback []func() error
+	defer func() {
+		if err == nil {
+			return
+		}
+		log.Debugf("CmdAdd failed, rolling back : %s", err.Error())
+		for i := len(rollback) - 1; i >= 0; i-- {
+			if rbErr := rollback[i](); rbErr != nil {
+				log.Debugf("CmdAdd rollback error : %s", rbErr.Error())
+			}
+		}
+	}()
+
 	// Load CNI config file (/etc/cni/net.d)
 	CNIConfig, err := config.LoadCNIConfig(args.StdinData)
 	if err != nil {
-		log.Debugf("LoadCNIConfig Error : %s", err.Error())
-		return err
+		return types.NewError(types.ErrDecodingFailure, "failed to load netconf", err.Error())
 	}
 
-	// Check if there is a bridge, and if it exists, update it; otherwise, create one.
-	br, err := bridge.SetUpBridge(CNIConfig.PodCidr)
+	if err = CNIConfig.ValidateIPAM(); err != nil {
+		return types.NewError(types.ErrInvalidNetworkConfig, "invalid ipam section", err.Error())
+	}
 
-	if err != nil || br == nil {
-		log.Debugf("Check Bridge Error : %s", err.Error())
+	if err = CNIConfig.Ranges.Validate(CNIConfig.PodCIDRs()); err != nil {
+		return types.NewError(types.ErrInvalidNetworkConfig, "invalid IP ranges", err.Error())
 	}
 
-	// obtain the pod IP and gateway IP addresses from the pod CIDR. During this process
-	// read from and write to the "tmp/reserved_ips" file, ensuring that the IP addresses do not overlap. (This approach is a very basic and simple method; a better approach would be to use the etcd-ipam method.)
-	podIP, gwIP, err := ipa.AllocateIPs(CNIConfig.PodCidr)
+	if err = CNIConfig.RuntimeConfig.Bandwidth.Validate(); err != nil {
+		return types.NewError(types.ErrInvalidNetworkConfig, "invalid bandwidth limits", err.Error())
+	}
+
+	if err = hostport.Validate(CNIConfig.RuntimeConfig.PortMappings); err != nil {
+		return types.NewError(types.ErrInvalidNetworkConfig, "invalid port mappings", err.Error())
+	}
+
+	// The bridge and both veth ends get the pod MTU, which leaves room for the VXLAN encapsulation
+	mtu := CNIConfig.PodMTU()
+
+	// Check if there is a bridge, and if it exists, update it; otherwise, create one.
+	br, err := setUpBridge(CNIConfig.PodCIDRs(), CNIConfig.Ranges, mtu)
 	if err != nil {
-		log.Debugf("Failed to process IPs: %v", err)
+		return types.NewError(types.ErrInternal, "failed to set up bridge", err.Error())
 	}
 
-	netns, err := ns.GetNS(args.Netns)
+	// obtain the pod IPs from the built-in allocator or the IPAM plugin of the "ipam" section.
+	ips, routes, release, err := addIPAM(CNIConfig, args)
+	if release != nil {
+		rollback = append(rollback, release)
+	}
 	if err != nil {
-		log.Debugf("GetNS Error %s ", err.Error())
 		return err
-
 	}
 
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return types.NewError(types.ErrInvalidEnvironmentVariables, fmt.Sprintf("failed to open netns %q", args.Netns), err.Error())
+	}
 	defer netns.Close()
 
-	if err = setUpVeth(netns, br, mtu, args.IfName, podIP, gwIP); err != nil {
-		log.Debugf("SetUpVethTest error")
-		return err
+	// Deleting the host end on rollback removes the container end and the routes on it as well.
+	hostIface, contIface, err := setUpVeth(netns, br, mtu, args.IfName, bridge.HostVethName(args.ContainerID, args.IfName), ips, routes, &rollback)
+	if err != nil {
+		return types.NewError(types.ErrInternal, "failed to set up veth", err.Error())
 	}
 
-	podIPAddr, _, err := net.ParseCIDR(podIP)
+	// Refetch the bridge, its MAC address may change when the first veth is attached.
+	brLink, err := netlink.LinkByName(br.Attrs().Name)
 	if err != nil {
-		log.Debugf("Invalid pod IP address: %s", podIP)
+		return types.NewError(types.ErrInternal, fmt.Sprintf("failed to lookup %q", br.Attrs().Name), err.Error())
 	}
 
-	gwIPNet, _, err := net.ParseCIDR(gwIP)
-	if err != nil {
-		log.Debugf("Invalid gateway IP address: %s", gwIP)
+	// Shape the pod traffic on the host side (kubernetes.io/ingress-bandwidth and egress-bandwidth)
+	if limits := CNIConfig.RuntimeConfig.Bandwidth; !limits.IsZero() {
+		ifbName := bandwidth.IfbName(args.ContainerID, args.IfName)
+		rollback = append(rollback, func() error {
+			return bandwidth.TearDown(ifbName)
+		})
+		if err = setUpBandwidth(hostIface.Name, ifbName, mtu, limits); err != nil {
+			return types.NewError(types.ErrInternal, "failed to set up bandwidth limits", err.Error())
+		}
+	}
+
+	// DNAT the hostPorts of the pod to it (portMappings)
+	if mappings := CNIConfig.RuntimeConfig.PortMappings; len(mappings) > 0 {
+		rollback = append(rollback, func() error {
+			return tearDownHostPorts(args.ContainerID, args.IfName)
+		})
+		if err = setUpHostPorts(args.ContainerID, args.IfName, addressesOf(ips), mappings); err != nil {
+			return types.NewError(types.ErrInternal, "failed to set up host ports", err.Error())
+		}
 	}
 
+	// Interfaces are listed as bridge, host veth, container interface; each IP points at the container interface.
 	result := &current.Result{
-		CNIVersion: "0.3.1",
-		IPs: []*current.IPConfig{
+		CNIVersion: current.ImplementedSpecVersion,
+		Interfaces: []*current.Interface{
 			{
-				Address: net.IPNet{
-					IP:   podIPAddr,
-					Mask: net.CIDRMask(24, 32), // 255.255.255.0
-				},
-				Gateway: gwIPNet,
+				Name: brLink.Attrs().Name,
+				Mac:  brLink.Attrs().HardwareAddr.String(),
 			},
+			hostIface,
+			contIface,
 		},
+		IPs:    ips,
+		Routes: routes,
 	}
 
-	resultBytes, err := json.Marshal(result)
+	resultBytes, _ := json.Marshal(result)
 	log.Debugf("CmdAdd completion : %s", string(resultBytes))
 
 	return types.PrintResult(result, CNIConfig.CNIVersion)
@@ -101,16 +164,25 @@ func CmdAdd(args *skel.CmdArgs) error {
 // These veth pairs should be manipulated within their respective namespaces.
 // Here, bvcni follows an approach where we create a veth pair in the container network namespace and move one end to the host network namespace.
 // Conversely, it is also possible to create a veth pair in the host network namespace and move one end to the container.
-func setUpVeth(netns ns.NetNS, br netlink.Link, mtu int, ifName string, podIP string, gatewayIpaddr string) error {
+// It returns the host and container interfaces for the CNI result, and registers the deletion of the veth pair in rollback once it exists.
+func setUpVeth(netns ns.NetNS, br netlink.Link, mtu int, ifName string, hostVethName string, ips []*current.IPConfig, routes []*types.Route, rollback *[]func() error) (*current.Interface, *current.Interface, error) {
 	hostIface := &current.Interface{}
+	contIface := &current.Interface{}
 	// Set up the veth interface inside the container network namespace.
 	err := netns.Do(func(hostNS ns.NetNS) error {
 		// Create the veth pair in the container and move host end into host netns.
-		hostVeth, containerVeth, err := ip.SetupVeth(ifName, mtu, "", hostNS)
+		hostVeth, containerVeth, err := setupVethWithName(ifName, hostVethName, mtu, "", hostNS)
 		if err != nil {
 			return fmt.Errorf("failed to setup veth with ifName %q: %w", ifName, err)
 		}
+		// Rollback runs in the host netns, where the host end lives now.
+		*rollback = append(*rollback, func() error {
+			return ip.DelLinkByName(hostVethName)
+		})
 		hostIface.Name = hostVeth.Name
+		contIface.Name = containerVeth.Name
+		contIface.Mac = containerVeth.HardwareAddr.String()
+		contIface.Sandbox = netns.Path()
 
 		// Get the link for the container veth.
 		conLink, err := netlink.LinkByName(containerVeth.Name)
@@ -118,53 +190,112 @@ func setUpVeth(netns ns.NetNS, br netlink.Link, mtu int, ifName string, podIP st
 			return fmt.Errorf("failed to get link by name %q: %w", containerVeth.Name, err)
 		}
 
-		// Parse the pod IP.
-		ipaddr, ipnet, err := net.ParseCIDR(podIP)
-		if err != nil {
-			return fmt.Errorf("failed to parse pod IP %q: %w", podIP, err)
-		}
-		ipnet.IP = ipaddr
+		// Add the addresses to the container link.
+		for _, ipc := range ips {
+			addr := &netlink.Addr{IPNet: &net.IPNet{IP: ipc.Address.IP, Mask: ipc.Address.Mask}}
+			if ipc.Address.IP.To4() == nil {
+				// Runtimes may leave IPv6 disabled in the sandbox.
+				if _, err = sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/disable_ipv6", ifName), "0"); err != nil {
+					return fmt.Errorf("failed to enable IPv6 on %q: %w", ifName, err)
+				}
+				// The address is unique in the pod CIDR, skip duplicate address detection.
+				addr.Flags = syscall.IFA_F_NODAD
+			}
 
-		// Add the address to the container link.
-		if err = netlink.AddrAdd(conLink, &netlink.Addr{IPNet: ipnet}); err != nil {
-			return fmt.Errorf("failed to add address %q: %w", ipnet, err)
+			if err = addrAdd(conLink, addr); err != nil {
+				return fmt.Errorf("failed to add address %q: %w", addr.IPNet, err)
+			}
 		}
 
 		// Set up the container link.
-		if err = netlink.LinkSetUp(conLink); err != nil {
+		if err = linkSetUp(conLink); err != nil {
 			return fmt.Errorf("failed to setup link %q: %w", conLink, err)
 		}
 
-		// Parse the gateway IP address.
-		gateway, _, err := net.ParseCIDR(gatewayIpaddr)
-		if err != nil {
-			return fmt.Errorf("failed to parse gateway IP address %q: %w", gatewayIpaddr, err)
-		}
+		// Add the routes in the container. ( ex. ip netns exec ns1 ip route add default via 10.244.2.1 )
+		for _, route := range routes {
+			gw := route.GW
+			if gw == nil {
+				gw = gatewayOf(ips, route.Dst.IP)
+			}
 
-		// Add the default route in the container. ( ex. ip netns exec ns1 ip route add default via 10.244.2.1 )
-		if err = ip.AddDefaultRoute(gateway, conLink); err != nil {
-			return fmt.Errorf("failed to add default route with gateway %q: %w", gateway, err)
+			if ones, _ := route.Dst.Mask.Size(); ones == 0 {
+				err = addDefaultRoute(gw, conLink)
+			} else {
+				err = ip.AddRoute(&route.Dst, gw, conLink)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to add route %s via %q: %w", route.Dst.String(), gw, err)
+			}
 		}
 		return nil
 	})
 
 	if err != nil {
-		return fmt.Errorf("failed to set up veth in netns: %w", err)
+		return nil, nil, fmt.Errorf("failed to set up veth in netns: %w", err)
 	}
 
 	// Lookup the host veth as its index may have changed during ns move.
 	hostVeth, err := netlink.LinkByName(hostIface.Name)
 	if err != nil {
-		return fmt.Errorf("failed to lookup %q: %w", hostIface.Name, err)
+		return nil, nil, fmt.Errorf("failed to lookup %q: %w", hostIface.Name, err)
 	}
 
 	if hostVeth == nil {
-		return fmt.Errorf("host veth is nil")
+		return nil, nil, fmt.Errorf("host veth is nil")
 	}
 
 	// Connect host veth end to the bridge.
-	if err = netlink.LinkSetMaster(hostVeth, br); err != nil {
-		return fmt.Errorf("failed to connect %q to bridge %v: %w", hostVeth.Attrs().Name, br.Attrs().Name, err)
+	if err = linkSetMaster(hostVeth, br); err != nil {
+		return nil, nil, fmt.Errorf("failed to connect %q to bridge %v: %w", hostVeth.Attrs().Name, br.Attrs().Name, err)
+	}
+	hostIface.Mac = hostVeth.Attrs().HardwareAddr.String()
+
+	return hostIface, contIface, nil
+}
+
+// ipConfigs converts the IPAM allocations to the IPs of the CNI result and a default route per IP family.
+// Each IP points at the container interface (Interfaces[2]).
+func ipConfigs(allocs []ipa.AllocatedIP) ([]*current.IPConfig, []*types.Route, error) {
+	var ips []*current.IPConfig
+	for _, alloc := range allocs {
+		podIPAddr, podIPNet, err := net.ParseCIDR(alloc.Address)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid pod IP address %q: %w", alloc.Address, err)
+		}
+
+		gwIPAddr, _, err := net.ParseCIDR(alloc.Gateway)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid gateway IP address %q: %w", alloc.Gateway, err)
+		}
+
+		ips = append(ips, &current.IPConfig{
+			Interface: current.Int(2),
+			Address:   net.IPNet{IP: podIPAddr, Mask: podIPNet.Mask},
+			Gateway:   gwIPAddr,
+		})
+	}
+
+	return ips, defaultRoutes(ips), nil
+}
+
+// addressesOf returns the pod IPs of the IP configs.
+func addressesOf(ips []*current.IPConfig) []net.IP {
+	var addrs []net.IP
+	for _, ipc := range ips {
+		addrs = append(addrs, ipc.Address.IP)
 	}
+
+	return addrs
+}
+
+// gatewayOf returns the gateway of the IP with the same family as dst.
+func gatewayOf(ips []*current.IPConfig, dst net.IP) net.IP {
+	for _, ipc := range ips {
+		if (ipc.Address.IP.To4() == nil) == (dst.To4() == nil) {
+			return ipc.Gateway
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,746 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/royroyee/bvcni/pkg/bandwidth"
+	"github.com/royroyee/bvcni/pkg/bridge"
+	"github.com/royroyee/bvcni/pkg/hostport"
+	ipa "github.com/royroyee/bvcni/pkg/ip"
+	"github.com/royroyee/bvcni/pkg/log"
+	"github.com/vishvananda/netlink"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	testContainerID = "test-container"
+	testIfName      = "eth0"
+)
+
+var errInjected = errors.New("injected failure")
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "bvcni-log")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	log.InitLogger(filepath.Join(dir, "bvcni.log"))
+	os.Exit(m.Run())
+}
+
+// testEnv is a fake node: hostNS plays the host network namespace (cni0 and host veths live
+// there) and podNS is the pod sandbox.
+type testEnv struct {
+	hostNS  ns.NetNS
+	podNS   ns.NetNS
+	dataDir string
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	if os.Geteuid() != 0 {
+		t.Skip("netns tests must run as root")
+	}
+
+	hostNS, err := testutils.NewNS()
+	if err != nil {
+		t.Fatalf("NewNS: %v", err)
+	}
+	podNS, err := testutils.NewNS()
+	if err != nil {
+		t.Fatalf("NewNS: %v", err)
+	}
+
+	t.Cleanup(func() {
+		hostNS.Close()
+		podNS.Close()
+		testutils.UnmountNS(hostNS)
+		testutils.UnmountNS(podNS)
+	})
+
+	return &testEnv{hostNS: hostNS, podNS: podNS, dataDir: t.TempDir()}
+}
+
+func (e *testEnv) args(podCidr string) *skel.CmdArgs {
+	conf := fmt.Sprintf(`{"cniVersion":"1.0.0","name":"bvcni","type":"bvcni","podcidr":%q,"dataDir":%q}`, podCidr, e.dataDir)
+	return &skel.CmdArgs{
+		ContainerID: testContainerID,
+		Netns:       e.podNS.Path(),
+		IfName:      testIfName,
+		StdinData:   []byte(conf),
+	}
+}
+
+func (e *testEnv) add(t *testing.T, args *skel.CmdArgs) error {
+	var addErr error
+	if err := e.hostNS.Do(func(_ ns.NetNS) error {
+		_, _, addErr = testutils.CmdAddWithArgs(args, func() error { return CmdAdd(args) })
+		return nil
+	}); err != nil {
+		t.Fatalf("hostNS.Do: %v", err)
+	}
+	return addErr
+}
+
+// assertClean checks that nothing of the container is left: no allocation, no host veth, no container interface.
+func (e *testEnv) assertClean(t *testing.T) {
+	t.Helper()
+
+	store, err := ipa.NewStore(e.dataDir)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	allocs, err := store.Get(testContainerID, testIfName)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if len(allocs) != 0 {
+		t.Errorf("allocations %+v were not released", allocs)
+	}
+
+	_ = e.hostNS.Do(func(_ ns.NetNS) error {
+		if _, err := netlink.LinkByName(bridge.HostVethName(testContainerID, testIfName)); err == nil {
+			t.Errorf("host veth was not deleted")
+		}
+		return nil
+	})
+
+	_ = e.podNS.Do(func(_ ns.NetNS) error {
+		if _, err := netlink.LinkByName(testIfName); err == nil {
+			t.Errorf("container interface was not deleted")
+		}
+		return nil
+	})
+}
+
+func assertCNIError(t *testing.T, err error) {
+	t.Helper()
+
+	if err == nil {
+		t.Fatalf("expected ADD to fail")
+	}
+	var cniErr *types.Error
+	if !errors.As(err, &cniErr) {
+		t.Fatalf("expected a CNI error, got %T: %v", err, err)
+	}
+}
+
+func TestCmdAddRollback(t *testing.T) {
+	tests := []struct {
+		name   string
+		inject func()
+	}{
+		{
+			name: "bridge",
+			inject: func() {
+				setUpBridge = func([]string, ipa.Ranges, int) (*netlink.Bridge, error) { return nil, errInjected }
+			},
+		},
+		{
+			name: "veth",
+			inject: func() {
+				setupVethWithName = func(string, string, int, string, ns.NetNS) (net.Interface, net.Interface, error) {
+					return net.Interface{}, net.Interface{}, errInjected
+				}
+			},
+		},
+		{
+			name: "address",
+			inject: func() {
+				addrAdd = func(netlink.Link, *netlink.Addr) error { return errInjected }
+			},
+		},
+		{
+			name: "link up",
+			inject: func() {
+				linkSetUp = func(netlink.Link) error { return errInjected }
+			},
+		},
+		{
+			name: "default route",
+			inject: func() {
+				addDefaultRoute = func(net.IP, netlink.Link) error { return errInjected }
+			},
+		},
+		{
+			name: "bridge port",
+			inject: func() {
+				linkSetMaster = func(netlink.Link, netlink.Link) error { return errInjected }
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+
+			origBridge, origVeth, origAddr := setUpBridge, setupVethWithName, addrAdd
+			origLinkUp, origRoute, origMaster := linkSetUp, addDefaultRoute, linkSetMaster
+			defer func() {
+				setUpBridge, setupVethWithName, addrAdd = origBridge, origVeth, origAddr
+				linkSetUp, addDefaultRoute, linkSetMaster = origLinkUp, origRoute, origMaster
+			}()
+			tt.inject()
+
+			assertCNIError(t, env.add(t, env.args("10.244.1.0/24")))
+			env.assertClean(t)
+		})
+	}
+}
+
+func TestCmdAddNoAvailableIP(t *testing.T) {
+	env := newTestEnv(t)
+
+	// 10.244.1.0/30 has a gateway and a single pod address, which is already taken.
+	store, err := ipa.NewStore(env.dataDir)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	if _, err = store.AllocateIPs([]string{"10.244.1.0/30"}, "other-container", testIfName); err != nil {
+		t.Fatalf("AllocateIPs: %v", err)
+	}
+
+	assertCNIError(t, env.add(t, env.args("10.244.1.0/30")))
+	env.assertClean(t)
+}
+
+func TestCmdAddMissingNetns(t *testing.T) {
+	env := newTestEnv(t)
+
+	args := env.args("10.244.1.0/24")
+	args.Netns = filepath.Join(t.TempDir(), "missing")
+
+	assertCNIError(t, env.add(t, args))
+	env.assertClean(t)
+}
+
+func TestCmdAddDel(t *testing.T) {
+	// The result is printed in the cniVersion of the config; 0.3.x and 0.4.0 results carry the interfaces as well.
+	for _, cniVersion := range []string{"1.0.0", "0.4.0", "0.3.1"} {
+		t.Run(cniVersion, func(t *testing.T) {
+			env := newTestEnv(t)
+
+			args := env.args("10.244.1.0/24")
+			args.StdinData = []byte(strings.Replace(string(args.StdinData), `"cniVersion":"1.0.0"`, fmt.Sprintf(`"cniVersion":%q`, cniVersion), 1))
+
+			var r types.Result
+			var out []byte
+			if err := env.hostNS.Do(func(_ ns.NetNS) error {
+				var err error
+				r, out, err = testutils.CmdAddWithArgs(args, func() error { return CmdAdd(args) })
+				return err
+			}); err != nil {
+				t.Fatalf("CmdAdd: %v", err)
+			}
+
+			if r.Version() != cniVersion || !strings.Contains(string(out), fmt.Sprintf(`"cniVersion": %q`, cniVersion)) {
+				t.Fatalf("expected a %s result, got %s", cniVersion, out)
+			}
+			result, err := current.GetResult(r)
+			if err != nil {
+				t.Fatalf("GetResult: %v", err)
+			}
+
+			// bridge, host veth, container interface
+			if len(result.Interfaces) != 3 {
+				t.Fatalf("expected 3 interfaces, got %+v", result.Interfaces)
+			}
+			expectIface := func(iface *current.Interface, netNS ns.NetNS, name, sandbox string) {
+				if iface.Name != name || iface.Sandbox != sandbox {
+					t.Errorf("expected interface %s in %q, got %+v", name, sandbox, iface)
+				}
+				_ = netNS.Do(func(_ ns.NetNS) error {
+					link, err := netlink.LinkByName(name)
+					if err != nil {
+						t.Fatalf("LinkByName %s: %v", name, err)
+					}
+					if mac := link.Attrs().HardwareAddr.String(); iface.Mac == "" || iface.Mac != mac {
+						t.Errorf("expected MAC %s for %s, got %q", mac, name, iface.Mac)
+					}
+					return nil
+				})
+			}
+			expectIface(result.Interfaces[0], env.hostNS, bridge.BridgeName, "")
+			expectIface(result.Interfaces[1], env.hostNS, bridge.HostVethName(testContainerID, testIfName), "")
+			expectIface(result.Interfaces[2], env.podNS, testIfName, env.podNS.Path())
+
+			if len(result.IPs) != 1 || result.IPs[0].Address.String() != "10.244.1.2/24" || !result.IPs[0].Gateway.Equal(net.ParseIP("10.244.1.1")) {
+				t.Fatalf("unexpected IPs %v", result.IPs)
+			}
+			if result.IPs[0].Interface == nil || *result.IPs[0].Interface != 2 {
+				t.Errorf("expected the IP to point at the container interface (2), got %v", result.IPs[0].Interface)
+			}
+
+			// DEL twice: the second one must succeed although everything is gone.
+			for i := 0; i < 2; i++ {
+				if err := env.hostNS.Do(func(_ ns.NetNS) error {
+					return testutils.CmdDelWithArgs(args, func() error { return CmdDel(args) })
+				}); err != nil {
+					t.Fatalf("CmdDel: %v", err)
+				}
+			}
+
+			env.assertClean(t)
+		})
+	}
+}
+
+func TestCmdAddMTU(t *testing.T) {
+	env := newTestEnv(t)
+
+	// cni0 of an earlier version, with the default MTU
+	if err := env.hostNS.Do(func(_ ns.NetNS) error {
+		br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridge.BridgeName, MTU: 1500}}
+		if err := netlink.LinkAdd(br); err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(br)
+	}); err != nil {
+		t.Fatalf("LinkAdd: %v", err)
+	}
+
+	args := env.args("10.244.1.0/24")
+	args.StdinData = []byte(strings.TrimSuffix(string(args.StdinData), "}") + `,"mtu":1450}`)
+	if err := env.add(t, args); err != nil {
+		t.Fatalf("CmdAdd: %v", err)
+	}
+
+	expectMTU := func(netNS ns.NetNS, name string) {
+		_ = netNS.Do(func(_ ns.NetNS) error {
+			link, err := netlink.LinkByName(name)
+			if err != nil {
+				t.Fatalf("LinkByName %s: %v", name, err)
+			}
+			if mtu := link.Attrs().MTU; mtu != 1450 {
+				t.Errorf("expected MTU 1450 on %s, got %d", name, mtu)
+			}
+			return nil
+		})
+	}
+
+	expectMTU(env.hostNS, bridge.BridgeName)
+	expectMTU(env.hostNS, bridge.HostVethName(testContainerID, testIfName))
+	expectMTU(env.podNS, testIfName)
+}
+
+func TestCmdAddDualStack(t *testing.T) {
+	env := newTestEnv(t)
+
+	args := env.args("10.244.1.0/24")
+	args.StdinData = []byte(fmt.Sprintf(`{"cniVersion":"1.0.0","name":"bvcni","type":"bvcni","podcidr":"10.244.1.0/24","podcidrs":["10.244.1.0/24","fd00:10:244:1::/64"],"dataDir":%q}`, env.dataDir))
+
+	var result types.Result
+	if err := env.hostNS.Do(func(_ ns.NetNS) error {
+		var err error
+		result, _, err = testutils.CmdAddWithArgs(args, func() error { return CmdAdd(args) })
+		return err
+	}); err != nil {
+		t.Fatalf("CmdAdd: %v", err)
+	}
+
+	res, err := current.GetResult(result)
+	if err != nil {
+		t.Fatalf("GetResult: %v", err)
+	}
+	if len(res.IPs) != 2 || res.IPs[0].Address.String() != "10.244.1.2/24" || res.IPs[1].Address.String() != "fd00:10:244:1::2/64" {
+		t.Fatalf("unexpected IPs %v", res.IPs)
+	}
+
+	_ = env.podNS.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(testIfName)
+		if err != nil {
+			t.Fatalf("container interface not created: %v", err)
+		}
+
+		routes, err := netlink.RouteList(link, netlink.FAMILY_V6)
+		if err != nil {
+			t.Fatalf("RouteList: %v", err)
+		}
+		if !hasDefaultRoute(routes, net.ParseIP("fd00:10:244:1::1")) {
+			t.Errorf("IPv6 default route via the gateway not found in %v", routes)
+		}
+		return nil
+	})
+
+	_ = env.hostNS.Do(func(_ ns.NetNS) error {
+		br, err := netlink.LinkByName("cni0")
+		if err != nil {
+			t.Fatalf("bridge not created: %v", err)
+		}
+
+		addrs, err := netlink.AddrList(br, netlink.FAMILY_V6)
+		if err != nil {
+			t.Fatalf("AddrList: %v", err)
+		}
+		for _, addr := range addrs {
+			if addr.IPNet.String() == "fd00:10:244:1::1/64" {
+				return nil
+			}
+		}
+		t.Errorf("IPv6 gateway address not found on the bridge: %v", addrs)
+		return nil
+	})
+}
+
+func TestCmdAddStaticIP(t *testing.T) {
+	env := newTestEnv(t)
+
+	kubeconfig := filepath.Join(t.TempDir(), "bvcni.kubeconfig")
+	if err := os.WriteFile(kubeconfig, nil, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	annotations := map[string]map[string]string{
+		"web":    {staticIPAnnotationKey: "10.244.1.50"},
+		"copy":   {staticIPAnnotationKey: "10.244.1.50"},
+		"remote": {staticIPAnnotationKey: "10.244.2.50"},
+		"broken": {staticIPAnnotationKey: "10.244.1.x"},
+	}
+	orig := getPod
+	getPod = func(_, namespace, name string) (*coreV1.Pod, error) {
+		return &coreV1.Pod{ObjectMeta: metaV1.ObjectMeta{Namespace: namespace, Name: name, Annotations: annotations[name]}}, nil
+	}
+	defer func() { getPod = orig }()
+
+	podArgs := func(containerID, podName string) *skel.CmdArgs {
+		args := env.args("10.244.1.0/24")
+		args.ContainerID = containerID
+		args.Args = "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=" + podName
+		args.StdinData = []byte(fmt.Sprintf(`{"cniVersion":"1.0.0","name":"bvcni","type":"bvcni","podcidr":"10.244.1.0/24","dataDir":%q,"kubeconfig":%q}`,
+			env.dataDir, kubeconfig))
+		return args
+	}
+
+	var result types.Result
+	args := podArgs(testContainerID, "web")
+	if err := env.hostNS.Do(func(_ ns.NetNS) error {
+		var err error
+		result, _, err = testutils.CmdAddWithArgs(args, func() error { return CmdAdd(args) })
+		return err
+	}); err != nil {
+		t.Fatalf("CmdAdd: %v", err)
+	}
+
+	res, err := current.GetResult(result)
+	if err != nil {
+		t.Fatalf("GetResult: %v", err)
+	}
+	if len(res.IPs) != 1 || res.IPs[0].Address.String() != "10.244.1.50/24" {
+		t.Fatalf("expected the annotated IP 10.244.1.50/24, got %v", res.IPs)
+	}
+
+	cases := []struct {
+		pod  string
+		code uint
+	}{
+		{"copy", ErrStaticIPInUse},
+		{"remote", ErrStaticIP},
+		{"broken", ErrStaticIP},
+	}
+	for _, c := range cases {
+		args := podArgs("container-"+c.pod, c.pod)
+		err := env.add(t, args)
+
+		var cniErr *types.Error
+		if !errors.As(err, &cniErr) || cniErr.Code != c.code {
+			t.Errorf("%s: expected CNI error code %d, got %v", c.pod, c.code, err)
+		}
+	}
+
+	// bvcnid has not written the kubeconfig yet: the pod is not handed a dynamic IP instead of its annotated one
+	if err = os.Remove(kubeconfig); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	var cniErr *types.Error
+	if err = env.add(t, podArgs("container-web-1", "web")); !errors.As(err, &cniErr) || cniErr.Code != types.ErrTryAgainLater {
+		t.Errorf("without kubeconfig: expected CNI error code %d, got %v", types.ErrTryAgainLater, err)
+	}
+}
+
+func TestCmdAddStickyIP(t *testing.T) {
+	env := newTestEnv(t)
+
+	kubeconfig := filepath.Join(t.TempDir(), "bvcni.kubeconfig")
+	if err := os.WriteFile(kubeconfig, nil, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	controller := true
+	orig := getPod
+	getPod = func(_, namespace, name string) (*coreV1.Pod, error) {
+		pod := &coreV1.Pod{ObjectMeta: metaV1.ObjectMeta{Namespace: namespace, Name: name}}
+		if name == "web-0" {
+			pod.OwnerReferences = []metaV1.OwnerReference{{Kind: "StatefulSet", Name: "web", Controller: &controller}}
+		}
+		return pod, nil
+	}
+	defer func() { getPod = orig }()
+
+	// Every pod gets its own netns
+	podArgs := func(containerID, podName string) *skel.CmdArgs {
+		podNS, err := testutils.NewNS()
+		if err != nil {
+			t.Fatalf("NewNS: %v", err)
+		}
+		t.Cleanup(func() {
+			podNS.Close()
+			testutils.UnmountNS(podNS)
+		})
+
+		args := env.args("10.244.1.0/24")
+		args.ContainerID = containerID
+		args.Netns = podNS.Path()
+		args.Args = "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=" + podName
+		args.StdinData = []byte(fmt.Sprintf(`{"cniVersion":"1.0.0","name":"bvcni","type":"bvcni","podcidr":"10.244.1.0/24","dataDir":%q,"kubeconfig":%q,"stickyIPGracePeriod":"10m"}`,
+			env.dataDir, kubeconfig))
+		return args
+	}
+
+	addIP := func(args *skel.CmdArgs) string {
+		var result types.Result
+		if err := env.hostNS.Do(func(_ ns.NetNS) error {
+			var err error
+			result, _, err = testutils.CmdAddWithArgs(args, func() error { return CmdAdd(args) })
+			return err
+		}); err != nil {
+			t.Fatalf("CmdAdd: %v", err)
+		}
+
+		res, err := current.GetResult(result)
+		if err != nil {
+			t.Fatalf("GetResult: %v", err)
+		}
+		return res.IPs[0].Address.String()
+	}
+
+	del := func(args *skel.CmdArgs) {
+		if err := env.hostNS.Do(func(_ ns.NetNS) error {
+			return testutils.CmdDelWithArgs(args, func() error { return CmdDel(args) })
+		}); err != nil {
+			t.Fatalf("CmdDel: %v", err)
+		}
+	}
+
+	// web-0 gets the second address, after a deployment pod that goes away
+	deployment := podArgs("deployment-a", "api-5d9c7")
+	addIP(deployment)
+	first := podArgs("web-0-a", "web-0")
+	sticky := addIP(first)
+	del(deployment)
+	del(first)
+
+	// A deployment pod is not sticky, its address is free again; the StatefulSet's is reserved.
+	if ip := addIP(podArgs("deployment-b", "api-7f6b2")); ip == sticky {
+		t.Fatalf("the address %s reserved for web-0 was handed out to another pod", sticky)
+	}
+
+	second := podArgs("web-0-b", "web-0")
+	if ip := addIP(second); ip != sticky {
+		t.Fatalf("expected web-0 to get %s back, got %s", sticky, ip)
+	}
+
+	// The pod and netns are recorded for bvcnid's garbage collection
+	store, err := ipa.NewStore(env.dataDir)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	allocs, err := store.Get(second.ContainerID, second.IfName)
+	if err != nil || len(allocs) != 1 {
+		t.Fatalf("expected one allocation for web-0, got %v (%v)", allocs, err)
+	}
+	if allocs[0].Pod != "default/web-0" || allocs[0].Netns != second.Netns {
+		t.Fatalf("expected pod default/web-0 and netns %s, got %q and %q", second.Netns, allocs[0].Pod, allocs[0].Netns)
+	}
+}
+
+func TestCmdAddBandwidth(t *testing.T) {
+	env := newTestEnv(t)
+
+	args := env.args("10.244.1.0/24")
+	conf := strings.TrimSuffix(string(args.StdinData), "}")
+	args.StdinData = []byte(conf + `,"runtimeConfig":{"bandwidth":{"ingressRate":1000000,"ingressBurst":2000000,"egressRate":2000000,"egressBurst":4000000}}}`)
+	if err := env.add(t, args); err != nil {
+		t.Fatalf("CmdAdd: %v", err)
+	}
+
+	ifbName := bandwidth.IfbName(testContainerID, testIfName)
+	_ = env.hostNS.Do(func(_ ns.NetNS) error {
+		// rate in bytes per second
+		expectTBF := func(name string, rate uint64) {
+			link, err := netlink.LinkByName(name)
+			if err != nil {
+				t.Fatalf("LinkByName %s: %v", name, err)
+			}
+			qdiscs, err := netlink.QdiscList(link)
+			if err != nil {
+				t.Fatalf("QdiscList %s: %v", name, err)
+			}
+			for _, qdisc := range qdiscs {
+				if tbf, ok := qdisc.(*netlink.Tbf); ok && tbf.Rate == rate {
+					return
+				}
+			}
+			t.Errorf("no tbf qdisc with rate %d on %s: %v", rate, name, qdiscs)
+		}
+
+		expectTBF(bridge.HostVethName(testContainerID, testIfName), 125000)
+		expectTBF(ifbName, 250000)
+		return nil
+	})
+
+	if err := env.hostNS.Do(func(_ ns.NetNS) error {
+		return testutils.CmdDelWithArgs(args, func() error { return CmdDel(args) })
+	}); err != nil {
+		t.Fatalf("CmdDel: %v", err)
+	}
+
+	_ = env.hostNS.Do(func(_ ns.NetNS) error {
+		if _, err := netlink.LinkByName(ifbName); err == nil {
+			t.Errorf("ifb device was not deleted")
+		}
+		return nil
+	})
+	env.assertClean(t)
+}
+
+func TestCmdAddInvalidBandwidth(t *testing.T) {
+	env := newTestEnv(t)
+
+	args := env.args("10.244.1.0/24")
+	conf := strings.TrimSuffix(string(args.StdinData), "}")
+	args.StdinData = []byte(conf + `,"runtimeConfig":{"bandwidth":{"egressRate":1000000}}}`)
+
+	assertCNIError(t, env.add(t, args))
+	env.assertClean(t)
+}
+
+func TestCmdAddBandwidthRollback(t *testing.T) {
+	env := newTestEnv(t)
+
+	origBandwidth := setUpBandwidth
+	defer func() { setUpBandwidth = origBandwidth }()
+	// Fail once the ifb device exists
+	setUpBandwidth = func(hostVethName, ifbName string, mtu int, limits *bandwidth.Limits) error {
+		if err := origBandwidth(hostVethName, ifbName, mtu, limits); err != nil {
+			return err
+		}
+		return errInjected
+	}
+
+	args := env.args("10.244.1.0/24")
+	conf := strings.TrimSuffix(string(args.StdinData), "}")
+	args.StdinData = []byte(conf + `,"runtimeConfig":{"bandwidth":{"egressRate":1000000,"egressBurst":1000000}}}`)
+
+	assertCNIError(t, env.add(t, args))
+	env.assertClean(t)
+	_ = env.hostNS.Do(func(_ ns.NetNS) error {
+		if _, err := netlink.LinkByName(bandwidth.IfbName(testContainerID, testIfName)); err == nil {
+			t.Errorf("ifb device was not deleted")
+		}
+		return nil
+	})
+}
+
+func TestCmdAddHostPorts(t *testing.T) {
+	env := newTestEnv(t)
+
+	origSetUp, origCheck, origTearDown := setUpHostPorts, checkHostPorts, tearDownHostPorts
+	defer func() { setUpHostPorts, checkHostPorts, tearDownHostPorts = origSetUp, origCheck, origTearDown }()
+
+	// The rules of each container, as installed by the fake iptables
+	installed := map[string]string{}
+	setUpHostPorts = func(containerID, ifName string, podIPs []net.IP, mappings []hostport.PortMapping) error {
+		installed[containerID] = fmt.Sprintf("%v %+v", podIPs, mappings)
+		return nil
+	}
+	checkHostPorts = func(containerID, ifName string, podIPs []net.IP, mappings []hostport.PortMapping) error {
+		if installed[containerID] != fmt.Sprintf("%v %+v", podIPs, mappings) {
+			return errInjected
+		}
+		return nil
+	}
+	tearDownHostPorts = func(containerID, ifName string) error {
+		delete(installed, containerID)
+		return nil
+	}
+
+	args := env.args("10.244.1.0/24")
+	conf := strings.TrimSuffix(string(args.StdinData), "}")
+	args.StdinData = []byte(conf + `,"runtimeConfig":{"portMappings":[{"hostPort":8080,"containerPort":80,"protocol":"tcp"}]}}`)
+
+	var r types.Result
+	var addErr error
+	_ = env.hostNS.Do(func(_ ns.NetNS) error {
+		r, _, addErr = testutils.CmdAddWithArgs(args, func() error { return CmdAdd(args) })
+		return nil
+	})
+	if addErr != nil {
+		t.Fatalf("CmdAdd: %v", addErr)
+	}
+	if expected := "[10.244.1.2] [{HostPort:8080 ContainerPort:80 Protocol:tcp HostIP:}]"; installed[testContainerID] != expected {
+		t.Fatalf("expected host ports %q, got %q", expected, installed[testContainerID])
+	}
+
+	// CHECK gets the result of ADD as prevResult
+	result, err := current.GetResult(r)
+	if err != nil {
+		t.Fatalf("GetResult: %v", err)
+	}
+	prevResult, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	checkArgs := *args
+	checkArgs.StdinData = []byte(strings.TrimSuffix(string(args.StdinData), "}") + `,"prevResult":` + string(prevResult) + `}`)
+	check := func() error {
+		return env.hostNS.Do(func(_ ns.NetNS) error {
+			return testutils.CmdCheckWithArgs(&checkArgs, func() error { return CmdCheck(&checkArgs) })
+		})
+	}
+	if err = check(); err != nil {
+		t.Fatalf("CmdCheck: %v", err)
+	}
+
+	rules := installed[testContainerID]
+	delete(installed, testContainerID)
+	var cniErr *types.Error
+	if err = check(); !errors.As(err, &cniErr) || cniErr.Code != ErrHostPort {
+		t.Fatalf("expected CHECK to fail with code %d, got %v", ErrHostPort, err)
+	}
+	installed[testContainerID] = rules
+
+	if err = env.hostNS.Do(func(_ ns.NetNS) error {
+		return testutils.CmdDelWithArgs(args, func() error { return CmdDel(args) })
+	}); err != nil {
+		t.Fatalf("CmdDel: %v", err)
+	}
+	if len(installed) != 0 {
+		t.Fatalf("host ports not deleted: %v", installed)
+	}
+	env.assertClean(t)
+
+	// Failing to install them rolls the ADD back
+	setUpHostPorts = func(containerID, ifName string, podIPs []net.IP, mappings []hostport.PortMapping) error {
+		installed[containerID] = "partial"
+		return errInjected
+	}
+	assertCNIError(t, env.add(t, args))
+	if len(installed) != 0 {
+		t.Fatalf("host ports not rolled back: %v", installed)
+	}
+	env.assertClean(t)
+}
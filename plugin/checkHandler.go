@@ -1,8 +1,216 @@
 package plugin
 
-import "github.com/containernetworking/cni/pkg/skel"
+import (
+	"fmt"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/royroyee/bvcni/pkg/bridge"
+	"github.com/royroyee/bvcni/pkg/config"
+	"github.com/royroyee/bvcni/pkg/hostport"
+	ipa "github.com/royroyee/bvcni/pkg/ip"
+	"github.com/royroyee/bvcni/pkg/log"
+	"github.com/vishvananda/netlink"
+	"net"
+)
+
+// Plugin specific error codes (the CNI spec reserves 0-99 for well known errors).
+const (
+	ErrContainerInterface uint = 100 + iota // container interface missing, or its IP/MAC drifted
+	ErrDefaultRoute                         // default route does not go through the cni0 gateway
+	ErrHostVeth                             // host veth missing or detached from the bridge
+	ErrAllocation                           // IPAM store lost the allocation
+	ErrStaticIP                             // invalid bvcni.io/ip annotation, or the IP is outside the node's pod CIDRs
+	ErrStaticIPInUse                        // the bvcni.io/ip address is allocated to another pod
+	ErrHostPort                             // host port rules missing from the bvcni chains
+)
+
+// checkHostPorts is a variable so that tests can run without iptables.
+var checkHostPorts = hostport.Check
+
+// CmdCheck verifies that the pod network still matches the result ADD returned.
+func CmdCheck(args *skel.CmdArgs) error {
+	//// debug
+	log.Debugf("cmdCheck details: containerID = %s, netNs = %s, ifName = %s, args = %s, path = %s, stdin = %s",
+		args.ContainerID,
+		args.Netns,
+		args.IfName,
+		args.Args,
+		args.Path,
+		string(args.StdinData),
+	)
+
+	CNIConfig, err := config.LoadCNIConfig(args.StdinData)
+	if err != nil {
+		return types.NewError(types.ErrDecodingFailure, "failed to load netconf", err.Error())
+	}
+
+	// CHECK was introduced in CNI 0.4.0
+	if ok, _ := version.GreaterThanOrEqualTo(CNIConfig.CNIVersion, "0.4.0"); !ok {
+		return types.NewError(types.ErrIncompatibleCNIVersion, "config version does not allow CHECK", CNIConfig.CNIVersion)
+	}
+
+	if CNIConfig.PrevResult == nil {
+		return types.NewError(types.ErrInvalidNetworkConfig, "required prevResult missing", "")
+	}
+
+	result, err := current.NewResultFromResult(CNIConfig.PrevResult)
+	if err != nil {
+		return types.NewError(types.ErrDecodingFailure, "failed to convert prevResult", err.Error())
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return types.NewError(types.ErrInvalidEnvironmentVariables, fmt.Sprintf("failed to open netns %q", args.Netns), err.Error())
+	}
+	defer netns.Close()
+
+	if err = netns.Do(func(_ ns.NetNS) error {
+		if err := checkContainerInterface(args.IfName, args.Netns, result); err != nil {
+			return err
+		}
+		return checkDefaultRoute(args.IfName, result)
+	}); err != nil {
+		return err
+	}
+
+	if err = checkHostVeth(bridge.HostVethName(args.ContainerID, args.IfName)); err != nil {
+		return err
+	}
+
+	if mappings := CNIConfig.RuntimeConfig.PortMappings; len(mappings) > 0 {
+		if err = checkHostPorts(args.ContainerID, args.IfName, addressesOf(result.IPs), mappings); err != nil {
+			return types.NewError(ErrHostPort, "host ports are not set up", err.Error())
+		}
+	}
+
+	return checkIPAM(CNIConfig, args, result)
+}
+
+// checkContainerInterface verifies the interface inside the pod netns: it must exist, carry
+// every IP of the result and, if the result recorded one, the same MAC address.
+func checkContainerInterface(ifName, netnsPath string, result *current.Result) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return types.NewError(ErrContainerInterface, fmt.Sprintf("container interface %q not found", ifName), err.Error())
+	}
+
+	for _, iface := range result.Interfaces {
+		if iface.Name != ifName || iface.Sandbox != netnsPath || iface.Mac == "" {
+			continue
+		}
+		if link.Attrs().HardwareAddr.String() != iface.Mac {
+			return types.NewError(ErrContainerInterface, fmt.Sprintf("container interface %q MAC mismatch", ifName),
+				fmt.Sprintf("expected %s, found %s", iface.Mac, link.Attrs().HardwareAddr))
+		}
+	}
+
+	if err = ip.ValidateExpectedInterfaceIPs(ifName, result.IPs); err != nil {
+		return types.NewError(ErrContainerInterface, fmt.Sprintf("container interface %q IP mismatch", ifName), err.Error())
+	}
 
-// TODO
-func CmdCheck(*skel.CmdArgs) error {
 	return nil
 }
+
+// checkDefaultRoute verifies that the pod's default route goes through the gateway (cni0) on ifName.
+func checkDefaultRoute(ifName string, result *current.Result) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return types.NewError(ErrContainerInterface, fmt.Sprintf("container interface %q not found", ifName), err.Error())
+	}
+
+	for _, ipc := range result.IPs {
+		if ipc.Gateway == nil {
+			continue
+		}
+
+		family := netlink.FAMILY_V4
+		if ipc.Gateway.To4() == nil {
+			family = netlink.FAMILY_V6
+		}
+
+		routes, err := netlink.RouteList(link, family)
+		if err != nil {
+			return types.NewError(ErrDefaultRoute, "failed to list routes", err.Error())
+		}
+
+		if !hasDefaultRoute(routes, ipc.Gateway) {
+			return types.NewError(ErrDefaultRoute, fmt.Sprintf("default route via %s not found on %q", ipc.Gateway, ifName), "")
+		}
+	}
+
+	return nil
+}
+
+func hasDefaultRoute(routes []netlink.Route, gw net.IP) bool {
+	for _, route := range routes {
+		if route.Dst != nil {
+			if ones, _ := route.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		if route.Gw.Equal(gw) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkHostVeth verifies that the host end of the veth pair still exists and is attached to cni0.
+func checkHostVeth(name string) error {
+	br, err := netlink.LinkByName(bridge.BridgeName)
+	if err != nil {
+		return types.NewError(ErrHostVeth, fmt.Sprintf("bridge %q not found", bridge.BridgeName), err.Error())
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return types.NewError(ErrHostVeth, fmt.Sprintf("host veth %q not found", name), err.Error())
+	}
+
+	if link.Attrs().MasterIndex != br.Attrs().Index {
+		return types.NewError(ErrHostVeth, fmt.Sprintf("host veth %q is not attached to %q", name, bridge.BridgeName), "")
+	}
+
+	return nil
+}
+
+// checkAllocation verifies that the IPAM store still holds the allocation for every IP of the result.
+func checkAllocation(dataDir, containerID, ifName string, result *current.Result) error {
+	store, err := ipa.NewStore(dataDir)
+	if err != nil {
+		return types.NewError(types.ErrIOFailure, "failed to open IPAM store", err.Error())
+	}
+
+	allocs, err := store.Get(containerID, ifName)
+	if err != nil {
+		return types.NewError(types.ErrIOFailure, "failed to read IPAM store", err.Error())
+	}
+
+	if len(allocs) == 0 {
+		return types.NewError(ErrAllocation, fmt.Sprintf("no IP allocated for container %s interface %s", containerID, ifName), "")
+	}
+
+	for _, ipc := range result.IPs {
+		if !isAllocated(allocs, ipc.Address.String()) {
+			return types.NewError(ErrAllocation, fmt.Sprintf("IP %s is not allocated to container %s", ipc.Address.String(), containerID),
+				fmt.Sprintf("the IPAM store holds %v", allocs))
+		}
+	}
+
+	return nil
+}
+
+func isAllocated(allocs []ipa.AllocatedIP, address string) bool {
+	for _, alloc := range allocs {
+		if alloc.Address == address {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,183 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/royroyee/bvcni/pkg/bridge"
+	"github.com/royroyee/bvcni/pkg/hostport"
+	ipa "github.com/royroyee/bvcni/pkg/ip"
+	"github.com/vishvananda/netlink"
+)
+
+// addResult runs ADD in the fake host and returns its result.
+func (e *testEnv) addResult(t *testing.T, args *skel.CmdArgs) *current.Result {
+	t.Helper()
+
+	var r types.Result
+	var addErr error
+	_ = e.hostNS.Do(func(_ ns.NetNS) error {
+		r, _, addErr = testutils.CmdAddWithArgs(args, func() error { return CmdAdd(args) })
+		return nil
+	})
+	if addErr != nil {
+		t.Fatalf("CmdAdd: %v", addErr)
+	}
+
+	result, err := current.GetResult(r)
+	if err != nil {
+		t.Fatalf("GetResult: %v", err)
+	}
+	return result
+}
+
+// check runs CHECK in the fake host with the result of ADD as prevResult.
+func (e *testEnv) check(t *testing.T, args *skel.CmdArgs, result *current.Result) error {
+	t.Helper()
+
+	prevResult, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	checkArgs := *args
+	checkArgs.StdinData = []byte(strings.TrimSuffix(string(args.StdinData), "}") + `,"prevResult":` + string(prevResult) + `}`)
+	return e.hostNS.Do(func(_ ns.NetNS) error {
+		return testutils.CmdCheckWithArgs(&checkArgs, func() error { return CmdCheck(&checkArgs) })
+	})
+}
+
+func TestCmdCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		code uint
+		// conf is appended to the network config
+		conf     string
+		breakNet func(t *testing.T, env *testEnv)
+	}{
+		{
+			name: "container address removed",
+			code: ErrContainerInterface,
+			breakNet: func(t *testing.T, env *testEnv) {
+				_ = env.podNS.Do(func(_ ns.NetNS) error {
+					link, err := netlink.LinkByName(testIfName)
+					if err != nil {
+						t.Fatalf("LinkByName: %v", err)
+					}
+					addr, _ := netlink.ParseAddr("10.244.1.2/24")
+					if err = netlink.AddrDel(link, addr); err != nil {
+						t.Fatalf("AddrDel: %v", err)
+					}
+					return nil
+				})
+			},
+		},
+		{
+			name: "container MAC changed",
+			code: ErrContainerInterface,
+			breakNet: func(t *testing.T, env *testEnv) {
+				_ = env.podNS.Do(func(_ ns.NetNS) error {
+					link, err := netlink.LinkByName(testIfName)
+					if err != nil {
+						t.Fatalf("LinkByName: %v", err)
+					}
+					mac, _ := net.ParseMAC("02:00:00:00:00:42")
+					if err = netlink.LinkSetHardwareAddr(link, mac); err != nil {
+						t.Fatalf("LinkSetHardwareAddr: %v", err)
+					}
+					return nil
+				})
+			},
+		},
+		{
+			name: "default route removed",
+			code: ErrDefaultRoute,
+			breakNet: func(t *testing.T, env *testEnv) {
+				_ = env.podNS.Do(func(_ ns.NetNS) error {
+					link, err := netlink.LinkByName(testIfName)
+					if err != nil {
+						t.Fatalf("LinkByName: %v", err)
+					}
+					route := &netlink.Route{LinkIndex: link.Attrs().Index, Gw: net.ParseIP("10.244.1.1")}
+					if err = netlink.RouteDel(route); err != nil {
+						t.Fatalf("RouteDel: %v", err)
+					}
+					return nil
+				})
+			},
+		},
+		{
+			name: "host veth detached",
+			code: ErrHostVeth,
+			breakNet: func(t *testing.T, env *testEnv) {
+				_ = env.hostNS.Do(func(_ ns.NetNS) error {
+					link, err := netlink.LinkByName(bridge.HostVethName(testContainerID, testIfName))
+					if err != nil {
+						t.Fatalf("LinkByName: %v", err)
+					}
+					if err = netlink.LinkSetNoMaster(link); err != nil {
+						t.Fatalf("LinkSetNoMaster: %v", err)
+					}
+					return nil
+				})
+			},
+		},
+		{
+			name: "allocation released",
+			code: ErrAllocation,
+			breakNet: func(t *testing.T, env *testEnv) {
+				store, err := ipa.NewStore(env.dataDir)
+				if err != nil {
+					t.Fatalf("NewStore: %v", err)
+				}
+				if err = store.ReturnIP(testContainerID, testIfName); err != nil {
+					t.Fatalf("ReturnIP: %v", err)
+				}
+			},
+		},
+		{
+			name: "host ports missing",
+			code: ErrHostPort,
+			conf: `,"runtimeConfig":{"portMappings":[{"hostPort":8080,"containerPort":80,"protocol":"tcp"}]}`,
+			breakNet: func(t *testing.T, env *testEnv) {
+				checkHostPorts = func(string, string, []net.IP, []hostport.PortMapping) error { return errInjected }
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+
+			// The host port rules are faked, CHECK finds them until the case breaks them
+			origSetUp, origCheck, origTearDown := setUpHostPorts, checkHostPorts, tearDownHostPorts
+			defer func() { setUpHostPorts, checkHostPorts, tearDownHostPorts = origSetUp, origCheck, origTearDown }()
+			setUpHostPorts = func(string, string, []net.IP, []hostport.PortMapping) error { return nil }
+			checkHostPorts = func(string, string, []net.IP, []hostport.PortMapping) error { return nil }
+			tearDownHostPorts = func(string, string) error { return nil }
+
+			args := env.args("10.244.1.0/24")
+			args.StdinData = []byte(strings.TrimSuffix(string(args.StdinData), "}") + tt.conf + `}`)
+			result := env.addResult(t, args)
+
+			if err := env.check(t, args, result); err != nil {
+				t.Fatalf("CmdCheck before breaking the pod network: %v", err)
+			}
+
+			tt.breakNet(t, env)
+
+			var cniErr *types.Error
+			if err := env.check(t, args, result); !errors.As(err, &cniErr) || cniErr.Code != tt.code {
+				t.Fatalf("expected CHECK to fail with code %d, got %v", tt.code, err)
+			}
+		})
+	}
+}
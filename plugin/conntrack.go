@@ -0,0 +1,105 @@
+package plugin
+
+import (
+	"fmt"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/royroyee/bvcni/pkg/config"
+	"github.com/vishvananda/netlink"
+	"net"
+	"strings"
+)
+
+// flushConntrack is a variable so that tests can check when DEL deletes the flows.
+var flushConntrack = delConntrack
+
+// podFlowFilter matches the conntrack flows that have one of the pod IPs as source or destination,
+// in the original or in the reply direction (ex. a NAT mapping of the MASQUERADE rule).
+type podFlowFilter struct {
+	ips []net.IP
+}
+
+func (f podFlowFilter) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	for _, ip := range f.ips {
+		if ip.Equal(flow.Forward.SrcIP) || ip.Equal(flow.Forward.DstIP) ||
+			ip.Equal(flow.Reverse.SrcIP) || ip.Equal(flow.Reverse.DstIP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// podIPs returns the addresses of the container interface: those of the prevResult, and for the built-in
+// allocator those of the IPAM store. It is called before the addresses are released.
+func podIPs(CNIConfig *config.CNIConfig, containerID, ifName string) ([]net.IP, error) {
+	var ips []net.IP
+	if CNIConfig.PrevResult != nil {
+		result, err := current.NewResultFromResult(CNIConfig.PrevResult)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert prevResult: %w", err)
+		}
+		for _, ipc := range result.IPs {
+			ips = append(ips, ipc.Address.IP)
+		}
+	}
+
+	if delegatesIPAM(CNIConfig) {
+		return ips, nil
+	}
+
+	store, err := openStore(CNIConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	allocs, err := store.Get(containerID, ifName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, alloc := range allocs {
+		ip, _, err := net.ParseCIDR(alloc.Address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allocation %q: %w", alloc.Address, err)
+		}
+		ips = append(ips, ip)
+	}
+
+	return ips, nil
+}
+
+// delConntrack deletes the conntrack entries of the pod IPs in the host network namespace, so that flows and
+// NAT mappings of a deleted pod do not apply to the next pod that gets the same address. It returns how many were deleted.
+func delConntrack(ips []net.IP) (uint, error) {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	var deleted uint
+	var errs []string
+	for _, family := range []struct {
+		family netlink.InetFamily
+		ips    []net.IP
+	}{{netlink.FAMILY_V4, v4}, {netlink.FAMILY_V6, v6}} {
+		if len(family.ips) == 0 {
+			continue
+		}
+
+		n, err := netlink.ConntrackDeleteFilter(netlink.ConntrackTable, family.family, podFlowFilter{ips: family.ips})
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %s", family.ips, err))
+		}
+		deleted += n
+	}
+
+	if len(errs) > 0 {
+		return deleted, fmt.Errorf("failed to delete conntrack entries of %s", strings.Join(errs, ", "))
+	}
+
+	return deleted, nil
+}
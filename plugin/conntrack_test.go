@@ -0,0 +1,157 @@
+package plugin
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	ipa "github.com/royroyee/bvcni/pkg/ip"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// ipctnlMsgCtNew creates a conntrack entry (IPCTNL_MSG_CT_NEW), which the vendored netlink cannot do.
+const ipctnlMsgCtNew = 0
+
+type testFlow struct {
+	origSrc, origDst   string
+	replySrc, replyDst string
+	sport, dport       uint16
+}
+
+// createFlow adds a UDP conntrack entry to the current network namespace, like the kernel does for the first packet.
+func createFlow(t *testing.T, f testFlow) {
+	t.Helper()
+
+	tuple := func(attrType int, src, dst string, sport, dport uint16) *nl.RtAttr {
+		ip := nl.NewRtAttr(nl.CTA_TUPLE_IP|int(nl.NLA_F_NESTED), nil)
+		ip.AddRtAttr(nl.CTA_IP_V4_SRC, net.ParseIP(src).To4())
+		ip.AddRtAttr(nl.CTA_IP_V4_DST, net.ParseIP(dst).To4())
+
+		proto := nl.NewRtAttr(nl.CTA_TUPLE_PROTO|int(nl.NLA_F_NESTED), nil)
+		proto.AddRtAttr(nl.CTA_PROTO_NUM, []byte{unix.IPPROTO_UDP})
+		proto.AddRtAttr(nl.CTA_PROTO_SRC_PORT, binary.BigEndian.AppendUint16(nil, sport))
+		proto.AddRtAttr(nl.CTA_PROTO_DST_PORT, binary.BigEndian.AppendUint16(nil, dport))
+
+		attr := nl.NewRtAttr(attrType|int(nl.NLA_F_NESTED), nil)
+		attr.AddChild(ip)
+		attr.AddChild(proto)
+		return attr
+	}
+
+	req := nl.NewNetlinkRequest(int(netlink.ConntrackTable)<<8|ipctnlMsgCtNew, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK)
+	req.AddData(&nl.Nfgenmsg{NfgenFamily: unix.AF_INET, Version: nl.NFNETLINK_V0})
+	req.AddData(tuple(nl.CTA_TUPLE_ORIG, f.origSrc, f.origDst, f.sport, f.dport))
+	req.AddData(tuple(nl.CTA_TUPLE_REPLY, f.replySrc, f.replyDst, f.dport, f.sport))
+	req.AddData(nl.NewRtAttr(nl.CTA_TIMEOUT, binary.BigEndian.AppendUint32(nil, 300)))
+
+	if _, err := req.Execute(unix.NETLINK_NETFILTER, 0); err != nil {
+		t.Skipf("cannot create conntrack entries: %v", err)
+	}
+}
+
+func TestCmdDelConntrack(t *testing.T) {
+	env := newTestEnv(t)
+
+	args := env.args("10.244.1.0/24")
+	if err := env.add(t, args); err != nil {
+		t.Fatalf("CmdAdd: %v", err)
+	}
+
+	const podIP = "10.244.1.2"
+	flows := []testFlow{
+		// pod -> internet, masqueraded to the node IP
+		{origSrc: podIP, origDst: "1.1.1.1", replySrc: "1.1.1.1", replyDst: "192.168.0.10", sport: 40000, dport: 53},
+		// client -> service IP, DNATed to the pod
+		{origSrc: "10.244.2.5", origDst: "10.96.0.10", replySrc: podIP, replyDst: "10.244.2.5", sport: 40001, dport: 53},
+		// another pod
+		{origSrc: "10.244.1.3", origDst: "1.1.1.1", replySrc: "1.1.1.1", replyDst: "192.168.0.10", sport: 40002, dport: 53},
+	}
+	_ = env.hostNS.Do(func(_ ns.NetNS) error {
+		for _, f := range flows {
+			createFlow(t, f)
+		}
+		return nil
+	})
+
+	if err := env.hostNS.Do(func(_ ns.NetNS) error {
+		return testutils.CmdDelWithArgs(args, func() error { return CmdDel(args) })
+	}); err != nil {
+		t.Fatalf("CmdDel: %v", err)
+	}
+
+	_ = env.hostNS.Do(func(_ ns.NetNS) error {
+		left, err := netlink.ConntrackTableList(netlink.ConntrackTable, netlink.FAMILY_V4)
+		if err != nil {
+			t.Fatalf("ConntrackTableList: %v", err)
+		}
+
+		if len(left) != 1 || left[0].Forward.SrcIP.String() != "10.244.1.3" {
+			for _, flow := range left {
+				t.Logf("left: %s", flow)
+			}
+			t.Fatalf("expected only the flow of 10.244.1.3 to be left, got %d flows", len(left))
+		}
+		return nil
+	})
+
+	env.assertClean(t)
+}
+
+func TestPodFlowFilter(t *testing.T) {
+	filter := podFlowFilter{ips: []net.IP{net.ParseIP("fd00:10:244:1::2")}}
+
+	flow := &netlink.ConntrackFlow{}
+	flow.Forward.SrcIP = net.ParseIP("fd00:10:244:2::5")
+	flow.Forward.DstIP = net.ParseIP("fd00:10:96::10")
+	flow.Reverse.SrcIP = net.ParseIP("fd00:10:244:1::2")
+	flow.Reverse.DstIP = net.ParseIP("fd00:10:244:2::5")
+	if !filter.MatchConntrackFlow(flow) {
+		t.Errorf("expected the DNATed flow of the pod to match")
+	}
+
+	flow.Reverse.SrcIP = net.ParseIP("fd00:10:244:1::3")
+	if filter.MatchConntrackFlow(flow) {
+		t.Errorf("expected the flow of another pod not to match")
+	}
+}
+
+func TestCmdDelConntrackBeforeRelease(t *testing.T) {
+	env := newTestEnv(t)
+
+	args := env.args("10.244.1.0/24")
+	if err := env.add(t, args); err != nil {
+		t.Fatalf("CmdAdd: %v", err)
+	}
+
+	store, err := ipa.NewStore(env.dataDir)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+
+	// A parallel ADD could get the address as soon as it is released, so the flows must be gone by then
+	orig := flushConntrack
+	defer func() { flushConntrack = orig }()
+	var flushed []net.IP
+	flushConntrack = func(ips []net.IP) (uint, error) {
+		flushed = ips
+		if allocs, err := store.Get(testContainerID, testIfName); err != nil || len(allocs) != 1 {
+			t.Errorf("expected the allocation to be held while the flows are deleted, got %v (%v)", allocs, err)
+		}
+		return 0, nil
+	}
+
+	if err = env.hostNS.Do(func(_ ns.NetNS) error {
+		return testutils.CmdDelWithArgs(args, func() error { return CmdDel(args) })
+	}); err != nil {
+		t.Fatalf("CmdDel: %v", err)
+	}
+
+	if len(flushed) != 1 || !flushed[0].Equal(net.ParseIP("10.244.1.2")) {
+		t.Fatalf("expected the flows of 10.244.1.2 to be deleted, got %v", flushed)
+	}
+	env.assertClean(t)
+}
@@ -1,14 +1,23 @@
 package plugin
 
 import (
+	"errors"
 	"fmt"
 	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ns"
-	ipa "github.com/royroyee/bvcni/pkg/ip"
+	"github.com/royroyee/bvcni/pkg/bandwidth"
+	"github.com/royroyee/bvcni/pkg/bridge"
+	"github.com/royroyee/bvcni/pkg/config"
+	"github.com/royroyee/bvcni/pkg/hostport"
 	"github.com/royroyee/bvcni/pkg/log"
-	"github.com/vishvananda/netlink"
 )
 
+// tearDownHostPorts is a variable so that tests can run without iptables.
+var tearDownHostPorts = hostport.TearDown
+
+// CmdDel releases everything ADD created for the container interface. Following the CNI spec,
+// it succeeds when the netns or the interface is already gone, and it may be called more than once.
 func CmdDel(args *skel.CmdArgs) error {
 	//// debug
 	log.Debugf("cmdDel details: containerID = %s, netNs = %s, ifName = %s, args = %s, path = %s, stdin = %s",
@@ -20,56 +29,77 @@ func CmdDel(args *skel.CmdArgs) error {
 		string(args.StdinData),
 	)
 
-	netns, err := ns.GetNS(args.Netns)
+	CNIConfig, err := config.LoadCNIConfig(args.StdinData)
 	if err != nil {
 		return err
 	}
 
-	defer netns.Close()
-
-	ip, err := fetchIPFromVethInNS(netns, args.IfName)
+	// The addresses are looked up before they are released, for the conntrack cleanup
+	ips, err := podIPs(CNIConfig, args.ContainerID, args.IfName)
 	if err != nil {
+		log.Debugf("cmdDel: failed to look up the pod IPs of %s/%s: %s", args.ContainerID, args.IfName, err.Error())
+	}
+
+	// The runtime may leave out the port mappings on DEL, so the chains of the pod are looked up by name.
+	// They go before the IPs, which the next pod may get.
+	if err = tearDownHostPorts(args.ContainerID, args.IfName); err != nil {
+		return err
+	}
+
+	if err = delVeth(args.Netns, args.IfName, bridge.HostVethName(args.ContainerID, args.IfName)); err != nil {
 		return err
 	}
 
-	err = ipa.ReturnIP(ip)
+	// Without its veth the pod sends no more packets, so no new flows show up after this. The flows go before
+	// the IPs: once released, a parallel ADD may hand them to a new pod, whose flows must not be deleted.
+	// A failure does not fail the DEL, the entries time out eventually.
+	deleted, err := flushConntrack(ips)
 	if err != nil {
+		log.Debugf("cmdDel: %s", err.Error())
+	}
+	log.Debugf("cmdDel: deleted %d conntrack entries of %v", deleted, ips)
+
+	if err = delIPAM(CNIConfig, args); err != nil {
+		return err
+	}
+
+	// The ifb device only exists for pods with an egress limit
+	if err = bandwidth.TearDown(bandwidth.IfbName(args.ContainerID, args.IfName)); err != nil {
 		return err
 	}
+
 	return nil
 }
 
-// return the IP address for the ifName in container Namespace.
-func fetchIPFromVethInNS(netns ns.NetNS, ifName string) (string, error) {
-	var ip string
-	err := netns.Do(func(_ ns.NetNS) error {
-		// Fetch the veth interface.
-		link, err := netlink.LinkByName(ifName)
-		if err != nil {
-			return fmt.Errorf("failed to lookup veth %q in %q: %v", ifName, netns.Path(), err)
-		}
+// delVeth deletes the veth pair from the host side. Deleting one end removes its peer as well.
+func delVeth(netnsPath, ifName, hostVethName string) error {
+	err := ip.DelLinkByName(hostVethName)
+	if err == nil {
+		return nil
+	}
 
-		// Check if the interface is of type veth.
-		if _, ok := link.(*netlink.Veth); !ok {
-			return fmt.Errorf("link %s already exists but is not a veth type", ifName)
-		}
+	if !errors.Is(err, ip.ErrLinkNotFound) {
+		return fmt.Errorf("failed to delete host veth %q: %w", hostVethName, err)
+	}
 
-		// List all addresses associated with the veth.
-		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
-		if err != nil {
-			return fmt.Errorf("failed to list address for veth %q: %v", ifName, err)
-		}
+	// The host veth may have been removed already, or the pod was created before host veths had
+	// stable names. Fall back to deleting the container end if the netns still exists.
+	if netnsPath == "" {
+		return nil
+	}
 
-		// Ensure that there is only one address.
-		if len(addrs) != 1 {
-			return fmt.Errorf("unexpected number of addresses for veth %q: %v", ifName, len(addrs))
+	err = ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		if err := ip.DelLinkByName(ifName); err != nil && !errors.Is(err, ip.ErrLinkNotFound) {
+			return err
 		}
-
-		// Save the IP address.
-		ip = addrs[0].IPNet.String()
 		return nil
 	})
 
-	// Return the fetched IP address, if any.
-	return ip, err
+	var notExistErr ns.NSPathNotExistErr
+	var notNSErr ns.NSPathNotNSErr
+	if err != nil && !errors.As(err, &notExistErr) && !errors.As(err, &notNSErr) {
+		return fmt.Errorf("failed to delete %q in %q: %w", ifName, netnsPath, err)
+	}
+
+	return nil
 }
@@ -0,0 +1,177 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/royroyee/bvcni/pkg/bandwidth"
+	"github.com/royroyee/bvcni/pkg/bridge"
+	"github.com/royroyee/bvcni/pkg/config"
+	"github.com/royroyee/bvcni/pkg/hostport"
+	"github.com/royroyee/bvcni/pkg/log"
+	"github.com/vishvananda/netlink"
+	"strings"
+)
+
+// hostPortAttachments is a variable so that tests can run without iptables.
+var hostPortAttachments = hostport.Attachments
+
+// CmdGC releases what the runtime no longer knows about (CNI 1.1): the host ports, allocations, host veths and ifb
+// devices of every container interface that is not in the cni.dev/valid-attachments list.
+func CmdGC(args *skel.CmdArgs) error {
+	//// debug
+	log.Debugf("cmdGC details: path = %s, stdin = %s", args.Path, string(args.StdinData))
+
+	CNIConfig, err := config.LoadCNIConfig(args.StdinData)
+	if err != nil {
+		return types.NewError(types.ErrDecodingFailure, "failed to load netconf", err.Error())
+	}
+
+	valid := make(map[string]bool, len(CNIConfig.ValidAttachments))
+	for _, attachment := range CNIConfig.ValidAttachments {
+		valid[attachment.ContainerID+"/"+attachment.IfName] = true
+	}
+
+	// The host ports DNAT to the IPs, which the next pod may get: they go before the IPs, whoever allocated them
+	if err = gcHostPorts(valid); err != nil {
+		return types.NewError(types.ErrInternal, "failed to delete stale host ports", err.Error())
+	}
+
+	if delegatesIPAM(CNIConfig) {
+		// The IPAM plugin gets the same valid attachments with the netconf
+		if err = invoke.DelegateGC(context.TODO(), CNIConfig.IPAM.Type, args.StdinData, nil); err != nil {
+			return types.NewError(types.ErrInternal, fmt.Sprintf("IPAM plugin %q GC failed", CNIConfig.IPAM.Type), err.Error())
+		}
+	} else if err = gcAllocations(CNIConfig, valid); err != nil {
+		return types.NewError(types.ErrIOFailure, "failed to release stale allocations", err.Error())
+	}
+
+	if err = gcHostVeths(CNIConfig.ValidAttachments); err != nil {
+		return types.NewError(types.ErrInternal, "failed to delete stale host veths", err.Error())
+	}
+
+	if err = gcIfbDevices(CNIConfig.ValidAttachments); err != nil {
+		return types.NewError(types.ErrInternal, "failed to delete stale ifb devices", err.Error())
+	}
+
+	return nil
+}
+
+// gcAllocations releases the allocations of the container interfaces (containerID/ifName) that are not valid.
+// Sticky IPs stay reserved for their pod, as after a DEL.
+func gcAllocations(CNIConfig *config.CNIConfig, valid map[string]bool) error {
+	store, err := openStore(CNIConfig)
+	if err != nil {
+		return err
+	}
+
+	allocs, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	for _, alloc := range allocs {
+		if valid[alloc.ContainerID+"/"+alloc.IfName] {
+			continue
+		}
+
+		log.Debugf("cmdGC: releasing %s of %s/%s", alloc.Address, alloc.ContainerID, alloc.IfName)
+		if err = store.ReturnIPWithGracePeriod(alloc.ContainerID, alloc.IfName, CNIConfig.StickyIPGrace()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// gcHostPorts removes the host ports of the container interfaces (containerID/ifName) that are not valid.
+// They are found through the iptables rules, so that the host ports of pods of an IPAM plugin go as well.
+func gcHostPorts(valid map[string]bool) error {
+	attachments, err := hostPortAttachments()
+	if err != nil {
+		return err
+	}
+
+	for _, attachment := range attachments {
+		if valid[attachment.ContainerID+"/"+attachment.IfName] {
+			continue
+		}
+
+		log.Debugf("cmdGC: deleting host ports of %s/%s", attachment.ContainerID, attachment.IfName)
+		if err = tearDownHostPorts(attachment.ContainerID, attachment.IfName); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// gcHostVeths deletes the host veths on cni0 that do not belong to a valid attachment. Only veths with the stable
+// names of bridge.HostVethName are considered; older random names cannot be mapped to their container.
+func gcHostVeths(attachments []types.GCAttachment) error {
+	br, err := netlink.LinkByName(bridge.BridgeName)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to lookup %q: %w", bridge.BridgeName, err)
+	}
+
+	valid := make(map[string]bool, len(attachments))
+	for _, attachment := range attachments {
+		valid[bridge.HostVethName(attachment.ContainerID, attachment.IfName)] = true
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("failed to list links: %w", err)
+	}
+
+	stableLen := len(bridge.HostVethName("", ""))
+	for _, link := range links {
+		name := link.Attrs().Name
+		if link.Type() != "veth" || link.Attrs().MasterIndex != br.Attrs().Index || len(name) != stableLen || valid[name] {
+			continue
+		}
+
+		log.Debugf("cmdGC: deleting host veth %s", name)
+		if err = ip.DelLinkByName(name); err != nil && !errors.Is(err, ip.ErrLinkNotFound) {
+			return fmt.Errorf("failed to delete host veth %q: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// gcIfbDevices deletes the ifb devices (bandwidth.IfbName) that do not belong to a valid attachment.
+func gcIfbDevices(attachments []types.GCAttachment) error {
+	valid := make(map[string]bool, len(attachments))
+	for _, attachment := range attachments {
+		valid[bandwidth.IfbName(attachment.ContainerID, attachment.IfName)] = true
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("failed to list links: %w", err)
+	}
+
+	ifbLen := len(bandwidth.IfbName("", ""))
+	for _, link := range links {
+		name := link.Attrs().Name
+		if link.Type() != "ifb" || len(name) != ifbLen || !strings.HasPrefix(name, "bwp") || valid[name] {
+			continue
+		}
+
+		log.Debugf("cmdGC: deleting ifb device %s", name)
+		if err = bandwidth.TearDown(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
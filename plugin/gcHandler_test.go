@@ -0,0 +1,169 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/royroyee/bvcni/pkg/bandwidth"
+	"github.com/royroyee/bvcni/pkg/bridge"
+	"github.com/royroyee/bvcni/pkg/hostport"
+	ipa "github.com/royroyee/bvcni/pkg/ip"
+	"github.com/vishvananda/netlink"
+)
+
+// gc runs GC in the fake host with the given valid attachments.
+func (e *testEnv) gc(t *testing.T, validAttachments string) {
+	e.gcWithIPAM(t, "", validAttachments)
+}
+
+// gcWithIPAM runs GC with the "ipam" section ipam, none if it is empty.
+func (e *testEnv) gcWithIPAM(t *testing.T, ipam, validAttachments string) {
+	if ipam != "" {
+		ipam = `,"ipam":` + ipam
+	}
+	args := &skel.CmdArgs{
+		StdinData: []byte(fmt.Sprintf(`{"cniVersion":"1.1.0","name":"bvcni","type":"bvcni","podcidr":"10.244.1.0/24","dataDir":%q%s,"cni.dev/valid-attachments":%s}`,
+			e.dataDir, ipam, validAttachments)),
+	}
+
+	if err := e.hostNS.Do(func(_ ns.NetNS) error { return CmdGC(args) }); err != nil {
+		t.Fatalf("CmdGC: %v", err)
+	}
+}
+
+func TestCmdGC(t *testing.T) {
+	env := newTestEnv(t)
+
+	if err := env.add(t, env.args("10.244.1.0/24")); err != nil {
+		t.Fatalf("CmdAdd: %v", err)
+	}
+
+	// The attachment is valid: nothing changes
+	env.gc(t, fmt.Sprintf(`[{"containerID":%q,"ifname":%q}]`, testContainerID, testIfName))
+
+	store, err := ipa.NewStore(env.dataDir)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	if allocs, err := store.Get(testContainerID, testIfName); err != nil || len(allocs) != 1 {
+		t.Fatalf("expected the allocation of a valid attachment to stay, got %v (%v)", allocs, err)
+	}
+	_ = env.hostNS.Do(func(_ ns.NetNS) error {
+		if _, err := netlink.LinkByName(bridge.HostVethName(testContainerID, testIfName)); err != nil {
+			t.Errorf("host veth of a valid attachment deleted: %v", err)
+		}
+		return nil
+	})
+
+	// The runtime forgot the container: everything goes
+	env.gc(t, `[{"containerID":"other-container","ifname":"eth0"}]`)
+	env.assertClean(t)
+}
+
+func TestCmdGCBandwidth(t *testing.T) {
+	env := newTestEnv(t)
+
+	args := env.args("10.244.1.0/24")
+	conf := strings.TrimSuffix(string(args.StdinData), "}")
+	args.StdinData = []byte(conf + `,"runtimeConfig":{"bandwidth":{"egressRate":1000000,"egressBurst":1000000}}}`)
+	if err := env.add(t, args); err != nil {
+		t.Fatalf("CmdAdd: %v", err)
+	}
+
+	ifbName := bandwidth.IfbName(testContainerID, testIfName)
+	ifbExists := func() bool {
+		var err error
+		_ = env.hostNS.Do(func(_ ns.NetNS) error {
+			_, err = netlink.LinkByName(ifbName)
+			return nil
+		})
+		return err == nil
+	}
+
+	env.gc(t, fmt.Sprintf(`[{"containerID":%q,"ifname":%q}]`, testContainerID, testIfName))
+	if !ifbExists() {
+		t.Fatalf("ifb device of a valid attachment deleted")
+	}
+
+	env.gc(t, `[]`)
+	if ifbExists() {
+		t.Fatalf("ifb device was not deleted")
+	}
+	env.assertClean(t)
+}
+
+func TestCmdGCHostPorts(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		ipam string
+	}{
+		{"built-in allocator", ""},
+		// GC of the IPAM plugin does not know about host ports, bvcni removes them all the same
+		{"IPAM plugin", `{"type":"stub-ipam"}`},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			env := newTestEnv(t)
+
+			origSetUp, origTearDown, origAttachments := setUpHostPorts, tearDownHostPorts, hostPortAttachments
+			defer func() {
+				setUpHostPorts, tearDownHostPorts, hostPortAttachments = origSetUp, origTearDown, origAttachments
+			}()
+
+			// The containers with host port rules, as installed by the fake iptables
+			installed := map[string]bool{}
+			setUpHostPorts = func(containerID, ifName string, podIPs []net.IP, mappings []hostport.PortMapping) error {
+				installed[containerID+"/"+ifName] = true
+				return nil
+			}
+			tearDownHostPorts = func(containerID, ifName string) error {
+				delete(installed, containerID+"/"+ifName)
+				return nil
+			}
+			hostPortAttachments = func() ([]hostport.Attachment, error) {
+				var attachments []hostport.Attachment
+				for key := range installed {
+					containerID, ifName, _ := strings.Cut(key, "/")
+					attachments = append(attachments, hostport.Attachment{ContainerID: containerID, IfName: ifName})
+				}
+				return attachments, nil
+			}
+
+			args := env.args("10.244.1.0/24")
+			conf := strings.TrimSuffix(string(args.StdinData), "}")
+			var stubDir string
+			if c.ipam != "" {
+				stubDir = newStubIPAM(t)
+				conf += `,"ipam":` + c.ipam
+			}
+			args.StdinData = []byte(conf + `,"runtimeConfig":{"portMappings":[{"hostPort":8080,"containerPort":80,"protocol":"tcp"}]}}`)
+			if err := env.add(t, args); err != nil {
+				t.Fatalf("CmdAdd: %v", err)
+			}
+			// Host ports of a container the runtime forgot about before GC existed
+			installed["leaked-container/eth0"] = true
+			if stubDir != "" {
+				// GC is called by the runtime without the test helpers, CNI_PATH is set by hand
+				t.Setenv("CNI_PATH", stubDir)
+			}
+
+			env.gcWithIPAM(t, c.ipam, fmt.Sprintf(`[{"containerID":%q,"ifname":%q}]`, testContainerID, testIfName))
+			if !installed[testContainerID+"/"+testIfName] {
+				t.Fatalf("host ports of a valid attachment deleted")
+			}
+			if installed["leaked-container/eth0"] {
+				t.Fatalf("host ports of a stale attachment not deleted")
+			}
+
+			// The host ports would DNAT to the IP the next pod gets
+			env.gcWithIPAM(t, c.ipam, `[]`)
+			if len(installed) != 0 {
+				t.Fatalf("host ports not deleted: %v", installed)
+			}
+			env.assertClean(t)
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/royroyee/bvcni/pkg/config"
+	ipa "github.com/royroyee/bvcni/pkg/ip"
+	"net"
+	"strings"
+)
+
+// Addressing is done by the built-in allocator (pkg/ip) unless the network config has an "ipam"
+// section, ex) "ipam": {"type": "host-local", ...}. Then the named IPAM plugin is called through
+// the CNI invoke helpers with the same netconf, and bvcni only does the bridge and veth plumbing.
+// The delegated plugin must hand out addresses from the node's pod CIDR, with the cni0 address as gateway.
+
+// delegatesIPAM reports whether addressing is delegated to an IPAM plugin.
+func delegatesIPAM(CNIConfig *config.CNIConfig) bool {
+	return CNIConfig.IPAM.Type != ""
+}
+
+// openStore opens the IPAM store of the built-in allocator, with the quarantine of the network config.
+func openStore(CNIConfig *config.CNIConfig) (*ipa.Store, error) {
+	store, err := ipa.NewStore(CNIConfig.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	store.SetQuarantine(CNIConfig.IPQuarantine())
+
+	return store, nil
+}
+
+// addIPAM obtains the addresses for the container interface and returns them with their routes,
+// and a function that releases them again on rollback.
+func addIPAM(CNIConfig *config.CNIConfig, args *skel.CmdArgs) ([]*current.IPConfig, []*types.Route, func() error, error) {
+	if !delegatesIPAM(CNIConfig) {
+		store, err := openStore(CNIConfig)
+		if err != nil {
+			return nil, nil, nil, types.NewError(types.ErrIOFailure, "failed to open IPAM store", err.Error())
+		}
+
+		// The pod may ask for fixed addresses with the bvcni.io/ip annotation, or get its sticky IPs back
+		req, err := podRequest(CNIConfig, args)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		// obtain the pod IP and gateway IP addresses from each pod CIDR (IPv4 and IPv6 on dual-stack nodes).
+		// The IPAM store is locked while the addresses are chosen, so parallel ADDs never hand out the same IP.
+		allocs, err := store.Allocate(CNIConfig.PodCIDRs(), CNIConfig.Ranges, req)
+		switch {
+		case errors.Is(err, ipa.ErrIPOutOfRange):
+			return nil, nil, nil, types.NewError(ErrStaticIP, fmt.Sprintf("requested IP is not usable on this node (%s)", strings.Join(CNIConfig.PodCIDRs(), ",")), err.Error())
+		case errors.Is(err, ipa.ErrIPInUse):
+			return nil, nil, nil, types.NewError(ErrStaticIPInUse, "requested IP is already allocated", err.Error())
+		case err != nil:
+			return nil, nil, nil, types.NewError(types.ErrInternal, "failed to allocate IP", err.Error())
+		}
+		release := func() error {
+			return store.ReturnIPWithGracePeriod(args.ContainerID, args.IfName, CNIConfig.StickyIPGrace())
+		}
+
+		ips, routes, err := ipConfigs(allocs)
+		if err != nil {
+			return nil, nil, release, types.NewError(types.ErrInternal, "invalid IP allocation", err.Error())
+		}
+
+		return ips, routes, release, nil
+	}
+
+	r, err := ipam.ExecAdd(CNIConfig.IPAM.Type, args.StdinData)
+	if err != nil {
+		return nil, nil, nil, types.NewError(types.ErrInternal, fmt.Sprintf("IPAM plugin %q failed", CNIConfig.IPAM.Type), err.Error())
+	}
+	release := func() error {
+		return ipam.ExecDel(CNIConfig.IPAM.Type, args.StdinData)
+	}
+
+	result, err := current.NewResultFromResult(r)
+	if err != nil {
+		return nil, nil, release, types.NewError(types.ErrDecodingFailure, "failed to convert IPAM result", err.Error())
+	}
+
+	if len(result.IPs) == 0 {
+		return nil, nil, release, types.NewError(types.ErrInternal, fmt.Sprintf("IPAM plugin %q returned no IP", CNIConfig.IPAM.Type), "")
+	}
+
+	// Every IP belongs to the container interface (Interfaces[2]).
+	for _, ipc := range result.IPs {
+		ipc.Interface = current.Int(2)
+	}
+
+	routes := result.Routes
+	if len(routes) == 0 {
+		routes = defaultRoutes(result.IPs)
+	}
+
+	return result.IPs, routes, release, nil
+}
+
+// delIPAM releases the addresses of the container interface. Releasing twice is not an error.
+func delIPAM(CNIConfig *config.CNIConfig, args *skel.CmdArgs) error {
+	if delegatesIPAM(CNIConfig) {
+		return ipam.ExecDel(CNIConfig.IPAM.Type, args.StdinData)
+	}
+
+	store, err := openStore(CNIConfig)
+	if err != nil {
+		return err
+	}
+
+	// The allocation is keyed by containerID/ifName, so the pod netns is not needed to find it.
+	// Sticky IPs stay reserved for the pod identity for the grace period.
+	return store.ReturnIPWithGracePeriod(args.ContainerID, args.IfName, CNIConfig.StickyIPGrace())
+}
+
+// checkIPAM verifies that the addresses of the result are still allocated to the container interface.
+func checkIPAM(CNIConfig *config.CNIConfig, args *skel.CmdArgs, result *current.Result) error {
+	if !delegatesIPAM(CNIConfig) {
+		return checkAllocation(CNIConfig.DataDir, args.ContainerID, args.IfName, result)
+	}
+
+	if err := ipam.ExecCheck(CNIConfig.IPAM.Type, args.StdinData); err != nil {
+		return types.NewError(ErrAllocation, fmt.Sprintf("IPAM plugin %q check failed", CNIConfig.IPAM.Type), err.Error())
+	}
+
+	return nil
+}
+
+// defaultRoutes returns a default route per IP family through the gateway of its IP.
+func defaultRoutes(ips []*current.IPConfig) []*types.Route {
+	var routes []*types.Route
+	for _, ipc := range ips {
+		if ipc.Gateway == nil {
+			continue
+		}
+
+		defaultDst := net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+		if ipc.Gateway.To4() == nil {
+			defaultDst = net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+		}
+		routes = append(routes, &types.Route{Dst: defaultDst, GW: ipc.Gateway})
+	}
+
+	return routes
+}
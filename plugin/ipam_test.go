@@ -0,0 +1,151 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/royroyee/bvcni/pkg/config"
+	"github.com/vishvananda/netlink"
+)
+
+// stubIPAM is an IPAM plugin that hands out 10.244.1.77 and records the verbs it is called with in calls.
+// CHECK and STATUS fail while a file named after the verb (fail-CHECK, fail-STATUS) exists next to it.
+const stubIPAM = `#!/bin/sh
+dir=$(dirname "$0")
+cat > /dev/null
+echo "$CNI_COMMAND" >> "$dir/calls"
+if [ -e "$dir/fail-$CNI_COMMAND" ]; then
+	echo '{"cniVersion":"1.0.0","code":11,"msg":"stub failure"}'
+	exit 1
+fi
+if [ "$CNI_COMMAND" = ADD ]; then
+	echo '{"cniVersion":"1.0.0","ips":[{"address":"10.244.1.77/24","gateway":"10.244.1.1"}]}'
+fi
+`
+
+// newStubIPAM installs the stub IPAM plugin in a directory on PATH, which the test helpers pass as CNI_PATH.
+func newStubIPAM(t *testing.T) string {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "stub-ipam"), []byte(stubIPAM), 0755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	return dir
+}
+
+// stubCalls returns the verbs the stub IPAM plugin was called with.
+func stubCalls(t *testing.T, dir string) string {
+	calls, err := os.ReadFile(filepath.Join(dir, "calls"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	return strings.Join(strings.Fields(string(calls)), ",")
+}
+
+func TestDelegatedIPAM(t *testing.T) {
+	env := newTestEnv(t)
+	stubDir := newStubIPAM(t)
+
+	args := env.args("10.244.1.0/24")
+	args.StdinData = []byte(strings.TrimSuffix(string(args.StdinData), "}") + `,"ipam":{"type":"stub-ipam"}}`)
+
+	result := env.addResult(t, args)
+	if len(result.IPs) != 1 || result.IPs[0].Address.String() != "10.244.1.77/24" {
+		t.Fatalf("expected the IP of the IPAM plugin, got %v", result.IPs)
+	}
+	if result.IPs[0].Interface == nil || *result.IPs[0].Interface != 2 {
+		t.Errorf("expected the IP to point at the container interface (2), got %v", result.IPs[0].Interface)
+	}
+	if len(result.Routes) != 1 || !result.Routes[0].GW.Equal(result.IPs[0].Gateway) {
+		t.Errorf("expected a default route via the gateway of the IPAM plugin, got %v", result.Routes)
+	}
+
+	// CHECK asks the IPAM plugin whether the allocation is still there
+	if err := env.check(t, args, result); err != nil {
+		t.Fatalf("CmdCheck: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(stubDir, "fail-CHECK"), nil, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	var cniErr *types.Error
+	if err := env.check(t, args, result); !errors.As(err, &cniErr) || cniErr.Code != ErrAllocation {
+		t.Fatalf("expected CHECK to fail with code %d, got %v", ErrAllocation, err)
+	}
+
+	if err := env.hostNS.Do(func(_ ns.NetNS) error {
+		return testutils.CmdDelWithArgs(args, func() error { return CmdDel(args) })
+	}); err != nil {
+		t.Fatalf("CmdDel: %v", err)
+	}
+	env.assertClean(t)
+
+	// GC and STATUS are called by the runtime without the test helpers, CNI_PATH is set by hand
+	t.Setenv("CNI_PATH", stubDir)
+	conf := fmt.Sprintf(`{"cniVersion":"1.1.0","name":"bvcni","type":"bvcni","podcidr":"10.244.1.0/24","dataDir":%q,"ipam":{"type":"stub-ipam"}`, env.dataDir)
+
+	gcArgs := &skel.CmdArgs{StdinData: []byte(conf + `,"cni.dev/valid-attachments":[]}`)}
+	if err := env.hostNS.Do(func(_ ns.NetNS) error { return CmdGC(gcArgs) }); err != nil {
+		t.Fatalf("CmdGC: %v", err)
+	}
+
+	if err := config.MarkReady(env.dataDir, "vxlan.1"); err != nil {
+		t.Fatalf("MarkReady: %v", err)
+	}
+	statusArgs := &skel.CmdArgs{StdinData: []byte(conf + `}`)}
+	status := func() error {
+		return env.hostNS.Do(func(_ ns.NetNS) error {
+			if err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "vxlan.1"}}); err != nil && !os.IsExist(err) {
+				return err
+			}
+			return CmdStatus(statusArgs)
+		})
+	}
+	if err := status(); err != nil {
+		t.Fatalf("CmdStatus: %v", err)
+	}
+	// The error of the IPAM plugin is passed on
+	if err := os.WriteFile(filepath.Join(stubDir, "fail-STATUS"), nil, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := status(); !errors.As(err, &cniErr) || cniErr.Code != 11 {
+		t.Fatalf("expected the STATUS error of the IPAM plugin, got %v", err)
+	}
+
+	if calls := stubCalls(t, stubDir); calls != "ADD,CHECK,CHECK,DEL,GC,STATUS,STATUS" {
+		t.Fatalf("unexpected IPAM plugin calls %s", calls)
+	}
+}
+
+func TestDelegatedIPAMRejectsAllocatorSettings(t *testing.T) {
+	env := newTestEnv(t)
+	stubDir := newStubIPAM(t)
+
+	for _, setting := range []string{
+		`"kubeconfig":"/etc/cni/net.d/bvcni.kubeconfig"`,
+		`"stickyIPGracePeriod":"10m"`,
+		`"ipQuarantinePeriod":"1m"`,
+	} {
+		args := env.args("10.244.1.0/24")
+		args.StdinData = []byte(strings.TrimSuffix(string(args.StdinData), "}") + `,"ipam":{"type":"stub-ipam"},` + setting + `}`)
+
+		var cniErr *types.Error
+		if err := env.add(t, args); !errors.As(err, &cniErr) || cniErr.Code != types.ErrInvalidNetworkConfig {
+			t.Errorf("%s: expected error code %d, got %v", setting, types.ErrInvalidNetworkConfig, err)
+		}
+	}
+
+	if calls := stubCalls(t, stubDir); calls != "" {
+		t.Fatalf("expected the IPAM plugin not to be called, got %s", calls)
+	}
+	env.assertClean(t)
+}
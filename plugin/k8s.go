@@ -0,0 +1,131 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/royroyee/bvcni/pkg/config"
+	ipa "github.com/royroyee/bvcni/pkg/ip"
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// staticIPAnnotationKey requests fixed pod IPs, one per IP family. ex) bvcni.io/ip: "10.244.1.50,fd00:10:244:1::50"
+const staticIPAnnotationKey = "bvcni.io/ip"
+
+const podLookupTimeout = 10 * time.Second
+
+// K8sArgs are the CNI_ARGS kubelet passes to the plugin.
+type K8sArgs struct {
+	types.CommonArgs
+	K8S_POD_NAMESPACE          types.UnmarshallableString
+	K8S_POD_NAME               types.UnmarshallableString
+	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString
+}
+
+// getPod is a variable so that tests can fake the API server.
+var getPod = lookupPod
+
+// lookupPod reads a pod with the kubeconfig bvcnid wrote.
+func lookupPod(kubeconfig, namespace, name string) (*coreV1.Pod, error) {
+	restConfig, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig %s: %w", kubeconfig, err)
+	}
+	restConfig.Timeout = podLookupTimeout
+
+	clientSet, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create k8s client: %w", err)
+	}
+
+	pod, err := clientSet.CoreV1().Pods(namespace).Get(context.TODO(), name, metaV1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pod %s/%s: %w", namespace, name, err)
+	}
+
+	return pod, nil
+}
+
+// podRequest returns the IPAM request of the container interface, with the pod and netns it belongs to. For the pod of CNI_ARGS it holds
+// the IPs of the bvcni.io/ip annotation and, if sticky IPs are enabled and a StatefulSet owns the pod,
+// the pod's namespace/name as owner. Outside of kubernetes (no pod in CNI_ARGS or no kubeconfig) there is nothing to look up.
+func podRequest(CNIConfig *config.CNIConfig, args *skel.CmdArgs) (ipa.Request, error) {
+	req := ipa.Request{ContainerID: args.ContainerID, IfName: args.IfName, Netns: args.Netns}
+
+	k8sArgs := K8sArgs{}
+	if err := types.LoadArgs(args.Args, &k8sArgs); err != nil {
+		return req, types.NewError(types.ErrInvalidEnvironmentVariables, "failed to parse CNI_ARGS", err.Error())
+	}
+
+	if k8sArgs.K8S_POD_NAME != "" {
+		req.Pod = string(k8sArgs.K8S_POD_NAMESPACE) + "/" + string(k8sArgs.K8S_POD_NAME)
+	}
+
+	if k8sArgs.K8S_POD_NAME == "" || CNIConfig.Kubeconfig == "" {
+		return req, nil
+	}
+	// bvcnid writes the kubeconfig when it starts; until it is there the annotations cannot be read, kubelet retries.
+	if _, err := os.Stat(CNIConfig.Kubeconfig); err != nil {
+		return req, types.NewError(types.ErrTryAgainLater, fmt.Sprintf("kubeconfig %s is not readable", CNIConfig.Kubeconfig), err.Error())
+	}
+
+	pod, err := getPod(CNIConfig.Kubeconfig, string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME))
+	if err != nil {
+		// Handing out a dynamic IP to a pod that asked for a static one would be wrong, kubelet retries instead.
+		return req, types.NewError(types.ErrTryAgainLater, "failed to look up the pod", err.Error())
+	}
+
+	if req.IPs, err = annotationIPs(pod.Annotations); err != nil {
+		return req, err
+	}
+
+	if CNIConfig.StickyIPGrace() > 0 && ownedByStatefulSet(pod) {
+		req.Owner = pod.Namespace + "/" + pod.Name
+	}
+
+	return req, nil
+}
+
+// annotationIPs returns the IPs of the bvcni.io/ip annotation, or nil if the pod does not request any.
+func annotationIPs(annotations map[string]string) ([]net.IP, error) {
+	value, ok := annotations[staticIPAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+
+	var ips []net.IP
+	for _, s := range strings.Split(value, ",") {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		if ip == nil {
+			return nil, types.NewError(ErrStaticIP, fmt.Sprintf("invalid IP %q in the %s annotation", s, staticIPAnnotationKey), value)
+		}
+
+		for _, other := range ips {
+			if (other.To4() != nil) == (ip.To4() != nil) {
+				return nil, types.NewError(ErrStaticIP, fmt.Sprintf("more than one IP per IP family in the %s annotation", staticIPAnnotationKey), value)
+			}
+		}
+		ips = append(ips, ip)
+	}
+
+	return ips, nil
+}
+
+// ownedByStatefulSet reports whether the pod belongs to a StatefulSet, the pods with a stable identity.
+func ownedByStatefulSet(pod *coreV1.Pod) bool {
+	for _, ref := range pod.OwnerReferences {
+		if ref.Kind == "StatefulSet" && ref.Controller != nil && *ref.Controller {
+			return true
+		}
+	}
+
+	return false
+}
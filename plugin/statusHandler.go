@@ -0,0 +1,54 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/royroyee/bvcni/pkg/config"
+	"github.com/royroyee/bvcni/pkg/log"
+	"github.com/vishvananda/netlink"
+	"os"
+)
+
+// ErrPluginNotAvailable is the well known STATUS error (CNI 1.1) of a plugin that cannot serve ADD yet.
+const ErrPluginNotAvailable uint = 50
+
+// CmdStatus reports whether the plugin can serve ADD (CNI 1.1): bvcnid must have written the config file,
+// set up the overlay device (ex. vxlan.1) and programmed iptables, and a delegated IPAM plugin must be ready as well.
+func CmdStatus(args *skel.CmdArgs) error {
+	//// debug
+	log.Debugf("cmdStatus details: path = %s, stdin = %s", args.Path, string(args.StdinData))
+
+	CNIConfig, err := config.LoadCNIConfig(args.StdinData)
+	if err != nil {
+		return types.NewError(types.ErrDecodingFailure, "failed to load netconf", err.Error())
+	}
+
+	readiness, err := config.ReadReady(CNIConfig.DataDir)
+	if os.IsNotExist(err) {
+		return types.NewError(ErrPluginNotAvailable, "bvcnid has not set up the node yet", "")
+	}
+	if err != nil {
+		return types.NewError(ErrPluginNotAvailable, "failed to read the bvcnid ready file", err.Error())
+	}
+
+	// The ready file outlives a reboot, the overlay device does not
+	if _, err = netlink.LinkByName(readiness.Device); err != nil {
+		return types.NewError(ErrPluginNotAvailable, fmt.Sprintf("overlay device %s is missing", readiness.Device), err.Error())
+	}
+
+	if delegatesIPAM(CNIConfig) {
+		if err = invoke.DelegateStatus(context.TODO(), CNIConfig.IPAM.Type, args.StdinData, nil); err != nil {
+			var cniErr *types.Error
+			if errors.As(err, &cniErr) {
+				return cniErr
+			}
+			return types.NewError(ErrPluginNotAvailable, fmt.Sprintf("IPAM plugin %q is not available", CNIConfig.IPAM.Type), err.Error())
+		}
+	}
+
+	return nil
+}
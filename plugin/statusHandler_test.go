@@ -0,0 +1,58 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/royroyee/bvcni/pkg/config"
+	"github.com/vishvananda/netlink"
+)
+
+func TestCmdStatus(t *testing.T) {
+	env := newTestEnv(t)
+
+	args := &skel.CmdArgs{
+		StdinData: []byte(fmt.Sprintf(`{"cniVersion":"1.1.0","name":"bvcni","type":"bvcni","podcidr":"10.244.1.0/24","dataDir":%q}`, env.dataDir)),
+	}
+	status := func() error {
+		var statusErr error
+		_ = env.hostNS.Do(func(_ ns.NetNS) error {
+			statusErr = CmdStatus(args)
+			return nil
+		})
+		return statusErr
+	}
+	assertNotAvailable := func(stage string) {
+		var cniErr *types.Error
+		if err := status(); !errors.As(err, &cniErr) || cniErr.Code != ErrPluginNotAvailable {
+			t.Fatalf("%s: expected error code %d, got %v", stage, ErrPluginNotAvailable, err)
+		}
+	}
+
+	assertNotAvailable("before bvcnid is ready")
+
+	// bvcnid is done, but the VXLAN device is gone (ex. after a reboot)
+	if err := config.MarkReady(env.dataDir, "vxlan.1"); err != nil {
+		t.Fatalf("MarkReady: %v", err)
+	}
+	assertNotAvailable("without the VXLAN device")
+
+	// Only the name is checked, any link type will do
+	if err := env.hostNS.Do(func(_ ns.NetNS) error {
+		return netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "vxlan.1"}})
+	}); err != nil {
+		t.Fatalf("LinkAdd: %v", err)
+	}
+	if err := status(); err != nil {
+		t.Fatalf("expected ready, got %v", err)
+	}
+
+	if err := config.ClearReady(env.dataDir); err != nil {
+		t.Fatalf("ClearReady: %v", err)
+	}
+	assertNotAvailable("after bvcnid cleared the ready file")
+}